@@ -181,6 +181,8 @@ func TestUnit(t *testing.T) {
 
 	expectSet := func(tree *MutableTree, i int, repr string, hashCount int64) {
 		origNode := tree.root
+		// Unpersisted nodes are modified in place, so operate on a copy.
+		tree.root = origNode.cloneUnpersisted()
 		updated := tree.Set(i2b(i), []byte{})
 		// ensure node was added & structure is as expected.
 		if updated || P(tree.root) != repr {
@@ -194,6 +196,8 @@ func TestUnit(t *testing.T) {
 
 	expectRemove := func(tree *MutableTree, i int, repr string, hashCount int64) {
 		origNode := tree.root
+		// Unpersisted nodes are modified in place, so operate on a copy.
+		tree.root = origNode.cloneUnpersisted()
 		value, removed := tree.Remove(i2b(i))
 		// ensure node was added & structure is as expected.
 		if len(value) != 0 || !removed || P(tree.root) != repr {
@@ -27,6 +27,12 @@ type Cache interface {
 
 	// Len returns the cache length.
 	Len() int
+
+	// Cap returns the maximum cache length.
+	Cap() int
+
+	// Clear removes all nodes from the cache, keeping its capacity.
+	Clear()
 }
 
 // lruCache is an LRU cache implementation.
@@ -82,6 +88,17 @@ func (nc *lruCache) Len() int {
 	return nc.ll.Len()
 }
 
+func (c *lruCache) Cap() int {
+	return c.cacheLimit
+}
+
+func (c *lruCache) Clear() {
+	for key := range c.dict {
+		delete(c.dict, key)
+	}
+	c.ll.Init()
+}
+
 func (c *lruCache) Remove(key []byte) Node {
 	if elem, exists := c.dict[string(key)]; exists {
 		return c.remove(elem)
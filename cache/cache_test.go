@@ -3,6 +3,7 @@ package cache_test
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/cosmos/iavl/cache"
@@ -179,6 +180,38 @@ func Test_Cache_Add(t *testing.T) {
 	}
 }
 
+func Test_Cache_Cap(t *testing.T) {
+	c := cache.New(2)
+	require.Equal(t, 2, c.Cap())
+	for _, n := range testNodes {
+		c.Add(n)
+	}
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, 2, c.Cap())
+	require.Equal(t, 0, cache.New(0).Cap())
+}
+
+func Test_Cache_Clear(t *testing.T) {
+	c := cache.New(2)
+	for _, n := range testNodes {
+		c.Add(n)
+	}
+	c.Clear()
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, 2, c.Cap())
+	for _, n := range testNodes {
+		require.False(t, c.Has(n.GetKey()))
+	}
+
+	// The cleared cache is still usable, with the same capacity.
+	for _, n := range testNodes {
+		c.Add(n)
+	}
+	require.Equal(t, 2, c.Len())
+	require.False(t, c.Has(testNodes[0].GetKey()))
+	require.Equal(t, testNodes[2], c.Get(testNodes[2].GetKey()))
+}
+
 func Test_Cache_Remove(t *testing.T) {
 	testcases := map[string]testcase{
 		"remove non-existent key, cache limit 0 - nil returned": {
@@ -309,3 +342,52 @@ func randBytes(length int) []byte {
 	rand.Read(key)
 	return key
 }
+
+func Test_ShardedCache(t *testing.T) {
+	c := cache.NewSharded(10, 4)
+	require.Equal(t, 10, c.Cap())
+
+	nodes := make([]cache.Node, 100)
+	for i := range nodes {
+		nodes[i] = &testNode{key: []byte(fmt.Sprintf("%s%d", testKey, i))}
+		c.Add(nodes[i])
+		require.True(t, c.Has(nodes[i].GetKey()))
+		require.Equal(t, nodes[i], c.Get(nodes[i].GetKey()))
+	}
+	require.LessOrEqual(t, c.Len(), 10)
+	require.Positive(t, c.Len())
+
+	last := nodes[len(nodes)-1]
+	require.Equal(t, last, c.Remove(last.GetKey()))
+	require.Nil(t, c.Get(last.GetKey()))
+	require.Nil(t, c.Remove(last.GetKey()))
+
+	c.Clear()
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, 10, c.Cap())
+	require.Equal(t, 0, cache.NewSharded(0, 4).Cap())
+}
+
+func Test_ShardedCache_Concurrent(t *testing.T) {
+	c := cache.NewSharded(100, 8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				node := &testNode{key: []byte(fmt.Sprintf("%d-%d", g, i%50))}
+				c.Add(node)
+				if found := c.Get(node.GetKey()); found != nil {
+					require.Equal(t, node.GetKey(), found.GetKey())
+				}
+				if i%7 == 0 {
+					c.Remove(node.GetKey())
+				}
+				c.Len()
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Len(), 100)
+}
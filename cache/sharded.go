@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"sync"
+)
+
+// shardedCache is a Cache which is safe for concurrent use. Keys are spread over several LRU
+// caches, each guarded by its own mutex, so that concurrent accesses to different shards don't
+// contend on a single lock. Nodes are evicted in LRU order within their shard.
+type shardedCache struct {
+	shards     []cacheShard
+	cacheLimit int
+}
+
+type cacheShard struct {
+	mtx   sync.Mutex
+	cache Cache
+}
+
+var _ Cache = (*shardedCache)(nil)
+
+// NewSharded returns a Cache which is safe for concurrent use, splitting cacheLimit between the
+// given number of shards.
+func NewSharded(cacheLimit, shards int) Cache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &shardedCache{
+		shards:     make([]cacheShard, shards),
+		cacheLimit: cacheLimit,
+	}
+	for i := range c.shards {
+		limit := cacheLimit / shards
+		if i < cacheLimit%shards {
+			limit++
+		}
+		c.shards[i].cache = New(limit)
+	}
+	return c
+}
+
+func (c *shardedCache) shard(key []byte) *cacheShard {
+	if len(c.shards) == 1 {
+		return &c.shards[0]
+	}
+	// FNV-1a of up to the last 8 bytes of the key, inlined to avoid allocating a hash.Hash32.
+	// Node keys are hashes, and other keys typically differ in their last bytes.
+	if len(key) > 8 {
+		key = key[len(key)-8:]
+	}
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return &c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *shardedCache) Add(node Node) Node {
+	s := c.shard(node.GetKey())
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Add(node)
+}
+
+func (c *shardedCache) Get(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Get(key)
+}
+
+func (c *shardedCache) Has(key []byte) bool {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Has(key)
+}
+
+func (c *shardedCache) Remove(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Remove(key)
+}
+
+func (c *shardedCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		n += s.cache.Len()
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+func (c *shardedCache) Cap() int {
+	return c.cacheLimit
+}
+
+func (c *shardedCache) Clear() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		s.cache.Clear()
+		s.mtx.Unlock()
+	}
+}
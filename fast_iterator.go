@@ -18,6 +18,8 @@ type FastIterator struct {
 
 	ascending bool
 
+	keysOnly bool
+
 	err error
 
 	ndb *nodeDB
@@ -30,11 +32,18 @@ type FastIterator struct {
 var _ dbm.Iterator = &FastIterator{}
 
 func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterator {
+	return newFastIterator(start, end, ascending, ndb, false)
+}
+
+// newFastIterator returns a new fast iterator. If keysOnly is set, fast nodes are not decoded and
+// Value() always returns nil.
+func newFastIterator(start, end []byte, ascending bool, ndb *nodeDB, keysOnly bool) *FastIterator {
 	iter := &FastIterator{
 		start:        start,
 		end:          end,
 		err:          nil,
 		ascending:    ascending,
+		keysOnly:     keysOnly,
 		ndb:          ndb,
 		nextFastNode: nil,
 		fastIterator: nil,
@@ -82,6 +91,9 @@ func (iter *FastIterator) Valid() bool {
 // Key implements dbm.Iterator
 func (iter *FastIterator) Key() []byte {
 	if iter.valid {
+		if iter.keysOnly {
+			return iter.fastIterator.Key()[1:]
+		}
 		return iter.nextFastNode.key
 	}
 	return nil
@@ -89,7 +101,7 @@ func (iter *FastIterator) Key() []byte {
 
 // Value implements dbm.Iterator
 func (iter *FastIterator) Value() []byte {
-	if iter.valid {
+	if iter.valid && !iter.keysOnly {
 		return iter.nextFastNode.value
 	}
 	return nil
@@ -115,8 +127,8 @@ func (iter *FastIterator) Next() {
 	}
 
 	iter.valid = iter.valid && iter.fastIterator.Valid()
-	if iter.valid {
-		iter.nextFastNode, iter.err = DeserializeFastNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+	if iter.valid && !iter.keysOnly {
+		iter.nextFastNode, iter.err = iter.ndb.decodeFastNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
 		iter.valid = iter.err == nil
 	}
 }
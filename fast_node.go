@@ -18,6 +18,33 @@ type FastNode struct {
 
 var _ cache.Node = (*FastNode)(nil)
 
+// FastNodeMismatchKind describes how a fast node doesn't match the live tree.
+type FastNodeMismatchKind uint8
+
+const (
+	// FastNodeMissing means that there is no fast node for a key in the tree.
+	FastNodeMissing FastNodeMismatchKind = iota
+	// FastNodeExtra means that there is a fast node for a key which isn't in the tree.
+	FastNodeExtra
+	// FastNodeValueMismatch means that the fast node value differs from the tree value.
+	FastNodeValueMismatch
+	// FastNodeVersionMismatch means that the fast node wasn't updated between the version of the
+	// tree leaf and the latest version.
+	FastNodeVersionMismatch
+)
+
+// FastNodeMismatch is a key whose fast node doesn't match the live tree, as reported by
+// MutableTree.VerifyFastStorage. The tree value and version are those of the leaf node, and the
+// fast value and version those of the fast node, where missing ones are nil and 0.
+type FastNodeMismatch struct {
+	Kind        FastNodeMismatchKind
+	Key         []byte
+	TreeValue   []byte
+	TreeVersion int64
+	FastValue   []byte
+	FastVersion int64
+}
+
 // NewFastNode returns a new fast node from a value and version.
 func NewFastNode(key []byte, value []byte, version int64) *FastNode {
 	return &FastNode{
@@ -1,9 +1,14 @@
 package iavl
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math/bits"
 	"strings"
+	"sync/atomic"
 
+	"github.com/pkg/errors"
 	dbm "github.com/tendermint/tm-db"
 )
 
@@ -14,9 +19,10 @@ import (
 // Returned key/value byte slices must not be modified, since they may point to data located inside
 // IAVL which would also be modified.
 type ImmutableTree struct {
-	root    *Node
-	ndb     *nodeDB
-	version int64
+	root            *Node
+	ndb             *nodeDB
+	version         int64
+	skipFastStorage bool // Whether to bypass fast storage, e.g. for unsaved snapshots.
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -39,6 +45,53 @@ func NewImmutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) *Immutabl
 	}
 }
 
+// NewReadSnapshotTree opens a saved version of the tree in db read-only, e.g. in a separate
+// process from the one writing the tree, see NewReadSnapshotTreeWithOpts.
+func NewReadSnapshotTree(db dbm.DB, version int64) (*ImmutableTree, error) {
+	return NewReadSnapshotTreeWithOpts(db, version, 0, nil)
+}
+
+// NewReadSnapshotTreeWithOpts opens a saved version of the tree in db read-only, with the given
+// node cache size and options, which must match those of the writer for e.g. Options.NodeCodec.
+// Nothing is written to the database, so it can be opened while another process writes the tree.
+//
+// The tree only reads the nodes reachable from the root of the version, and never fast storage,
+// which reflects the latest version. Nodes are written atomically along with the root of their
+// version, and are never modified afterwards, so the tree doesn't observe partially written newer
+// versions, provided that the database commits batches atomically, like LevelDB, and that the
+// reading process sees writes in commit order. The writer must not delete the version, or prune
+// it, while it is read, since its nodes are deleted along with it, and reading them then panics.
+func NewReadSnapshotTreeWithOpts(db dbm.DB, version int64, cacheSize int, opts *Options) (*ImmutableTree, error) {
+	ndb := newNodeDB(db, cacheSize, opts)
+	rootHash, err := ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootHash == nil {
+		return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+	}
+	// The version exists, so the checks don't persist anything.
+	for _, check := range []func() error{
+		ndb.checkNodeCodec, ndb.checkLeafHashSalt, ndb.checkComparator, ndb.checkValueCodec,
+	} {
+		if err := check(); err != nil {
+			return nil, err
+		}
+	}
+
+	tree := &ImmutableTree{
+		ndb:             ndb,
+		version:         version,
+		skipFastStorage: true,
+	}
+	if len(rootHash) > 0 {
+		if tree.root, err = ndb.getNode(rootHash); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
 // String returns a string representation of Tree.
 func (t *ImmutableTree) String() string {
 	leaves := []string{}
@@ -117,6 +170,43 @@ func (t *ImmutableTree) Height() int8 {
 	return t.root.height
 }
 
+// NodeCount returns the number of leaf and inner nodes in the tree. Every inner node has exactly
+// two children, so the counts are derived from the root size without traversing the tree.
+func (t *ImmutableTree) NodeCount() (leaves int64, inner int64) {
+	leaves = t.Size()
+	if leaves == 0 {
+		return 0, 0
+	}
+	return leaves, leaves - 1
+}
+
+// BalanceFactors walks the tree and returns the maximum absolute balance factor of its inner
+// nodes, i.e. the difference between the heights of their left and right subtrees, and the number
+// of inner nodes which violate the AVL invariant of an absolute balance factor of at most 1. A
+// correctly built tree has no unbalanced nodes. This is a diagnostic which loads every node.
+func (t *ImmutableTree) BalanceFactors() (maxAbsBalance int, unbalancedNodes int) {
+	if t.root == nil {
+		return 0, 0
+	}
+	t.root.traverse(t, true, func(node *Node) bool {
+		if node.isLeaf() {
+			return false
+		}
+		balance := node.calcBalance(t)
+		if balance < 0 {
+			balance = -balance
+		}
+		if balance > maxAbsBalance {
+			maxAbsBalance = balance
+		}
+		if balance > 1 {
+			unbalancedNodes++
+		}
+		return false
+	})
+	return maxAbsBalance, unbalancedNodes
+}
+
 // Has returns whether or not a key exists.
 func (t *ImmutableTree) Has(key []byte) bool {
 	if t.root == nil {
@@ -127,13 +217,80 @@ func (t *ImmutableTree) Has(key []byte) bool {
 
 // Hash returns the root hash.
 func (t *ImmutableTree) Hash() []byte {
-	hash, _ := t.root.hashWithCount()
+	hash, _ := t.hashWithCount()
 	return hash
 }
 
-// hashWithCount returns the root hash and hash count.
+// StructuralEqual returns whether the tree is identical to other, i.e. has the same root hash. If
+// not, it also returns the key of the first node where the trees differ, comparing the trees node
+// by node from the root and skipping identical subtrees by their hashes. Differing nodes with the
+// same key are compared by their left subtrees first, then their right subtrees, and if those are
+// identical the node key itself is returned, e.g. for differing versions. If the trees have a
+// different shape, the lower of the two node keys where the shapes first diverge is returned.
+func (t *ImmutableTree) StructuralEqual(other *ImmutableTree) (equal bool, firstDiffKey []byte) {
+	if bytes.Equal(t.Hash(), other.Hash()) {
+		return true, nil
+	}
+	return false, firstDiffNodeKey(t, t.root, other, other.root)
+}
+
+// firstDiffNodeKey returns the key of the first node where the subtrees a and b differ, which must
+// be hashed. See StructuralEqual.
+func firstDiffNodeKey(at *ImmutableTree, a *Node, bt *ImmutableTree, b *Node) []byte {
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case a == nil:
+		return b.key
+	case b == nil:
+		return a.key
+	case bytes.Equal(a.hash, b.hash):
+		return nil
+	}
+
+	if a.isLeaf() || b.isLeaf() || a.height != b.height || !bytes.Equal(a.key, b.key) {
+		if at.compareKeys(b.key, a.key) < 0 {
+			return b.key
+		}
+		return a.key
+	}
+	aLeft, bLeft := a.getLeftNode(at), b.getLeftNode(bt)
+	if !bytes.Equal(aLeft.hash, bLeft.hash) {
+		return firstDiffNodeKey(at, aLeft, bt, bLeft)
+	}
+	aRight, bRight := a.getRightNode(at), b.getRightNode(bt)
+	if !bytes.Equal(aRight.hash, bRight.hash) {
+		return firstDiffNodeKey(at, aRight, bt, bRight)
+	}
+	return a.key
+}
+
+// compareKeys compares two keys in the order of the tree, given by Options.Comparator or else
+// bytes.Compare. Only the sign of the result is meaningful.
+func (t *ImmutableTree) compareKeys(a, b []byte) int {
+	if t == nil || t.ndb == nil || t.ndb.opts.Comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return t.ndb.opts.Comparator(a, b)
+}
+
+// leafHashSalt returns Options.LeafHashSalt, which the tree is hashed with.
+func (t *ImmutableTree) leafHashSalt() []byte {
+	if t.ndb == nil {
+		return nil
+	}
+	return t.ndb.opts.LeafHashSalt
+}
+
+// hashWithCount returns the root hash and hash count. Unhashed subtrees are hashed concurrently
+// if Options.CommitParallelism is greater than 1.
 func (t *ImmutableTree) hashWithCount() ([]byte, int64) {
-	return t.root.hashWithCount()
+	if t.ndb != nil && t.ndb.opts.CommitParallelism > 1 {
+		// Spawn goroutines down to the depth where there are CommitParallelism subtrees.
+		depth := bits.Len(uint(t.ndb.opts.CommitParallelism - 1))
+		return t.root.hashWithCountParallel(depth, t.leafHashSalt())
+	}
+	return t.root.hashWithCount(t.leafHashSalt())
 }
 
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
@@ -163,6 +320,11 @@ func (t *ImmutableTree) Get(key []byte) []byte {
 		return nil
 	}
 
+	if t.skipFastStorage {
+		_, result := t.root.get(t, key)
+		return result
+	}
+
 	// attempt to get a FastNode directly from db/cache.
 	// if call fails, fall back to the original IAVL logic in place.
 	fastNode, err := t.ndb.GetFastNode(key)
@@ -176,7 +338,7 @@ func (t *ImmutableTree) Get(key []byte) []byte {
 		// If the tree is of the latest version and fast node is not in the tree
 		// then the regular node is not in the tree either because fast node
 		// represents live state.
-		if t.version == t.ndb.latestVersion {
+		if t.version == atomic.LoadInt64(&t.ndb.latestVersion) {
 			debug("latest version with no fast node for key: %X. The node must not exist, return nil. Tree version: %d\n", key, t.version)
 			return nil
 		}
@@ -196,6 +358,19 @@ func (t *ImmutableTree) Get(key []byte) []byte {
 	return fastNode.value
 }
 
+// GetCopy is like Get, but returns a copy of the value which may be modified by the caller.
+func (t *ImmutableTree) GetCopy(key []byte) []byte {
+	return copyValue(t.Get(key))
+}
+
+// GetInto is like Get, but copies the value into dst instead of returning it, so that callers can
+// reuse a buffer across reads without allocating. It returns the length of the value, and whether
+// the key exists. If the value is longer than dst, nothing is copied, and the caller can retry
+// with a buffer of at least n bytes.
+func (t *ImmutableTree) GetInto(key []byte, dst []byte) (n int, found bool) {
+	return getInto(t.Get(key), dst)
+}
+
 // GetByIndex gets the key and value at the specified index.
 func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte) {
 	if t.root == nil {
@@ -205,6 +380,164 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte) {
 	return t.root.getByIndex(t, index)
 }
 
+// Floor returns the largest key less than or equal to the given key, and its value, in a single
+// descent of the tree. ok is false if all keys are greater than it. The returned key and value
+// must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) Floor(key []byte) (k, v []byte, ok bool) {
+	if t.root == nil {
+		return nil, nil, false
+	}
+	return t.root.floor(t, key)
+}
+
+// Ceiling returns the smallest key greater than or equal to the given key, and its value, in at
+// most two descents of the tree. ok is false if all keys are less than it. The returned key and
+// value must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) Ceiling(key []byte) (k, v []byte, ok bool) {
+	if t.root == nil {
+		return nil, nil, false
+	}
+	return t.root.ceiling(t, key)
+}
+
+// SplitPoints returns up to n-1 ascending keys which split the tree into n contiguous ranges of
+// roughly equal size, using the subtree sizes, e.g. to iterate over the tree in parallel. The
+// ranges are [nil, keys[0]), [keys[0], keys[1]), ..., [keys[len(keys)-1], nil). Fewer keys are
+// returned if the tree has fewer than n keys.
+func (t *ImmutableTree) SplitPoints(n int) [][]byte {
+	size := t.Size()
+	if n <= 1 || size == 0 {
+		return nil
+	}
+	if int64(n) > size {
+		n = int(size)
+	}
+
+	keys := make([][]byte, 0, n-1)
+	for i := int64(1); i < int64(n); i++ {
+		key, _ := t.GetByIndex(i * size / int64(n))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// PrefixHash returns the hash of the subtree whose leaves are exactly the keys starting with
+// prefix, as a commitment to just those keys. An error is returned if there are no such keys, or
+// if they are split between several subtrees, which depends on the shape of the tree. An empty
+// prefix returns the root hash. Not supported for trees with a custom Options.Comparator, where
+// keys sharing a prefix need not be contiguous.
+func (t *ImmutableTree) PrefixHash(prefix []byte) ([]byte, error) {
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return nil, errors.New("prefix hashes are not supported for trees with a custom comparator")
+	}
+	if t.root == nil {
+		return nil, errors.Errorf("no keys with prefix %X", prefix)
+	}
+	if t.root.hash == nil {
+		t.Hash()
+	}
+
+	// The keys with the prefix are the leaves with indexes in [first, last).
+	first, last := int64(0), t.Size()
+	if len(prefix) > 0 {
+		first, _ = t.GetWithIndex(prefix)
+		if end := prefixEnd(prefix); end != nil {
+			last, _ = t.GetWithIndex(end)
+		}
+	}
+	if first >= last {
+		return nil, errors.Errorf("no keys with prefix %X", prefix)
+	}
+
+	// Descend to the node covering exactly [first, last), where offset is the index of the
+	// node's leftmost leaf.
+	node, offset := t.root, int64(0)
+	for {
+		if offset == first && node.size == last-first {
+			return node.hash, nil
+		}
+		if node.isLeaf() {
+			break
+		}
+		left := node.getLeftNode(t)
+		switch {
+		case last <= offset+left.size:
+			node = left
+		case first >= offset+left.size:
+			node, offset = node.getRightNode(t), offset+left.size
+		default:
+			return nil, errors.Errorf("keys with prefix %X do not form a single subtree", prefix)
+		}
+	}
+	return nil, errors.Errorf("keys with prefix %X do not form a single subtree", prefix)
+}
+
+// NodeInfo is a read-only view of a node, as given by WalkNodes. Value is only set for leaf nodes.
+// The byte slices must not be modified, since they may point to data stored within IAVL.
+type NodeInfo struct {
+	Hash    []byte
+	Key     []byte
+	Value   []byte
+	Height  int8
+	Size    int64
+	Version int64
+}
+
+// WalkNodes calls fn for every leaf and inner node of the tree in pre-order, i.e. each inner node
+// before its left and then its right subtree, until fn returns true. Nodes are loaded from the
+// database as they are visited, and are not retained by the tree, so memory use is bounded by the
+// tree height and the node cache. An error is returned if a node can't be loaded, e.g. because
+// the version has been deleted. The hashes of unsaved nodes may be nil.
+func (t *ImmutableTree) WalkNodes(fn func(node NodeInfo) bool) error {
+	if t.root == nil {
+		return nil
+	}
+	stack := []*Node{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		info := NodeInfo{
+			Hash:    node.hash,
+			Key:     node.key,
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+		}
+		if node.isLeaf() {
+			info.Value = node.value
+		}
+		if fn(info) {
+			return nil
+		}
+		if node.isLeaf() {
+			continue
+		}
+
+		right, err := t.walkChild(node.rightNode, node.rightHash)
+		if err != nil {
+			return err
+		}
+		left, err := t.walkChild(node.leftNode, node.leftHash)
+		if err != nil {
+			return err
+		}
+		stack = append(stack, right, left)
+	}
+	return nil
+}
+
+// walkChild returns a child node for WalkNodes, loading it from the database unless it is in
+// memory.
+func (t *ImmutableTree) walkChild(node *Node, hash []byte) (*Node, error) {
+	if node != nil {
+		return node, nil
+	}
+	if t.ndb == nil {
+		return nil, errors.Errorf("node %X is not in memory", hash)
+	}
+	return t.ndb.getNode(hash)
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) bool {
@@ -225,13 +558,65 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) bool {
 
 // Iterator returns an iterator over the immutable tree.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) dbm.Iterator {
-	if t.IsFastCacheEnabled() {
+	if t.fastIterationEnabled() {
 		return NewFastIterator(start, end, ascending, t.ndb)
 	} else {
 		return NewIterator(start, end, ascending, t)
 	}
 }
 
+// KeysIterator returns an iterator over the keys of the immutable tree, whose Value() always
+// returns nil. Values are not decoded from fast nodes, which reduces I/O and allocations for
+// trees with large values.
+func (t *ImmutableTree) KeysIterator(start, end []byte, ascending bool) dbm.Iterator {
+	if t.fastIterationEnabled() {
+		return newFastIterator(start, end, ascending, t.ndb, true)
+	}
+	return newIterator(context.Background(), start, end, ascending, t, true)
+}
+
+// IterateNewLeaves makes a callback in ascending key order for the keys whose leaves were created
+// at the given version, i.e. which were set at that version. Nodes are never older than their
+// descendants, so subtrees whose root is older than the version are skipped, which is much cheaper
+// than comparing the version with its predecessor. Removed keys are not included. The keys
+// and values must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) IterateNewLeaves(version int64, fn func(key, value []byte) bool) (stopped bool) {
+	if t.root == nil || t.root.version < version {
+		return false
+	}
+	stack := []*Node{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node.isLeaf() {
+			if node.version == version && fn(node.key, node.value) {
+				return true
+			}
+			continue
+		}
+		if right := node.getRightNode(t); right.version >= version {
+			stack = append(stack, right)
+		}
+		if left := node.getLeftNode(t); left.version >= version {
+			stack = append(stack, left)
+		}
+	}
+	return false
+}
+
+// IterateExpired makes a callback in ascending key order for the keys whose values have expired,
+// e.g. to collect them for removal. expiryFn extracts the expiry time of a value, and the value
+// has expired if it is at or before now. Values that never expire can return math.MaxInt64. The
+// keys must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) IterateExpired(now int64, expiryFn func(value []byte) int64, fn func(key []byte) bool) (stopped bool) {
+	return t.Iterate(func(key, value []byte) bool {
+		if expiryFn(value) <= now {
+			return fn(key)
+		}
+		return false
+	})
+}
+
 // IterateRange makes a callback for all nodes with key between start and end non-inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
 // values must not be modified, since they may point to data stored within IAVL.
@@ -247,6 +632,56 @@ func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(
 	})
 }
 
+// IterateReverseFrom makes a callback in descending order for all nodes with key strictly less than
+// startExclusive, e.g. to load the previous page of a paginated query. A nil startExclusive starts
+// from the largest key. The keys and values must not be modified, since they may point to data
+// stored within IAVL.
+func (t *ImmutableTree) IterateReverseFrom(startExclusive []byte, fn func(key []byte, value []byte) bool) (stopped bool) {
+	return t.IterateRange(nil, startExclusive, false, fn)
+}
+
+// IteratePage makes a callback for a page of nodes with key between start and end non-inclusive,
+// skipping the first offset nodes in iteration order and stopping after limit nodes. A limit of 0
+// means no limit. The offset is skipped using the subtree sizes, so deep pages are cheap. If
+// either bound is nil, then it is open on that side. The keys and values must not be modified,
+// since they may point to data stored within IAVL. Panics if offset or limit is negative.
+func (t *ImmutableTree) IteratePage(start, end []byte, ascending bool, offset, limit int, fn func(key []byte, value []byte) bool) (stopped bool) {
+	if offset < 0 || limit < 0 {
+		panic("offset and limit must not be negative")
+	}
+	if t.root == nil {
+		return false
+	}
+
+	first, last := int64(0), t.Size()
+	if start != nil {
+		first, _ = t.GetWithIndex(start)
+	}
+	if end != nil {
+		last, _ = t.GetWithIndex(end)
+	}
+	count := last - first - int64(offset)
+	if count <= 0 {
+		return false
+	}
+	if limit > 0 && int64(limit) < count {
+		count = int64(limit)
+	}
+
+	var from, to []byte
+	if ascending {
+		from, _ = t.GetByIndex(first + int64(offset))
+	} else {
+		to, _ = t.GetByIndex(last - 1 - int64(offset))
+	}
+	t.IterateRangeInclusive(from, to, ascending, func(key, value []byte, _ int64) bool {
+		stopped = fn(key, value)
+		count--
+		return stopped || count == 0
+	})
+	return stopped
+}
+
 // IterateRangeInclusive makes a callback for all nodes with key between start and end inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
 // values must not be modified, since they may point to data stored within IAVL.
@@ -263,11 +698,19 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 }
 
 // IsFastCacheEnabled returns true if fast cache is enabled, false otherwise.
-// For fast cache to be enabled, the following 2 conditions must be met:
+// For fast cache to be enabled, the following 3 conditions must be met:
 // 1. The tree is of the latest version.
 // 2. The underlying storage has been upgraded to fast cache
+// 3. There are no writes staged by Options.DeferCommit, which fast iterators can't see.
 func (t *ImmutableTree) IsFastCacheEnabled() bool {
-	return t.isLatestTreeVersion() && t.ndb.hasUpgradedToFastStorage()
+	return !t.skipFastStorage && t.isLatestTreeVersion() && t.ndb.hasUpgradedToFastStorage() && !t.ndb.hasStagedWrites() &&
+		t.ndb.opts.VersionCeiling == 0
+}
+
+// fastIterationEnabled returns whether iterators can use fast storage, which is in byte order, so
+// not for trees with a custom Options.Comparator.
+func (t *ImmutableTree) fastIterationEnabled() bool {
+	return t.ndb.opts.Comparator == nil && t.IsFastCacheEnabled()
 }
 
 func (t *ImmutableTree) isLatestTreeVersion() bool {
@@ -278,9 +721,10 @@ func (t *ImmutableTree) isLatestTreeVersion() bool {
 // Used internally by MutableTree.
 func (t *ImmutableTree) clone() *ImmutableTree {
 	return &ImmutableTree{
-		root:    t.root,
-		ndb:     t.ndb,
-		version: t.version,
+		root:            t.root,
+		ndb:             t.ndb,
+		version:         t.version,
+		skipFastStorage: t.skipFastStorage,
 	}
 }
 
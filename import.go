@@ -2,6 +2,10 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 
@@ -11,6 +15,15 @@ import (
 // maxBatchSize is the maximum size of the import batch before flushing it to the database
 const maxBatchSize = 10000
 
+// ImporterOptions configures an Importer, see MutableTree.ImportWithOptions.
+type ImporterOptions struct {
+	// FlushThreshold is the number of nodes added to the import batch before it is written to the
+	// database, and the written nodes are released from memory. Lower thresholds bound the memory
+	// used by very large imports more tightly, at the cost of more database writes. Zero uses the
+	// default of 10000 nodes.
+	FlushThreshold int
+}
+
 // ErrNoImport is returned when calling methods on a closed importer
 var ErrNoImport = errors.New("no import in progress")
 
@@ -27,28 +40,57 @@ type Importer struct {
 	batch     db.Batch
 	batchSize uint32
 	stack     []*Node
+	unflushed []*Node // Inner nodes added since the batch was last written.
+	threshold uint32  // Number of nodes to write per batch.
+
+	imported         int64                     // Number of nodes added.
+	progressInterval int64                     // Number of nodes between progress calls.
+	progress         func(nodesImported int64) // Progress callback, see SetProgress.
+	validate         bool                      // Validate the node order, see SetValidation.
+	lastKey          []byte                    // Key of the last leaf added, when validating.
 }
 
 // newImporter creates a new Importer for an empty MutableTree.
 //
 // version should correspond to the version that was initially exported. It must be greater than
-// or equal to the highest ExportNode version number given.
-func newImporter(tree *MutableTree, version int64) (*Importer, error) {
+// or equal to the highest ExportNode version number given, and to Options.InitialVersion, since
+// the imported version could not be loaded otherwise.
+func newImporter(tree *MutableTree, version int64, opts ImporterOptions) (*Importer, error) {
 	if version < 0 {
 		return nil, errors.New("imported version cannot be negative")
 	}
-	if tree.ndb.latestVersion > 0 {
-		return nil, errors.Errorf("found database at version %d, must be 0", tree.ndb.latestVersion)
+	if tree.ndb.opts.VersionCeiling > 0 {
+		return nil, errVersionCeiling
+	}
+	if initialVersion := tree.ndb.opts.InitialVersion; initialVersion > 0 && version < int64(initialVersion) {
+		return nil, errors.Errorf("imported version %d is below the initial version %d", version, initialVersion)
+	}
+	if latestVersion := atomic.LoadInt64(&tree.ndb.latestVersion); latestVersion > 0 {
+		return nil, errors.Errorf("found database at version %d, must be 0", latestVersion)
 	}
 	if !tree.IsEmpty() {
 		return nil, errors.New("tree must be empty")
 	}
+	if opts.FlushThreshold < 0 {
+		return nil, errors.New("flush threshold cannot be negative")
+	}
+	threshold := uint32(maxBatchSize)
+	if opts.FlushThreshold > 0 {
+		threshold = uint32(opts.FlushThreshold)
+	}
+
+	// Compact holds workingMtx while deleting unreachable nodes, so it either sees this importer
+	// or finishes before the importer writes any nodes.
+	tree.workingMtx.Lock()
+	atomic.AddInt32(&tree.importers, 1)
+	tree.workingMtx.Unlock()
 
 	return &Importer{
-		tree:    tree,
-		version: version,
-		batch:   tree.ndb.db.NewBatch(),
-		stack:   make([]*Node, 0, 8),
+		tree:      tree,
+		version:   version,
+		batch:     tree.ndb.db.NewBatch(),
+		stack:     make([]*Node, 0, 8),
+		threshold: threshold,
 	}, nil
 }
 
@@ -58,17 +100,47 @@ func (i *Importer) Close() {
 	if i.batch != nil {
 		i.batch.Close()
 	}
+	if i.tree != nil {
+		atomic.AddInt32(&i.tree.importers, -1)
+	}
 	i.batch = nil
 	i.tree = nil
 }
 
+// SetProgress sets a callback which is called with the number of nodes imported so far, every
+// time another interval nodes have been added, e.g. to report the progress of long imports.
+func (i *Importer) SetProgress(interval int64, fn func(nodesImported int64)) {
+	i.progressInterval = interval
+	i.progress = fn
+}
+
+// SetValidation enables or disables validation of the node order, e.g. when importing from an
+// untrusted source. Otherwise, nodes are assumed to be in the order returned by Exporter, and
+// misordered or duplicate nodes may silently produce a corrupt tree. When enabled, Add returns an
+// error for leaves which aren't in strictly ascending key order, and for inner nodes which don't
+// have two children of consistent height, key, and version.
+func (i *Importer) SetValidation(enabled bool) {
+	i.validate = enabled
+}
+
 // Add adds an ExportNode to the import. ExportNodes must be added in the order returned by
 // Exporter, i.e. depth-first post-order (LRN). Nodes are periodically flushed to the database,
 // but the imported version is not visible until Commit() is called.
 func (i *Importer) Add(exportNode *ExportNode) error {
+	return i.AddContext(context.Background(), exportNode)
+}
+
+// AddContext is like Add, but returns the context error without adding the node if the context
+// is done, e.g. to cancel an import. A cancelled import must be closed, and the imported version
+// is then not visible. Nodes already flushed to the database are unreachable, and can be deleted
+// with MutableTree.Compact.
+func (i *Importer) AddContext(ctx context.Context, exportNode *ExportNode) error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if exportNode == nil {
 		return errors.New("node cannot be nil")
 	}
@@ -76,6 +148,9 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		return errors.Errorf("node version %v can't be greater than import version %v",
 			exportNode.Version, i.version)
 	}
+	if err := i.tree.ndb.opts.validateKeyValue(exportNode.Key, exportNode.Value); err != nil {
+		return err
+	}
 
 	node := &Node{
 		key:     exportNode.Key,
@@ -103,6 +178,12 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		node.leftHash = node.leftNode.hash
 	}
 
+	if i.validate {
+		if err := i.validateOrder(node); err != nil {
+			return err
+		}
+	}
+
 	if node.height == 0 {
 		node.size = 1
 	}
@@ -113,24 +194,21 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		node.size += node.rightNode.size
 	}
 
-	node._hash()
+	node._hash(i.tree.ndb.opts.LeafHashSalt)
 	err := node.validate()
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	err = node.writeBytes(&buf)
-	if err != nil {
+	if _, err = i.tree.ndb.writeNode(i.batch, node); err != nil {
 		return err
 	}
 
-	if err = i.batch.Set(i.tree.ndb.nodeKey(node.hash), buf.Bytes()); err != nil {
-		return err
+	if node.height > 0 {
+		i.unflushed = append(i.unflushed, node)
 	}
-
 	i.batchSize++
-	if i.batchSize >= maxBatchSize {
+	if i.batchSize >= i.threshold {
 		err = i.batch.Write()
 		if err != nil {
 			return err
@@ -138,6 +216,7 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		i.batch.Close()
 		i.batch = i.tree.ndb.db.NewBatch()
 		i.batchSize = 0
+		i.release()
 	}
 
 	// Update the stack now that we know there were no errors
@@ -148,7 +227,73 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		i.stack = i.stack[:stackSize-1]
 	}
 	i.stack = append(i.stack, node)
+	if i.validate && node.height == 0 {
+		i.lastKey = node.key
+	}
 
+	i.imported++
+	if i.progress != nil && i.progressInterval > 0 && i.imported%i.progressInterval == 0 {
+		i.progress(i.imported)
+	}
+	return nil
+}
+
+// release releases the right subtrees of the inner nodes written to the database, which would
+// otherwise be retained through the stack until the import is committed. The left subtrees are
+// kept, since validateOrder follows the left children to find the leftmost key of a subtree, but
+// their right subtrees are released as well, so only the left spine of each written subtree on
+// the stack stays in memory. Parents only need the hash, size, height and version of their
+// children, which are kept in the children themselves.
+func (i *Importer) release() {
+	for _, node := range i.unflushed {
+		node.rightNode = nil
+	}
+	i.unflushed = i.unflushed[:0]
+}
+
+// validateOrder checks that a node with its children resolved from the stack is consistent with
+// the nodes added before it, see SetValidation.
+func (i *Importer) validateOrder(node *Node) error {
+	if node.height == 0 {
+		if i.lastKey != nil {
+			switch cmp := i.tree.compareKeys(node.key, i.lastKey); {
+			case cmp == 0:
+				return errors.Errorf("duplicate key %X", node.key)
+			case cmp < 0:
+				return errors.Errorf("key %X is out of order after key %X", node.key, i.lastKey)
+			}
+		}
+		return nil
+	}
+
+	left, right := node.leftNode, node.rightNode
+	if left == nil || right == nil {
+		return errors.Errorf("inner node with key %X at height %d is missing children", node.key, node.height)
+	}
+	height := left.height
+	if right.height > height {
+		height = right.height
+	}
+	if node.height != height+1 {
+		return errors.Errorf("inner node with key %X has height %d, but its children have heights %d and %d",
+			node.key, node.height, left.height, right.height)
+	}
+	if left.height-right.height > 1 || right.height-left.height > 1 {
+		return errors.Errorf("inner node with key %X is unbalanced, its children have heights %d and %d",
+			node.key, left.height, right.height)
+	}
+	if node.version < left.version || node.version < right.version {
+		return errors.Errorf("inner node with key %X has version %d, which is lower than its children's versions %d and %d",
+			node.key, node.version, left.version, right.version)
+	}
+	leftmost := right
+	for leftmost.leftNode != nil {
+		leftmost = leftmost.leftNode
+	}
+	if !bytes.Equal(node.key, leftmost.key) {
+		return errors.Errorf("inner node has key %X, but the lowest key of its right subtree is %X",
+			node.key, leftmost.key)
+	}
 	return nil
 }
 
@@ -156,9 +301,18 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 // version visible, and updating the tree metadata. It can only be called once, and calls Close()
 // internally.
 func (i *Importer) Commit() error {
+	return i.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit, but returns the context error without making the version visible
+// if the context is done. See AddContext.
+func (i *Importer) CommitContext(ctx context.Context) error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	switch len(i.stack) {
 	case 0:
@@ -188,3 +342,152 @@ func (i *Importer) Commit() error {
 	i.Close()
 	return nil
 }
+
+// bulkLoader builds a tree bottom-up from sorted key/value pairs, adding its nodes to an Importer.
+type bulkLoader struct {
+	importer *Importer
+	version  int64
+	keys     [][]byte
+	values   [][]byte
+	next     int
+}
+
+// bulkLoadLeftSize returns the number of leaves in the left subtree of a tree with n > 1 leaves
+// built by setting sorted keys one at a time. The rebalancing always results in a perfect left
+// subtree with P/2 or P leaves, where P is the largest power of 2 less than n.
+func bulkLoadLeftSize(n int) int {
+	p := 1 << (bits.Len(uint(n-1)) - 1)
+	if n <= p+p/2 {
+		return p / 2
+	}
+	return p
+}
+
+// build adds the nodes of a subtree with n leaves to the importer in post-order, returning its
+// height and leftmost key.
+func (l *bulkLoader) build(n int) (int8, []byte, error) {
+	if n == 1 {
+		key, value := l.keys[l.next], l.values[l.next]
+		l.next++
+		if err := l.importer.Add(&ExportNode{Key: key, Value: value, Version: l.version, Height: 0}); err != nil {
+			return 0, nil, err
+		}
+		return 0, key, l.importer.addFastNode(key, value, l.version)
+	}
+
+	leftHeight, leftKey, err := l.build(bulkLoadLeftSize(n))
+	if err != nil {
+		return 0, nil, err
+	}
+	rightHeight, rightKey, err := l.build(n - bulkLoadLeftSize(n))
+	if err != nil {
+		return 0, nil, err
+	}
+	height := maxInt8(leftHeight, rightHeight) + 1
+	err = l.importer.Add(&ExportNode{Key: rightKey, Version: l.version, Height: height})
+	return height, leftKey, err
+}
+
+// addFastNode writes the fast node for a leaf to the import batch.
+func (i *Importer) addFastNode(key, value []byte, version int64) error {
+	buf, err := i.tree.ndb.encodeFastNode(NewFastNode(key, value, version))
+	if err != nil {
+		return err
+	}
+	return i.batch.Set(i.tree.ndb.fastNodeKey(key), buf)
+}
+
+// commitWithFastNodes commits the import like Commit, for imports which wrote the fast nodes
+// along with the tree. The fast storage is marked as up to date to avoid upgrading it by
+// traversing the tree when it is loaded.
+func (i *Importer) commitWithFastNodes() error {
+	storageVersion := fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(i.version))
+	if err := i.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(storageVersion)); err != nil {
+		return err
+	}
+	ndb := i.tree.ndb
+	previousStorageVersion := ndb.storageVersion
+	ndb.storageVersion = storageVersion
+	if err := i.Commit(); err != nil {
+		ndb.storageVersion = previousStorageVersion
+		return err
+	}
+	return nil
+}
+
+// BulkLoad initializes an empty tree with the key/value pairs returned by src, and saves it as the
+// given version. src must return the pairs in ascending key order, and ok = false when there are
+// no more pairs. The tree is built bottom-up in O(n) time, and is identical to the tree built by
+// setting the keys one at a time and saving it, with all nodes at the given version.
+//
+// BulkLoad can only be called on an empty tree, like Import.
+func (tree *MutableTree) BulkLoad(version int64, src func() (key, value []byte, ok bool)) error {
+	if version <= 0 {
+		return errors.New("version must be greater than 0")
+	}
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+
+	loader := &bulkLoader{importer: importer, version: version}
+	for {
+		key, value, ok := src()
+		if !ok {
+			break
+		}
+		if len(loader.keys) > 0 && tree.compareKeys(key, loader.keys[len(loader.keys)-1]) <= 0 {
+			return errors.Errorf("key %X is not greater than the previous key, keys must be sorted and unique", key)
+		}
+		if value == nil && tree.ndb.opts.NilValuePolicy == TreatNilAsEmpty {
+			value = []byte{}
+		}
+		loader.keys = append(loader.keys, key)
+		loader.values = append(loader.values, value)
+	}
+
+	if len(loader.keys) > 0 {
+		if _, _, err := loader.build(len(loader.keys)); err != nil {
+			return err
+		}
+	}
+
+	return importer.commitWithFastNodes()
+}
+
+// ImportVersion initializes the empty tree dst with a saved version of another tree, e.g. from
+// MutableTree.GetImmutable, in-process. dst is then identical to src, with the same version and
+// root hash. It is like exporting src and importing it into dst, but without an intermediate
+// exporter, and the fast nodes are written along with the tree like BulkLoad.
+func ImportVersion(dst *MutableTree, src *ImmutableTree) error {
+	if src.version <= 0 {
+		return errors.New("source tree must be a saved version")
+	}
+	importer, err := dst.Import(src.version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+
+	// Keep the version from being deleted while it is traversed, like Exporter.
+	src.ndb.incrVersionReaders(src.version)
+	defer src.ndb.decrVersionReaders(src.version)
+
+	src.root.traversePost(src, true, func(node *Node) bool {
+		err = importer.Add(&ExportNode{
+			Key:     node.key,
+			Value:   node.value,
+			Version: node.version,
+			Height:  node.height,
+		})
+		if err == nil && node.isLeaf() {
+			err = importer.addFastNode(node.key, node.value, node.version)
+		}
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	return importer.commitWithFastNodes()
+}
@@ -1,6 +1,9 @@
 package iavl
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -107,6 +110,62 @@ func TestImporter_NotEmptyUnsaved(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestImporter_InitialVersion(t *testing.T) {
+	src, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	src.Set([]byte("a"), []byte{1})
+	src.Set([]byte("b"), []byte{2})
+	_, _, err = src.SaveVersion()
+	require.NoError(t, err)
+	itree, err := src.GetImmutable(1)
+	require.NoError(t, err)
+
+	importAt := func(memDB db.DB, version int64) error {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{InitialVersion: 5})
+		require.NoError(t, err)
+		importer, err := tree.Import(version)
+		if err != nil {
+			return err
+		}
+		defer importer.Close()
+		exporter := itree.Export()
+		defer exporter.Close()
+		for {
+			node, err := exporter.Next()
+			if err == ExportDone {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+		}
+		return importer.Commit()
+	}
+
+	// Importing below the initial version is rejected before anything is written.
+	memDB := db.NewMemDB()
+	err = importAt(memDB, 4)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "below the initial version 5")
+	require.Empty(t, dumpDB(t, memDB))
+
+	// Importing at or above the initial version can be loaded and saved.
+	for _, version := range []int64{5, 6} {
+		memDB := db.NewMemDB()
+		require.NoError(t, importAt(memDB, version))
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{InitialVersion: 5})
+		require.NoError(t, err)
+		loaded, err := tree.LoadVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, version, loaded)
+		require.Equal(t, itree.Hash(), tree.Hash())
+
+		tree.Set([]byte("c"), []byte{3})
+		_, saved, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, version+1, saved)
+	}
+}
+
 func TestImporter_Add(t *testing.T) {
 	k := []byte("key")
 	v := []byte("value")
@@ -121,12 +180,14 @@ func TestImporter_Add(t *testing.T) {
 		"no value":          {&ExportNode{Key: k, Value: nil, Version: 1, Height: 0}, false},
 		"version too large": {&ExportNode{Key: k, Value: v, Version: 2, Height: 0}, false},
 		"no version":        {&ExportNode{Key: k, Value: v, Version: 0, Height: 0}, false},
+		"key too large":     {&ExportNode{Key: []byte("keys"), Value: v, Version: 1, Height: 0}, false},
+		"value too large":   {&ExportNode{Key: k, Value: []byte("values"), Version: 1, Height: 0}, false},
 		// further cases will be handled by Node.validate()
 	}
 	for desc, tc := range testcases {
 		tc := tc // appease scopelint
 		t.Run(desc, func(t *testing.T) {
-			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxKeySize: len(k), MaxValueSize: len(v)})
 			require.NoError(t, err)
 			importer, err := tree.Import(1)
 			require.NoError(t, err)
@@ -212,6 +273,272 @@ func TestImporter_Commit_Empty(t *testing.T) {
 	assert.EqualValues(t, 3, tree.Version())
 }
 
+func TestImporter_Progress(t *testing.T) {
+	exported := exportNodes(t, setupExportTreeSized(t, 100))
+	require.Len(t, exported, 199)
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := tree.Import(1)
+	require.NoError(t, err)
+	defer importer.Close()
+
+	progress := []int64{}
+	importer.SetProgress(50, func(nodesImported int64) {
+		progress = append(progress, nodesImported)
+	})
+	for _, node := range exported {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, []int64{50, 100, 150}, progress)
+}
+
+func TestImporter_Cancel(t *testing.T) {
+	exported := exportNodes(t, setupExportTreeSized(t, 6000))
+	require.Greater(t, len(exported), maxBatchSize+1000)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err := tree.Import(1)
+	require.NoError(t, err)
+
+	// Cancel the import after the first batch has been flushed to the database.
+	ctx, cancel := context.WithCancel(context.Background())
+	importer.SetProgress(maxBatchSize+1000, func(int64) { cancel() })
+	var i int
+	for i = 0; i < len(exported); i++ {
+		if err = importer.AddContext(ctx, exported[i]); err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, maxBatchSize+1000, i)
+	require.ErrorIs(t, importer.CommitContext(ctx), context.Canceled)
+	importer.Close()
+
+	// No version is visible, and the flushed nodes can be deleted.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+	require.Empty(t, tree.AvailableVersions())
+	require.Positive(t, tree.ndb.size())
+	require.NoError(t, tree.Compact())
+	nodes := 0
+	require.NoError(t, tree.ndb.traverseNodes(func([]byte, *Node) error {
+		nodes++
+		return nil
+	}))
+	require.Zero(t, nodes)
+}
+
+func TestImporter_FlushThreshold(t *testing.T) {
+	source := setupExportTreeSized(t, 5000)
+	exported := exportNodes(t, source)
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, err = tree.ImportWithOptions(1, ImporterOptions{FlushThreshold: -1})
+	require.Error(t, err)
+
+	memDB := db.NewMemDB()
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err := tree.ImportWithOptions(source.Version(), ImporterOptions{FlushThreshold: 100})
+	require.NoError(t, err)
+	defer importer.Close()
+	importer.SetValidation(true)
+
+	// countRetained counts the nodes retained in memory through the stack.
+	countRetained := func() int {
+		count := 0
+		var walk func(node *Node)
+		walk = func(node *Node) {
+			if node == nil {
+				return
+			}
+			count++
+			walk(node.leftNode)
+			walk(node.rightNode)
+		}
+		for _, node := range importer.stack {
+			walk(node)
+		}
+		return count
+	}
+	maxRetained := 0
+	for _, node := range exported {
+		require.NoError(t, importer.Add(node))
+		if retained := countRetained(); retained > maxRetained {
+			maxRetained = retained
+		}
+	}
+	require.Less(t, maxRetained, len(exported)/4)
+	require.NoError(t, importer.Commit())
+	require.Equal(t, source.Hash(), tree.Hash())
+
+	// The result matches an import with the default threshold, and can be loaded.
+	full, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	fullImporter, err := full.Import(source.Version())
+	require.NoError(t, err)
+	defer fullImporter.Close()
+	for _, node := range exported {
+		require.NoError(t, fullImporter.Add(node))
+	}
+	require.NoError(t, fullImporter.Commit())
+	require.Equal(t, full.Hash(), tree.Hash())
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, source.Version(), version)
+	require.Equal(t, source.Hash(), tree.Hash())
+	require.Equal(t, exported, exportNodes(t, tree.ImmutableTree))
+}
+
+// exportNodes exports all nodes of a tree.
+func exportNodes(t *testing.T, tree *ImmutableTree) []*ExportNode {
+	exporter := tree.Export()
+	defer exporter.Close()
+	exported := []*ExportNode{}
+	for {
+		node, err := exporter.Next()
+		if err == ExportDone {
+			return exported
+		}
+		require.NoError(t, err)
+		exported = append(exported, node)
+	}
+}
+
+// bulkLoadSource returns a BulkLoad source for n sorted keys.
+func bulkLoadSource(n int) func() ([]byte, []byte, bool) {
+	i := 0
+	return func() ([]byte, []byte, bool) {
+		if i >= n {
+			return nil, nil, false
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		i++
+		return key, append([]byte("value"), key...), true
+	}
+}
+
+func TestMutableTree_BulkLoad(t *testing.T) {
+	sizes := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 12, 13, 17, 24, 25, 100, 1000, 4095, 4096, 4097, 6144, 6145}
+	for i := 26; i <= 300; i += 7 {
+		sizes = append(sizes, i)
+	}
+	for _, n := range sizes {
+		expected, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		src := bulkLoadSource(n)
+		for key, value, ok := src(); ok; key, value, ok = src() {
+			expected.Set(key, value)
+		}
+		expectedHash, _, err := expected.SaveVersion()
+		require.NoError(t, err)
+
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		require.NoError(t, tree.BulkLoad(1, bulkLoadSource(n)))
+		require.Equal(t, expectedHash, tree.Hash(), "n=%d", n)
+		require.EqualValues(t, 1, tree.Version())
+		require.EqualValues(t, n, tree.Size())
+		require.EqualValues(t, expected.Height(), tree.Height())
+	}
+
+	// The bulk loaded tree is persisted and can be modified.
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	require.NoError(t, tree.BulkLoad(5, bulkLoadSource(100)))
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+
+	// Fast nodes are written by the bulk load, so no upgrade is needed.
+	require.False(t, tree.IsUpgradeable())
+	require.True(t, tree.IsFastCacheEnabled())
+	itr := tree.Iterator(nil, nil, true)
+	require.IsType(t, &UnsavedFastIterator{}, itr)
+	src := bulkLoadSource(100)
+	for key, value, ok := src(); ok; key, value, ok = src() {
+		require.True(t, itr.Valid())
+		require.Equal(t, key, itr.Key())
+		require.Equal(t, value, itr.Value())
+		itr.Next()
+	}
+	require.False(t, itr.Valid())
+	itr.Close()
+
+	key, value, _ := bulkLoadSource(1)()
+	require.Equal(t, value, tree.Get(key))
+	tree.Set(key, []byte("new"))
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 6, version)
+	require.Equal(t, []byte("new"), tree.Get(key))
+}
+
+func TestMutableTree_BulkLoad_Errors(t *testing.T) {
+	pairs := func(keys ...string) func() ([]byte, []byte, bool) {
+		return func() ([]byte, []byte, bool) {
+			if len(keys) == 0 {
+				return nil, nil, false
+			}
+			key := keys[0]
+			keys = keys[1:]
+			return []byte(key), []byte(key), true
+		}
+	}
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Error(t, tree.BulkLoad(0, pairs("a")))
+	require.Error(t, tree.BulkLoad(1, pairs("b", "a")))
+	require.Error(t, tree.BulkLoad(1, pairs("a", "a")))
+	require.EqualValues(t, 0, tree.Version())
+
+	tree.Set([]byte("a"), []byte("a"))
+	require.Error(t, tree.BulkLoad(1, pairs("a")))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Error(t, tree.BulkLoad(2, pairs("a")))
+}
+
+func BenchmarkMutableTree_BulkLoad(b *testing.B) {
+	for _, n := range []int{1000, 1000000} {
+		b.Run(fmt.Sprintf("bulk-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree, err := NewMutableTree(db.NewMemDB(), 0)
+				require.NoError(b, err)
+				require.NoError(b, tree.BulkLoad(1, bulkLoadSource(n)))
+			}
+		})
+		b.Run(fmt.Sprintf("set-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree, err := NewMutableTree(db.NewMemDB(), 0)
+				require.NoError(b, err)
+				src := bulkLoadSource(n)
+				for key, value, ok := src(); ok; key, value, ok = src() {
+					tree.Set(key, value)
+				}
+				_, _, err = tree.SaveVersion()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
 func BenchmarkImport(b *testing.B) {
 	b.StopTimer()
 	tree := setupExportTreeSized(b, 4096)
@@ -244,3 +571,153 @@ func BenchmarkImport(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+func TestImportVersion(t *testing.T) {
+	src, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for version := int64(1); version <= 4; version++ {
+		for i := 0; i < 200; i++ {
+			src.Set([]byte(fmt.Sprintf("k%03d", (i*7+int(version)*13)%300)), []byte(fmt.Sprintf("v%d", version)))
+		}
+		src.Remove([]byte(fmt.Sprintf("k%03d", version)))
+		hash, _, err := src.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+
+	itree, err := src.GetImmutable(3)
+	require.NoError(t, err)
+	memDB := db.NewMemDB()
+	dst, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	require.NoError(t, ImportVersion(dst, itree))
+	require.EqualValues(t, 3, dst.Version())
+	require.Equal(t, hashes[3], dst.Hash())
+	equal, diffKey := dst.StructuralEqual(itree)
+	require.True(t, equal, "differs at %q", diffKey)
+
+	// The imported tree is persisted with its fast nodes, and can be modified.
+	dst, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := dst.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, hashes[3], dst.Hash())
+	require.False(t, dst.IsUpgradeable())
+	mismatches, err := dst.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+	require.Equal(t, itree.Get([]byte("k100")), dst.Get([]byte("k100")))
+	dst.Set([]byte("k100"), []byte("new"))
+	_, version, err = dst.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+
+	// Non-empty destination trees are rejected.
+	require.Error(t, ImportVersion(dst, itree))
+
+	// Empty versions are imported, but unsaved trees are rejected.
+	empty, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	emptyHash, _, err := empty.SaveVersion()
+	require.NoError(t, err)
+	itree, err = empty.GetImmutable(1)
+	require.NoError(t, err)
+	dst, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.NoError(t, ImportVersion(dst, itree))
+	require.Equal(t, emptyHash, dst.Hash())
+	require.Error(t, ImportVersion(dst, &ImmutableTree{ndb: empty.ndb}))
+}
+
+func TestImporter_Validation(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte{byte(i * version % 20)}, []byte{byte(version)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	exported := exportNodes(t, tree.ImmutableTree)
+	require.EqualValues(t, 0, exported[0].Height)
+	require.EqualValues(t, 0, exported[1].Height)
+	require.EqualValues(t, 1, exported[2].Height)
+
+	importNodes := func(nodes []*ExportNode, validate bool) (*MutableTree, error) {
+		imported, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		importer, err := imported.Import(tree.Version())
+		require.NoError(t, err)
+		defer importer.Close()
+		importer.SetValidation(validate)
+		for _, node := range nodes {
+			if err := importer.Add(node); err != nil {
+				return nil, err
+			}
+		}
+		return imported, importer.Commit()
+	}
+	modify := func(fn func(nodes []*ExportNode) []*ExportNode) []*ExportNode {
+		nodes := make([]*ExportNode, len(exported))
+		for i, node := range exported {
+			copied := *node
+			nodes[i] = &copied
+		}
+		return fn(nodes)
+	}
+
+	// Valid nodes are imported either way.
+	for _, validate := range []bool{false, true} {
+		imported, err := importNodes(exported, validate)
+		require.NoError(t, err)
+		require.Equal(t, tree.Hash(), imported.Hash())
+	}
+
+	// The fast path doesn't detect misordered leaves.
+	swapped := modify(func(nodes []*ExportNode) []*ExportNode {
+		nodes[0], nodes[1] = nodes[1], nodes[0]
+		return nodes
+	})
+	imported, err := importNodes(swapped, false)
+	require.NoError(t, err)
+	require.NotEqual(t, tree.Hash(), imported.Hash())
+
+	testcases := map[string]struct {
+		nodes []*ExportNode
+		err   string
+	}{
+		"swapped leaves": {swapped, "out of order"},
+		"duplicate leaf": {modify(func(nodes []*ExportNode) []*ExportNode {
+			return append(nodes[:1], nodes...)
+		}), "duplicate key"},
+		"duplicate inner node": {modify(func(nodes []*ExportNode) []*ExportNode {
+			return append(nodes[:3], nodes[2:]...)
+		}), "missing children"},
+		"missing leaf": {modify(func(nodes []*ExportNode) []*ExportNode {
+			return nodes[1:]
+		}), "missing children"},
+		"wrong inner key": {modify(func(nodes []*ExportNode) []*ExportNode {
+			nodes[2].Key = nodes[0].Key
+			return nodes
+		}), "lowest key of its right subtree"},
+		"wrong inner height": {modify(func(nodes []*ExportNode) []*ExportNode {
+			nodes[2].Height = 2
+			return nodes
+		}), "children have heights"},
+		"wrong inner version": {modify(func(nodes []*ExportNode) []*ExportNode {
+			nodes[2].Version = nodes[0].Version - 1
+			return nodes
+		}), "lower than its children's versions"},
+	}
+	for desc, tc := range testcases {
+		tc := tc
+		t.Run(desc, func(t *testing.T) {
+			_, err := importNodes(tc.nodes, true)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
@@ -5,6 +5,7 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 
 	dbm "github.com/tendermint/tm-db"
@@ -16,6 +17,7 @@ type traversal struct {
 	ascending    bool          // ascending traversal
 	inclusive    bool          // end key inclusiveness
 	post         bool          // postorder traversal
+	bypassCache  bool          // don't add loaded nodes to the node cache
 	delayedNodes *delayedNodes // delayed nodes to be traversed
 }
 
@@ -46,6 +48,8 @@ type delayedNodes []delayedNode
 
 func (nodes *delayedNodes) pop() (*Node, bool) {
 	node := (*nodes)[len(*nodes)-1]
+	// Clear the popped slot so the backing array doesn't retain the node.
+	(*nodes)[len(*nodes)-1] = delayedNode{}
 	*nodes = (*nodes)[:len(*nodes)-1]
 	return node.node, node.delayed
 }
@@ -102,9 +106,9 @@ func (t *traversal) next() *Node {
 		return node
 	}
 
-	afterStart := t.start == nil || bytes.Compare(t.start, node.key) < 0
+	afterStart := t.start == nil || t.tree.compareKeys(t.start, node.key) < 0
 	startOrAfter := afterStart || bytes.Equal(t.start, node.key)
-	beforeEnd := t.end == nil || bytes.Compare(node.key, t.end) < 0
+	beforeEnd := t.end == nil || t.tree.compareKeys(node.key, t.end) < 0
 	if t.inclusive {
 		beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
 	}
@@ -122,22 +126,22 @@ func (t *traversal) next() *Node {
 		if t.ascending {
 			if beforeEnd {
 				// push the delayed traversal for the right nodes,
-				t.delayedNodes.push(node.getRightNode(t.tree), true)
+				t.delayedNodes.push(t.getRightNode(node), true)
 			}
 			if afterStart {
 				// push the delayed traversal for the left nodes,
-				t.delayedNodes.push(node.getLeftNode(t.tree), true)
+				t.delayedNodes.push(t.getLeftNode(node), true)
 			}
 		} else {
 			// if node is a branch node and the order is not ascending
 			// We traverse through the right subtree, then the left subtree.
 			if afterStart {
 				// push the delayed traversal for the left nodes,
-				t.delayedNodes.push(node.getLeftNode(t.tree), true)
+				t.delayedNodes.push(t.getLeftNode(node), true)
 			}
 			if beforeEnd {
 				// push the delayed traversal for the right nodes,
-				t.delayedNodes.push(node.getRightNode(t.tree), true)
+				t.delayedNodes.push(t.getRightNode(node), true)
 			}
 		}
 	}
@@ -152,6 +156,30 @@ func (t *traversal) next() *Node {
 	return t.next()
 }
 
+// getLeftNode returns the left child of node, bypassing the node cache if requested.
+func (t *traversal) getLeftNode(node *Node) *Node {
+	if !t.bypassCache || node.leftNode != nil {
+		return node.getLeftNode(t.tree)
+	}
+	return t.getNodeUncached(node.leftHash)
+}
+
+// getRightNode returns the right child of node, bypassing the node cache if requested.
+func (t *traversal) getRightNode(node *Node) *Node {
+	if !t.bypassCache || node.rightNode != nil {
+		return node.getRightNode(t.tree)
+	}
+	return t.getNodeUncached(node.rightHash)
+}
+
+func (t *traversal) getNodeUncached(hash []byte) *Node {
+	child, err := t.tree.ndb.getNodeUncached(hash)
+	if err != nil {
+		panic(err.Error())
+	}
+	return child
+}
+
 // Iterator is a dbm.Iterator for ImmutableTree
 type Iterator struct {
 	start, end []byte
@@ -162,6 +190,10 @@ type Iterator struct {
 
 	err error
 
+	ctx context.Context
+
+	keysOnly bool
+
 	t *traversal
 }
 
@@ -169,17 +201,58 @@ var _ dbm.Iterator = &Iterator{}
 
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) dbm.Iterator {
+	return NewIteratorContext(context.Background(), start, end, ascending, tree)
+}
+
+// NewIteratorContext returns a new iterator over the immutable tree which stops when the context
+// is cancelled. Once cancelled, the iterator becomes invalid and Error() returns the context error.
+// If the tree is nil, the iterator will be invalid.
+func NewIteratorContext(ctx context.Context, start, end []byte, ascending bool, tree *ImmutableTree) dbm.Iterator {
+	return newIterator(ctx, start, end, ascending, tree, false)
+}
+
+// IteratorOptions configures iterators created by NewIteratorWithOpts.
+type IteratorOptions struct {
+	// BypassCache doesn't add nodes loaded from the database by the iterator to the node cache, so
+	// that e.g. background full scans don't evict the nodes used by other queries. Nodes already
+	// in the cache are still used.
+	BypassCache bool
+}
+
+// NewIteratorWithOpts is like NewIterator, but with the given options.
+func NewIteratorWithOpts(start, end []byte, ascending bool, tree *ImmutableTree, opts IteratorOptions) dbm.Iterator {
+	iter := newIteratorUnstarted(context.Background(), start, end, ascending, tree, false)
+	if iter.t != nil {
+		iter.t.bypassCache = opts.BypassCache
+		iter.Next()
+	}
+	return iter
+}
+
+// newIterator returns a new iterator over the immutable tree. If keysOnly is set, Value() always
+// returns nil.
+func newIterator(ctx context.Context, start, end []byte, ascending bool, tree *ImmutableTree, keysOnly bool) *Iterator {
+	iter := newIteratorUnstarted(ctx, start, end, ascending, tree, keysOnly)
+	if iter.t != nil {
+		// Move iterator before the first element
+		iter.Next()
+	}
+	return iter
+}
+
+// newIteratorUnstarted is like newIterator, but doesn't move the iterator to the first element.
+func newIteratorUnstarted(ctx context.Context, start, end []byte, ascending bool, tree *ImmutableTree, keysOnly bool) *Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
-		valid: tree != nil,
-		t:     nil,
+		start:    start,
+		end:      end,
+		valid:    tree != nil,
+		ctx:      ctx,
+		keysOnly: keysOnly,
+		t:        nil,
 	}
 
 	if iter.valid {
 		iter.t = tree.root.newTraversal(tree, start, end, ascending, false, false)
-		// Move iterator before the first element
-		iter.Next()
 	} else {
 		iter.err = errIteratorNilTreeGiven
 	}
@@ -213,6 +286,13 @@ func (iter *Iterator) Next() {
 		return
 	}
 
+	if err := iter.ctx.Err(); err != nil {
+		iter.err = err
+		iter.t = nil
+		iter.valid = false
+		return
+	}
+
 	node := iter.t.next()
 	if node == nil {
 		iter.t = nil
@@ -221,7 +301,10 @@ func (iter *Iterator) Next() {
 	}
 
 	if node.height == 0 {
-		iter.key, iter.value = node.key, node.value
+		iter.key = node.key
+		if !iter.keysOnly {
+			iter.value = node.value
+		}
 		return
 	}
 
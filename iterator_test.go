@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"sort"
 	"testing"
@@ -407,3 +409,239 @@ func setupUnsavedFastIterator(t *testing.T, config *iteratorTestConfig) (dbm.Ite
 	itr := NewUnsavedFastIterator(config.startIterate, config.endIterate, config.ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
 	return itr, mergedMirror
 }
+
+func TestIterator_Context_Cancelled(t *testing.T) {
+	tree, err := NewMutableTree(dbm.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	itr := NewIteratorContext(ctx, nil, nil, true, tree.ImmutableTree)
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+		if count == 10 {
+			cancel()
+		}
+	}
+	require.Equal(t, 10, count)
+	require.False(t, itr.Valid())
+	require.ErrorIs(t, itr.Error(), context.Canceled)
+	require.ErrorIs(t, itr.Close(), context.Canceled)
+
+	// An already expired context yields no items.
+	itr = NewIteratorContext(ctx, nil, nil, false, tree.ImmutableTree)
+	require.False(t, itr.Valid())
+	require.ErrorIs(t, itr.Error(), context.Canceled)
+}
+
+func TestIterator_BypassCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, err := NewMutableTree(db, 0)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		tree.Set(i2b(i), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTree(db, 50)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	// Warm the cache with the path to a hot key.
+	hotKey := i2b(500)
+	_, value := itree.GetWithIndex(hotKey)
+	require.Equal(t, []byte{byte(500 % 256)}, value)
+	hot := [][]byte{}
+	for node := itree.root; ; {
+		hot = append(hot, node.hash)
+		if node.isLeaf() {
+			break
+		}
+		if itree.compareKeys(hotKey, node.key) < 0 {
+			node = node.getLeftNode(itree)
+		} else {
+			node = node.getRightNode(itree)
+		}
+	}
+	entries, capacity, _ := tree.CacheUtilization()
+	require.Less(t, entries, capacity)
+	for _, hash := range hot {
+		require.True(t, tree.ndb.nodeCache.Has(hash))
+	}
+
+	count := 0
+	itr := NewIteratorWithOpts(nil, nil, true, itree, IteratorOptions{BypassCache: true})
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 1000, count)
+
+	after, _, _ := tree.CacheUtilization()
+	require.Equal(t, entries, after)
+	for _, hash := range hot {
+		require.True(t, tree.ndb.nodeCache.Has(hash))
+	}
+
+	// A regular scan fills the cache, evicting the hot nodes.
+	itr = NewIterator(nil, nil, true, itree)
+	for ; itr.Valid(); itr.Next() {
+	}
+	require.NoError(t, itr.Close())
+	after, _, _ = tree.CacheUtilization()
+	require.Equal(t, capacity, after)
+	require.False(t, tree.ndb.nodeCache.Has(hot[len(hot)-1]))
+}
+
+func TestImmutableTree_KeysIterator(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	latest, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	require.True(t, latest.IsFastCacheEnabled())
+	previous, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.False(t, previous.IsFastCacheEnabled())
+
+	sortedKeys := getSortedMirrorKeys(mirror)
+	for _, itree := range []*ImmutableTree{latest, previous} {
+		for _, ascending := range []bool{true, false} {
+			itr := itree.KeysIterator(nil, nil, ascending)
+			i := 0
+			for ; itr.Valid(); itr.Next() {
+				expected := sortedKeys[i]
+				if !ascending {
+					expected = sortedKeys[len(sortedKeys)-1-i]
+				}
+				require.Equal(t, expected, string(itr.Key()))
+				require.Nil(t, itr.Value())
+				i++
+			}
+			require.NoError(t, itr.Close())
+			require.Equal(t, len(sortedKeys), i)
+		}
+	}
+}
+
+func BenchmarkImmutableTree_KeysIterator(b *testing.B) {
+	tree, err := NewMutableTree(dbm.NewMemDB(), 10000)
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		tree.Set(randBytes(16), randBytes(4096))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+	require.True(b, tree.IsFastCacheEnabled())
+
+	iterate := func(b *testing.B, newIterator func() dbm.Iterator) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			itr := newIterator()
+			for ; itr.Valid(); itr.Next() {
+				_ = itr.Key()
+				_ = itr.Value()
+			}
+			itr.Close()
+		}
+	}
+
+	b.Run("keys", func(b *testing.B) {
+		iterate(b, func() dbm.Iterator { return tree.ImmutableTree.KeysIterator(nil, nil, true) })
+	})
+	b.Run("full", func(b *testing.B) {
+		iterate(b, func() dbm.Iterator { return tree.ImmutableTree.Iterator(nil, nil, true) })
+	})
+}
+
+func TestImmutableTree_MultiRangeIterator(t *testing.T) {
+	tree, err := NewMutableTree(dbm.NewMemDB(), 0)
+	require.NoError(t, err)
+	keys := []string{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+		tree.Set([]byte(key), []byte("v"+key))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	r := func(start, end string) KeyRange {
+		var kr KeyRange
+		if start != "" {
+			kr.Start = []byte(start)
+		}
+		if end != "" {
+			kr.End = []byte(end)
+		}
+		return kr
+	}
+	testCases := map[string][]KeyRange{
+		"none":        {},
+		"single":      {r("k10", "k15")},
+		"disjoint":    {r("k30", "k33"), r("k05", "k08")},
+		"overlapping": {r("k10", "k20"), r("k15", "k25"), r("k12", "k14"), r("k24", "k27")},
+		"adjacent":    {r("k10", "k15"), r("k15", "k20"), r("k20", "k21")},
+		"open":        {r("", "k03"), r("k47", ""), r("k01", "k05")},
+		"all":         {r("k10", "k20"), r("", "")},
+		"empty":       {r("k20", "k10"), r("k20", "k20"), r("k40", "k41")},
+	}
+	for name, ranges := range testCases {
+		ranges := ranges
+		t.Run(name, func(t *testing.T) {
+			expected := []string{}
+			for _, key := range keys {
+				for _, kr := range ranges {
+					if (kr.Start == nil || key >= string(kr.Start)) && (kr.End == nil || key < string(kr.End)) {
+						expected = append(expected, key)
+						break
+					}
+				}
+			}
+			for _, ascending := range []bool{true, false} {
+				iter := itree.MultiRangeIterator(ranges, ascending)
+				actual := []string{}
+				for ; iter.Valid(); iter.Next() {
+					require.Equal(t, "v"+string(iter.Key()), string(iter.Value()))
+					actual = append(actual, string(iter.Key()))
+				}
+				require.NoError(t, iter.Error())
+				require.NoError(t, iter.Close())
+				require.False(t, iter.Valid())
+				if !ascending {
+					for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+						expected[i], expected[j] = expected[j], expected[i]
+					}
+				}
+				require.Equal(t, expected, actual)
+			}
+		})
+	}
+
+	// Mutable trees iterate over the working tree.
+	tree.Set([]byte("k11"), []byte("new"))
+	tree.Remove([]byte("k12"))
+	iter := tree.MultiRangeIterator([]KeyRange{r("k10", "k13"), r("k12", "k14")}, true)
+	actual := []string{}
+	for ; iter.Valid(); iter.Next() {
+		actual = append(actual, string(iter.Key())+"="+string(iter.Value()))
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, []string{"k10=vk10", "k11=new", "k13=vk13"}, actual)
+}
@@ -2,14 +2,37 @@ package iavl
 
 import (
 	"fmt"
+	"strings"
 )
 
 var (
 	debugging = false
 )
 
+// Logger receives debug logs of tree operations, see Options.Logger. kv holds alternating keys
+// and values giving details of the operation.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+}
+
 func debug(format string, args ...interface{}) {
 	if debugging {
 		fmt.Printf(format, args...)
 	}
 }
+
+// logDebug logs a message to Options.Logger, or to the global debug output if it is nil.
+func (ndb *nodeDB) logDebug(msg string, kv ...interface{}) {
+	if ndb.opts.Logger != nil {
+		ndb.opts.Logger.Debug(msg, kv...)
+		return
+	}
+	if debugging {
+		var b strings.Builder
+		b.WriteString(msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+		}
+		debug("%s\n", b.String())
+	}
+}
@@ -0,0 +1,172 @@
+package iavl
+
+import (
+	"sort"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// KeyRange is a range of keys from Start (inclusive) to End (exclusive). A nil Start or End leaves
+// the range open on that side.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// empty returns whether the range contains no keys, given the key order compare.
+func (r KeyRange) empty(compare func(a, b []byte) int) bool {
+	return r.Start != nil && r.End != nil && compare(r.Start, r.End) >= 0
+}
+
+// mergeKeyRanges returns the union of the given ranges as disjoint, non-adjacent ranges in
+// ascending key order as given by compare, dropping empty ranges.
+func mergeKeyRanges(ranges []KeyRange, compare func(a, b []byte) int) []KeyRange {
+	sorted := make([]KeyRange, 0, len(ranges))
+	for _, r := range ranges {
+		if !r.empty(compare) {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[j].Start != nil && (sorted[i].Start == nil || compare(sorted[i].Start, sorted[j].Start) < 0)
+	})
+
+	merged := []KeyRange{}
+	for _, r := range sorted {
+		if len(merged) == 0 {
+			merged = append(merged, r)
+			continue
+		}
+		last := &merged[len(merged)-1]
+		if last.End != nil && compare(r.Start, last.End) > 0 {
+			merged = append(merged, r)
+			continue
+		}
+		if last.End != nil && (r.End == nil || compare(r.End, last.End) > 0) {
+			last.End = r.End
+		}
+	}
+	return merged
+}
+
+// multiRangeIterator iterates over several disjoint key ranges in order, using an iterator for
+// each range in turn.
+type multiRangeIterator struct {
+	iterator  func(start, end []byte, ascending bool) dbm.Iterator
+	ranges    []KeyRange
+	ascending bool
+	next      int
+	iter      dbm.Iterator
+	err       error
+}
+
+var _ dbm.Iterator = (*multiRangeIterator)(nil)
+
+// MultiRangeIterator returns an iterator over the union of the given key ranges, in ascending or
+// descending key order. Overlapping ranges are merged, so each key is returned at most once.
+func (t *ImmutableTree) MultiRangeIterator(ranges []KeyRange, ascending bool) dbm.Iterator {
+	return newMultiRangeIterator(t.Iterator, mergeKeyRanges(ranges, t.compareKeys), ascending)
+}
+
+// MultiRangeIterator is like ImmutableTree.MultiRangeIterator, but iterates over the working tree
+// like Iterator.
+// CONTRACT: no updates are made to the tree while an iterator is active.
+func (tree *MutableTree) MultiRangeIterator(ranges []KeyRange, ascending bool) dbm.Iterator {
+	return newMultiRangeIterator(tree.Iterator, mergeKeyRanges(ranges, tree.compareKeys), ascending)
+}
+
+// newMultiRangeIterator returns an iterator over the given merged ranges, using iterator to create
+// an iterator for each range.
+func newMultiRangeIterator(iterator func(start, end []byte, ascending bool) dbm.Iterator, ranges []KeyRange, ascending bool) *multiRangeIterator {
+	iter := &multiRangeIterator{
+		iterator:  iterator,
+		ranges:    ranges,
+		ascending: ascending,
+	}
+	iter.advance()
+	return iter
+}
+
+// advance moves to the next range with any keys, unless the current iterator is still valid.
+func (iter *multiRangeIterator) advance() {
+	for iter.iter == nil || !iter.iter.Valid() {
+		if iter.iter != nil {
+			err := iter.iter.Close()
+			iter.iter = nil
+			if err != nil {
+				iter.err = err
+				return
+			}
+		}
+		if iter.next >= len(iter.ranges) {
+			return
+		}
+		r := iter.ranges[iter.next]
+		if !iter.ascending {
+			r = iter.ranges[len(iter.ranges)-1-iter.next]
+		}
+		iter.next++
+		iter.iter = iter.iterator(r.Start, r.End, iter.ascending)
+	}
+}
+
+// Domain implements dbm.Iterator, returning the bounds of the union of the ranges.
+func (iter *multiRangeIterator) Domain() ([]byte, []byte) {
+	if len(iter.ranges) == 0 {
+		return nil, nil
+	}
+	return iter.ranges[0].Start, iter.ranges[len(iter.ranges)-1].End
+}
+
+// Valid implements dbm.Iterator.
+func (iter *multiRangeIterator) Valid() bool {
+	return iter.iter != nil && iter.iter.Valid()
+}
+
+// Key implements dbm.Iterator.
+func (iter *multiRangeIterator) Key() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.iter.Key()
+}
+
+// Value implements dbm.Iterator.
+func (iter *multiRangeIterator) Value() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.iter.Value()
+}
+
+// Next implements dbm.Iterator.
+func (iter *multiRangeIterator) Next() {
+	if !iter.Valid() {
+		return
+	}
+	iter.iter.Next()
+	iter.advance()
+}
+
+// Error implements dbm.Iterator.
+func (iter *multiRangeIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	if iter.iter != nil {
+		return iter.iter.Error()
+	}
+	return nil
+}
+
+// Close implements dbm.Iterator.
+func (iter *multiRangeIterator) Close() error {
+	if iter.iter != nil {
+		if err := iter.iter.Close(); err != nil && iter.err == nil {
+			iter.err = err
+		}
+		iter.iter = nil
+	}
+	iter.next = len(iter.ranges)
+	return iter.err
+}
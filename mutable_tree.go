@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"math"
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,9 +19,15 @@ import (
 // ErrVersionDoesNotExist is returned if a requested version does not exist.
 var ErrVersionDoesNotExist = errors.New("version does not exist")
 
+// ErrUnflushedVersions is returned by operations which can't be performed while there are versions
+// saved with Options.DeferCommit that have not been flushed with FlushToDisk.
+var ErrUnflushedVersions = errors.New("there are unflushed versions, call FlushToDisk first")
+
 // MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
 // use, and should be guarded by a Mutex or RWLock as appropriate. An immutable tree at a given
-// version can be returned via GetImmutable, which is safe for concurrent access.
+// version can be returned via GetImmutable, which is safe for concurrent access. As an exception,
+// Get, Has, MultiGet, Iterate and WorkingImmutable can be called concurrently with a single
+// goroutine modifying and saving the tree, and observe the working tree at some point in time.
 //
 // Given and returned key/value byte slices must not be modified, since they may point to data
 // located inside IAVL which would also be modified.
@@ -27,15 +35,24 @@ var ErrVersionDoesNotExist = errors.New("version does not exist")
 // The inner ImmutableTree should not be used directly by callers.
 type MutableTree struct {
 	*ImmutableTree                                  // The current, working tree.
-	lastSaved                *ImmutableTree         // The most recently saved tree.
+	lastSaved                *ImmutableTree         // The most recently saved tree, sharing its persisted root.
 	orphans                  map[string]int64       // Nodes removed by changes to working tree.
 	versions                 map[int64]bool         // The previous, saved versions of the tree.
+	pendingDeletions         map[int64]bool         // Versions staged for deletion by DeleteVersionsNoCommit.
+	pruningHook              func([]int64) []int64  // Hook set by SetVersionPruningHook.
+	pruningErrorHandler      func(error)            // Handler set by SetPruningErrorHandler.
+	replayingWAL             bool                   // Whether ReplayWAL is applying journaled operations.
+	writeCounts              map[string]int         // Sets per key since the last save, see Options.DetectDuplicateWritesPerVersion.
 	allRootLoaded            bool                   // Whether all roots are loaded or not(by LazyLoadVersion)
 	unsavedFastNodeAdditions map[string]*FastNode   // FastNodes that have not yet been saved to disk
 	unsavedFastNodeRemovals  map[string]interface{} // FastNodes that have not yet been removed from disk
 	ndb                      *nodeDB
+	inMemory                 bool  // Whether the tree owns its in-memory database (see NewInMemoryTree).
+	importers                int32 // Number of open importers, which may have flushed nodes not yet reachable from a root.
+	orphanCapacity           int   // Removals the unsaved change maps were sized for by HintOrphanCapacity since the last save.
 
-	mtx sync.Mutex
+	mtx        sync.Mutex
+	workingMtx sync.RWMutex // Guards the working tree and unsaved fast nodes against concurrent readers.
 }
 
 // NewMutableTree returns a new tree with the specified cache size and datastore.
@@ -45,7 +62,28 @@ func NewMutableTree(db dbm.DB, cacheSize int) (*MutableTree, error) {
 
 // NewMutableTreeWithOpts returns a new tree with the specified options.
 func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) (*MutableTree, error) {
+	if opts != nil && opts.NodeCodec != nil && opts.ExternalValueThreshold > 0 {
+		return nil, errors.New("NodeCodec can't be combined with ExternalValueThreshold")
+	}
+	if opts != nil && opts.WAL != nil && opts.DeferCommit {
+		return nil, errors.New("WAL can't be combined with DeferCommit")
+	}
+	if opts != nil && (opts.Comparator == nil) != (opts.ComparatorName == "") {
+		return nil, errors.New("Comparator and ComparatorName must be set together")
+	}
 	ndb := newNodeDB(db, cacheSize, opts)
+	if err := ndb.checkNodeCodec(); err != nil {
+		return nil, err
+	}
+	if err := ndb.checkLeafHashSalt(); err != nil {
+		return nil, err
+	}
+	if err := ndb.checkComparator(); err != nil {
+		return nil, err
+	}
+	if err := ndb.checkValueCodec(); err != nil {
+		return nil, err
+	}
 	head := &ImmutableTree{ndb: ndb}
 
 	return &MutableTree{
@@ -53,6 +91,7 @@ func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) (*MutableTr
 		lastSaved:                head.clone(),
 		orphans:                  map[string]int64{},
 		versions:                 map[int64]bool{},
+		pendingDeletions:         map[int64]bool{},
 		allRootLoaded:            false,
 		unsavedFastNodeAdditions: make(map[string]*FastNode),
 		unsavedFastNodeRemovals:  make(map[string]interface{}),
@@ -60,6 +99,103 @@ func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) (*MutableTr
 	}, nil
 }
 
+// NewInMemoryTree returns a new tree with the specified cache size and options, which is kept
+// entirely in memory, e.g. for tests and caches. It is backed by an in-memory database owned by
+// the tree, so saved versions are kept in memory and nothing is ever written to disk. The memory
+// is released by Close.
+func NewInMemoryTree(cacheSize int, opts *Options) (*MutableTree, error) {
+	tree, err := NewMutableTreeWithOpts(dbm.NewMemDB(), cacheSize, opts)
+	if err != nil {
+		return nil, err
+	}
+	tree.inMemory = true
+	return tree, nil
+}
+
+// Close releases the memory held by the tree, including its caches and, for trees created by
+// NewInMemoryTree, its database with all saved versions. The database of other trees is owned by
+// the caller, and is not closed. The tree must not be used after it is closed.
+func (tree *MutableTree) Close() error {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb}
+	tree.lastSaved = tree.ImmutableTree.clone()
+	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
+	tree.versions = map[int64]bool{}
+	tree.pendingDeletions = map[int64]bool{}
+	tree.unsavedFastNodeAdditions = make(map[string]*FastNode)
+	tree.unsavedFastNodeRemovals = make(map[string]interface{})
+	return tree.ndb.close(tree.inMemory)
+}
+
+// Reset discards the tree's state, and rebinds it to the given database, which may be the same
+// one. The tree is then equivalent to a new tree created with the same cache size and options by
+// NewMutableTreeWithOpts, but reuses the allocations of its caches and maps, e.g. for processes
+// creating many short-lived trees. Trees created by NewInMemoryTree release their in-memory
+// database, and the tree doesn't own the given one. It returns an error if any versions have
+// active readers, e.g. exporters, or if the database doesn't match the tree's options, e.g. its
+// codecs or leaf hash salt, in which case the tree is left unchanged. Immutable trees and
+// iterators previously returned by the tree must not be used afterwards. It must not be called on
+// a closed tree.
+func (tree *MutableTree) Reset(db dbm.DB) error {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	// The database is checked against the options before the tree is rebound to it.
+	probe := &nodeDB{db: db, codec: tree.ndb.codec, opts: tree.ndb.opts}
+	if err := probe.checkNodeCodec(); err != nil {
+		return err
+	}
+	if err := probe.checkLeafHashSalt(); err != nil {
+		return err
+	}
+	if err := probe.checkComparator(); err != nil {
+		return err
+	}
+	if err := probe.checkValueCodec(); err != nil {
+		return err
+	}
+
+	previous := tree.ndb.db
+	if err := tree.ndb.reset(db); err != nil {
+		return err
+	}
+	if tree.inMemory && previous != db {
+		if err := previous.Close(); err != nil {
+			return err
+		}
+	}
+	tree.inMemory = false
+
+	tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb}
+	tree.lastSaved = tree.ImmutableTree.clone()
+	tree.allRootLoaded = false
+	tree.writeCounts = nil
+	for hash := range tree.orphans {
+		delete(tree.orphans, hash)
+	}
+	for version := range tree.versions {
+		delete(tree.versions, version)
+	}
+	for version := range tree.pendingDeletions {
+		delete(tree.pendingDeletions, version)
+	}
+	for key := range tree.unsavedFastNodeAdditions {
+		delete(tree.unsavedFastNodeAdditions, key)
+	}
+	for key := range tree.unsavedFastNodeRemovals {
+		delete(tree.unsavedFastNodeRemovals, key)
+	}
+	return nil
+}
+
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
 // not empty can be saved.
 func (tree *MutableTree) IsEmpty() bool {
@@ -99,6 +235,169 @@ func (tree *MutableTree) AvailableVersions() []int {
 	return res
 }
 
+// AvailableVersionsFromDisk returns all versions saved in the database in ascending order. Unlike
+// AvailableVersions, it doesn't depend on how the tree was loaded, e.g. by LazyLoadVersion, which
+// only loads the requested version. Versions staged by Options.DeferCommit are not included until
+// they are flushed.
+func (tree *MutableTree) AvailableVersionsFromDisk() ([]int, error) {
+	versions := []int{}
+	err := tree.ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		var version int64
+		rootKeyFormat.Scan(k, &version)
+		if !tree.ndb.hidesVersion(version) {
+			versions = append(versions, int(version))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// SyncVersions rebuilds the versions known to the tree from the versions saved in the database,
+// e.g. after LazyLoadVersion, which only registers the loaded version, so that AvailableVersions
+// is complete and VersionExists doesn't have to look up versions in the database. The working
+// tree is not reloaded.
+func (tree *MutableTree) SyncVersions() error {
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+	roots, err := tree.ndb.getRoots()
+	if err != nil {
+		return err
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.versions = make(map[int64]bool, len(roots))
+	for version := range roots {
+		tree.versions[version] = true
+	}
+	tree.allRootLoaded = true
+	return nil
+}
+
+// HistoryFingerprint returns a hash of the version numbers and root hashes of all versions saved
+// in the database, in ascending order, so that trees with identical version histories have the
+// same fingerprint, e.g. to validate that nodes are in sync. Unlike the root hash, it changes when
+// versions are deleted.
+func (tree *MutableTree) HistoryFingerprint() ([]byte, error) {
+	h := sha256.New()
+	err := tree.ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		var version int64
+		rootKeyFormat.Scan(k, &version)
+		if tree.ndb.hidesVersion(version) {
+			return nil
+		}
+		if len(v) == 0 {
+			// Empty trees are saved without a root node, but hash like Hash.
+			v = sha256.New().Sum(nil)
+		}
+		if err := encodeVarint(h, version); err != nil {
+			return err
+		}
+		return encodeBytes(h, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// IterateVersions calls fn with each version saved in the database and its root hash in ascending
+// version order, until fn returns true, reading the roots in a single pass rather than loading
+// each version. Empty versions report the hash of an empty tree, like Hash. Versions staged by
+// Options.DeferCommit are not included until they are flushed.
+func (tree *MutableTree) IterateVersions(fn func(version int64, rootHash []byte) bool) error {
+	itr, err := dbm.IteratePrefix(tree.ndb.db, rootKeyFormat.Key())
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		var version int64
+		rootKeyFormat.Scan(itr.Key(), &version)
+		if tree.ndb.hidesVersion(version) {
+			break
+		}
+		rootHash := append([]byte{}, itr.Value()...)
+		if len(rootHash) == 0 {
+			rootHash = sha256.New().Sum(nil)
+		}
+		if fn(version, rootHash) {
+			break
+		}
+	}
+	return itr.Error()
+}
+
+// VersionCount returns the number of versions saved in the database, like the length of
+// AvailableVersionsFromDisk but without building the version list.
+func (tree *MutableTree) VersionCount() (int, error) {
+	return tree.ndb.countVersions()
+}
+
+// VersionRange returns the first and last versions saved in the database, or 0 if there are none.
+// There may be gaps between them, e.g. from deleted versions or SaveVersionTo.
+func (tree *MutableTree) VersionRange() (first, last int64, err error) {
+	return tree.ndb.versionRange()
+}
+
+// VersionSizeBytes estimates the storage cost of a version in bytes, as the size of the database
+// entries written for the nodes created by it, i.e. with that version, and for the fast nodes of
+// the leaves it set. The entries for its root, orphans and metadata are not included, nor are
+// fast nodes that overwrote or were overwritten by those of other versions accounted for.
+func (tree *MutableTree) VersionSizeBytes(version int64) (int64, error) {
+	rootHash, err := tree.ndb.getRoot(version)
+	if err != nil {
+		return 0, err
+	}
+	if rootHash == nil {
+		return 0, ErrVersionDoesNotExist
+	}
+	if len(rootHash) == 0 {
+		return 0, nil
+	}
+	return tree.ndb.versionSize(tree.ndb.GetNode(rootHash), version)
+}
+
+// CopyTo copies all saved versions of the tree, along with their orphans, fast nodes and metadata,
+// to the empty database dst, e.g. to fork a chain. A tree loaded from dst has identical versions
+// and hashes. The data is streamed in batches rather than loaded into memory. Unsaved changes are
+// not copied, and the tree must not be saved or have versions deleted while copying.
+func (tree *MutableTree) CopyTo(dst dbm.DB) error {
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+	return tree.ndb.copyTo(dst)
+}
+
+// PinnedVersions returns the versions which currently have active readers, e.g. exporters, in
+// ascending order. Pinned versions cannot be deleted until their readers are closed.
+func (tree *MutableTree) PinnedVersions() []int64 {
+	return tree.ndb.pinnedVersions()
+}
+
+// CacheUtilization returns the number of nodes in the node cache, its capacity as given by the
+// cache size, and the ratio between them. The fill ratio is 0 if the cache is disabled. It does
+// not affect the eviction order of the cache.
+func (tree *MutableTree) CacheUtilization() (entries, capacity int, fillRatio float64) {
+	entries, capacity = tree.ndb.nodeCacheUtilization()
+	if capacity > 0 {
+		fillRatio = float64(entries) / float64(capacity)
+	}
+	return entries, capacity, fillRatio
+}
+
+// LatestVersion returns the latest version saved in the database, or 0 if there are no versions.
+// Unlike Load, it does not load the tree or modify its in-memory state, so it can be used to
+// decide how to load the tree.
+func (tree *MutableTree) LatestVersion() (int64, error) {
+	return tree.ndb.readLatestVersion()
+}
+
 // Hash returns the hash of the latest saved version of the tree, as returned
 // by SaveVersion. If no versions have been saved, Hash returns nil.
 func (tree *MutableTree) Hash() []byte {
@@ -107,9 +406,19 @@ func (tree *MutableTree) Hash() []byte {
 
 // WorkingHash returns the hash of the current working tree.
 func (tree *MutableTree) WorkingHash() []byte {
+	// Hashing modifies the unsaved nodes.
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
 	return tree.ImmutableTree.Hash()
 }
 
+// PreviewSaveHash returns the hash and version that SaveVersion would produce for the current
+// working tree, without saving it. They match a subsequent SaveVersion call as long as the tree
+// is not modified in between.
+func (tree *MutableTree) PreviewSaveHash() ([]byte, int64) {
+	return tree.WorkingHash(), tree.workingVersion()
+}
+
 // String returns a string representation of the tree.
 func (tree *MutableTree) String() (string, error) {
 	return tree.ndb.String()
@@ -124,17 +433,110 @@ func (tree *MutableTree) prepareOrphansSlice() []*Node {
 // Set sets a key in the working tree. Nil values are invalid. The given
 // key/value byte slices must not be modified after this call, since they point
 // to slices stored within IAVL. It returns true when an existing value was
-// updated, while false means it was a new key.
+// updated, while false means it was a new key, or that the write was skipped because the value
+// was unchanged and Options.SkipUnchangedWrites is set.
 func (tree *MutableTree) Set(key, value []byte) (updated bool) {
-	var orphaned []*Node
-	orphaned, updated = tree.set(key, value)
-	tree.addOrphans(orphaned)
+	updated, err := tree.SetE(key, value)
+	if err != nil {
+		panic(err)
+	}
 	return updated
 }
 
+// SetE is like Set, but returns an error instead of panicking when given a nil value and
+// Options.NilValuePolicy is RejectNil, when the key or value exceeds the size limits given
+// by Options.MaxKeySize and Options.MaxValueSize, or when given an empty key and
+// Options.RejectEmptyKey is set.
+func (tree *MutableTree) SetE(key, value []byte) (updated bool, err error) {
+	_, updated, err = tree.setE(key, value)
+	return updated, err
+}
+
+// SetWithPrevious is like Set, but also returns the previous value of the key if it was updated,
+// which avoids a separate Get. The previous value must not be modified, since it may point to
+// data stored within IAVL.
+func (tree *MutableTree) SetWithPrevious(key, value []byte) (previous []byte, updated bool) {
+	previous, updated, err := tree.setE(key, value)
+	if err != nil {
+		panic(err)
+	}
+	return previous, updated
+}
+
+func (tree *MutableTree) setE(key, value []byte) (previous []byte, updated bool, err error) {
+	if value == nil {
+		switch tree.ndb.opts.NilValuePolicy {
+		case RejectNil:
+			return nil, false, errors.Errorf("attempt to store nil value at key '%s'", key)
+		case TreatNilAsEmpty:
+			value = []byte{}
+		}
+	}
+	if err := tree.ndb.opts.validateKeyValue(key, value); err != nil {
+		return nil, false, err
+	}
+	if key == nil {
+		// Fast storage can't hold nil keys, so store them as the equivalent empty key.
+		key = []byte{}
+	}
+	if maxHeight := tree.ndb.opts.MaxHeight; maxHeight > 0 && tree.root != nil {
+		if height := tree.root.heightAfterSet(tree.ImmutableTree, key); height > maxHeight {
+			return nil, false, errors.Errorf("setting key '%X' would grow the tree to height %d, exceeding maximum of %d",
+				key, height, maxHeight)
+		}
+	}
+	if err := tree.journal(walOpSet, key, value); err != nil {
+		return nil, false, err
+	}
+
+	orphaned, previous, updated := tree.set(key, value)
+	tree.addOrphans(orphaned)
+	if tree.ndb.opts.DetectDuplicateWritesPerVersion {
+		tree.countWrite(key)
+	}
+	return previous, updated, nil
+}
+
+// countWrite counts a write of the key since the last save, for DuplicateWrites.
+func (tree *MutableTree) countWrite(key []byte) {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	if tree.writeCounts == nil {
+		tree.writeCounts = map[string]int{}
+	}
+	tree.writeCounts[string(key)]++
+}
+
+// DuplicateWrites returns the keys which have been set more than once since the last save, in
+// ascending byte order, e.g. to detect bugs where a later write unintentionally overrides an
+// earlier one. It requires Options.DetectDuplicateWritesPerVersion, and returns nil otherwise.
+func (tree *MutableTree) DuplicateWrites() [][]byte {
+	if !tree.ndb.opts.DetectDuplicateWritesPerVersion {
+		return nil
+	}
+	tree.workingMtx.RLock()
+	defer tree.workingMtx.RUnlock()
+
+	keys := []string{}
+	for key, count := range tree.writeCounts {
+		if count > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	duplicates := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		duplicates = append(duplicates, []byte(key))
+	}
+	return duplicates
+}
+
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (t *MutableTree) Get(key []byte) []byte {
+	t.workingMtx.RLock()
+	defer t.workingMtx.RUnlock()
+
 	if t.root == nil {
 		return nil
 	}
@@ -142,10 +544,58 @@ func (t *MutableTree) Get(key []byte) []byte {
 	if fastNode, ok := t.unsavedFastNodeAdditions[string(key)]; ok {
 		return fastNode.value
 	}
+	if _, ok := t.unsavedFastNodeRemovals[string(key)]; ok {
+		return nil
+	}
 
 	return t.ImmutableTree.Get(key)
 }
 
+// GetCopy is like Get, but returns a copy of the value which may be modified by the caller.
+func (tree *MutableTree) GetCopy(key []byte) []byte {
+	return copyValue(tree.Get(key))
+}
+
+// GetInto is like Get, but copies the value into dst, see ImmutableTree.GetInto.
+func (tree *MutableTree) GetInto(key []byte, dst []byte) (n int, found bool) {
+	return getInto(tree.Get(key), dst)
+}
+
+// MultiGet returns the values of the given keys, positionally aligned with keys, with nil for keys
+// that do not exist. Keys are sorted internally and resolved in a single descent of the working
+// tree. The returned values must not be modified, since they may point to data stored within IAVL.
+func (tree *MutableTree) MultiGet(keys [][]byte) [][]byte {
+	tree.workingMtx.RLock()
+	defer tree.workingMtx.RUnlock()
+
+	values := make([][]byte, len(keys))
+	if tree.root == nil {
+		return values
+	}
+
+	pending := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if fastNode, ok := tree.unsavedFastNodeAdditions[string(key)]; ok {
+			values[i] = fastNode.value
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return tree.compareKeys(keys[pending[i]], keys[pending[j]]) < 0
+	})
+	tree.root.multiGet(tree.ImmutableTree, keys, pending, values)
+	return values
+}
+
+// Has returns whether or not a key exists in the working tree.
+func (tree *MutableTree) Has(key []byte) bool {
+	tree.workingMtx.RLock()
+	defer tree.workingMtx.RUnlock()
+	return tree.ImmutableTree.Has(key)
+}
+
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
 // producing an identical IAVL tree. The caller must call Close() on the importer when done.
 //
@@ -155,21 +605,50 @@ func (t *MutableTree) Get(key []byte) []byte {
 // Import can only be called on an empty tree. It is the callers responsibility that no other
 // modifications are made to the tree while importing.
 func (tree *MutableTree) Import(version int64) (*Importer, error) {
-	return newImporter(tree, version)
+	return newImporter(tree, version, ImporterOptions{})
+}
+
+// ImportWithOptions is like Import, but configures the importer with the given options, e.g. to
+// flush imported nodes to the database more often.
+func (tree *MutableTree) ImportWithOptions(version int64, opts ImporterOptions) (*Importer, error) {
+	return newImporter(tree, version, opts)
 }
 
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callnack, false otherwise
+//
+// Iteration is over a snapshot of the working tree taken when Iterate is called, so Set and
+// Remove calls made during iteration (e.g. by fn) are not observed by the iteration.
 func (t *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
+	t.workingMtx.RLock()
 	if t.root == nil {
+		t.workingMtx.RUnlock()
 		return false
 	}
 
-	if !t.IsFastCacheEnabled() {
-		return t.ImmutableTree.Iterate(fn)
+	if !t.fastIterationEnabled() {
+		// Saving modifies unsaved nodes, so they are copied to take the snapshot.
+		snapshot := &ImmutableTree{
+			root:            t.root.cloneUnpersisted(),
+			ndb:             t.ndb,
+			version:         t.version,
+			skipFastStorage: true,
+		}
+		t.workingMtx.RUnlock()
+		return snapshot.Iterate(fn)
+	}
+
+	additions := make(map[string]*FastNode, len(t.unsavedFastNodeAdditions))
+	for key, node := range t.unsavedFastNodeAdditions {
+		additions[key] = node
 	}
+	removals := make(map[string]interface{}, len(t.unsavedFastNodeRemovals))
+	for key, removal := range t.unsavedFastNodeRemovals {
+		removals[key] = removal
+	}
+	t.workingMtx.RUnlock()
 
-	itr := NewUnsavedFastIterator(nil, nil, true, t.ndb, t.unsavedFastNodeAdditions, t.unsavedFastNodeRemovals)
+	itr := NewUnsavedFastIterator(nil, nil, true, t.ndb, additions, removals)
 	defer itr.Close()
 
 	for ; itr.Valid(); itr.Next() {
@@ -184,13 +663,16 @@ func (t *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped b
 // Iterator returns an iterator over the mutable tree.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (t *MutableTree) Iterator(start, end []byte, ascending bool) dbm.Iterator {
-	if t.IsFastCacheEnabled() {
+	if t.fastIterationEnabled() {
 		return NewUnsavedFastIterator(start, end, ascending, t.ndb, t.unsavedFastNodeAdditions, t.unsavedFastNodeRemovals)
 	}
 	return t.ImmutableTree.Iterator(start, end, ascending)
 }
 
-func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated bool) {
+func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, previous []byte, updated bool) {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
 	if value == nil {
 		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
 	}
@@ -198,24 +680,30 @@ func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated
 	if tree.ImmutableTree.root == nil {
 		tree.addUnsavedAddition(key, NewFastNode(key, value, tree.version+1))
 		tree.ImmutableTree.root = NewNode(key, value, tree.version+1)
-		return nil, updated
+		return nil, nil, false
+	}
+
+	if tree.ndb.opts.SkipUnchangedWrites {
+		if _, existing := tree.ImmutableTree.root.get(tree.ImmutableTree, key); existing != nil && bytes.Equal(existing, value) {
+			return nil, nil, false
+		}
 	}
 
 	orphans = tree.prepareOrphansSlice()
-	tree.ImmutableTree.root, updated = tree.recursiveSet(tree.ImmutableTree.root, key, value, &orphans)
-	return orphans, updated
+	tree.ImmutableTree.root, previous, updated = tree.recursiveSet(tree.ImmutableTree.root, key, value, &orphans)
+	return orphans, previous, updated
 }
 
 func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orphans *[]*Node) (
-	newSelf *Node, updated bool,
+	newSelf *Node, previous []byte, updated bool,
 ) {
 	version := tree.version + 1
 
 	if node.isLeaf() {
 		tree.addUnsavedAddition(key, NewFastNode(key, value, version))
 
-		switch bytes.Compare(key, node.key) {
-		case -1:
+		switch cmp := tree.compareKeys(key, node.key); {
+		case cmp < 0:
 			return &Node{
 				key:       node.key,
 				height:    1,
@@ -223,8 +711,8 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 				leftNode:  NewNode(key, value, version),
 				rightNode: node,
 				version:   version,
-			}, false
-		case 1:
+			}, nil, false
+		case cmp > 0:
 			return &Node{
 				key:       key,
 				height:    1,
@@ -232,43 +720,158 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 				leftNode:  node,
 				rightNode: NewNode(key, value, version),
 				version:   version,
-			}, false
+			}, nil, false
 		default:
 			*orphans = append(*orphans, node)
-			return NewNode(key, value, version), true
+			return NewNode(key, value, version), node.value, true
 		}
 	} else {
 		*orphans = append(*orphans, node)
 		node = node.clone(version)
 
-		if bytes.Compare(key, node.key) < 0 {
-			node.leftNode, updated = tree.recursiveSet(node.getLeftNode(tree.ImmutableTree), key, value, orphans)
+		if tree.compareKeys(key, node.key) < 0 {
+			node.leftNode, previous, updated = tree.recursiveSet(node.getLeftNode(tree.ImmutableTree), key, value, orphans)
 			node.leftHash = nil // leftHash is yet unknown
 		} else {
-			node.rightNode, updated = tree.recursiveSet(node.getRightNode(tree.ImmutableTree), key, value, orphans)
+			node.rightNode, previous, updated = tree.recursiveSet(node.getRightNode(tree.ImmutableTree), key, value, orphans)
 			node.rightHash = nil // rightHash is yet unknown
 		}
 
 		if updated {
-			return node, updated
+			return node, previous, updated
 		}
 		node.calcHeightAndSize(tree.ImmutableTree)
 		newNode := tree.balance(node, orphans)
-		return newNode, updated
+		return newNode, previous, updated
 	}
 }
 
 // Remove removes a key from the working tree. The given key byte slice should not be modified
-// after this call, since it may point to data stored inside IAVL.
+// after this call, since it may point to data stored inside IAVL. It panics when given an empty
+// key and Options.RejectEmptyKey is set, or if the removal can't be journaled to Options.WAL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool) {
-	val, orphaned, removed := tree.remove(key)
-	tree.addOrphans(orphaned)
+	val, removed, err := tree.RemoveE(key)
+	if err != nil {
+		panic(err)
+	}
 	return val, removed
 }
 
+// RemoveE is like Remove, but returns an error when given an empty key and
+// Options.RejectEmptyKey is set, or when the removal can't be journaled to Options.WAL.
+func (tree *MutableTree) RemoveE(key []byte) (value []byte, removed bool, err error) {
+	if tree.ndb.opts.RejectEmptyKey && len(key) == 0 {
+		return nil, false, errors.New("empty keys are not allowed")
+	}
+	if err := tree.journal(walOpRemove, key, nil); err != nil {
+		return nil, false, err
+	}
+	value, orphaned, removed := tree.remove(key)
+	tree.addOrphans(orphaned)
+	return value, removed, nil
+}
+
+// RemoveIfPresent is like Remove, but first checks whether the key exists with a read-only descent,
+// and only performs the remove when it does. This avoids the cost of a remove for keys that are
+// usually absent. The resulting tree is identical to Remove. Like Remove, it panics when given an
+// empty key and Options.RejectEmptyKey is set.
+func (tree *MutableTree) RemoveIfPresent(key []byte) (value []byte, removed bool) {
+	if tree.ndb.opts.RejectEmptyKey && len(key) == 0 {
+		panic(errors.New("empty keys are not allowed"))
+	}
+	tree.workingMtx.Lock()
+	if tree.root == nil || !tree.root.has(tree.ImmutableTree, key) {
+		tree.workingMtx.Unlock()
+		return nil, false
+	}
+	if err := tree.journal(walOpRemove, key, nil); err != nil {
+		tree.workingMtx.Unlock()
+		panic(err)
+	}
+	value, orphaned, removed := tree.removeLocked(key)
+	tree.workingMtx.Unlock()
+
+	tree.addOrphans(orphaned)
+	return value, removed
+}
+
+// RemoveRange removes all keys in the range [start, end) from the working tree, returning the
+// number of keys removed. Either bound may be nil, in which case the range is open on that side.
+// The resulting tree and orphans are identical to removing each key individually in ascending order.
+//
+// Since the shape of the tree depends on the rebalancing after each removal, the keys are still
+// removed one at a time, with a descent from the root each, but under a single lock and without
+// iterating through the tree's public API. A range covering the whole tree is cleared in a single
+// pass instead, since the tree is then empty regardless of the order of removals.
+//
+// If Options.RejectEmptyKey is set, an empty (but non-nil) bound returns an error.
+func (tree *MutableTree) RemoveRange(start, end []byte) (count int, err error) {
+	if tree.ndb.opts.RejectEmptyKey && ((start != nil && len(start) == 0) || (end != nil && len(end) == 0)) {
+		return 0, errors.New("empty keys are not allowed")
+	}
+	if start != nil && end != nil && tree.compareKeys(start, end) >= 0 {
+		return 0, errors.Errorf("invalid range [%X, %X), start must be lower than end", start, end)
+	}
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	if tree.root == nil {
+		return 0, nil
+	}
+
+	keys := [][]byte{}
+	nodes := []*Node{}
+	tree.root.traverseInRange(tree.ImmutableTree, start, end, true, false, false, func(node *Node) bool {
+		nodes = append(nodes, node)
+		if node.isLeaf() {
+			keys = append(keys, node.key)
+		}
+		return false
+	})
+	if int64(len(keys)) < tree.root.size {
+		for _, key := range keys {
+			if err := tree.journal(walOpRemove, key, nil); err != nil {
+				return count, err
+			}
+			_, orphaned, removed := tree.removeLocked(key)
+			if !removed {
+				return count, errors.Errorf("failed to remove key %X", key)
+			}
+			tree.addOrphans(orphaned)
+			count++
+		}
+		return count, nil
+	}
+
+	// Every node of the tree is on the path of some removed key, so clearing the tree orphans all
+	// of them, like removing the keys one at a time.
+	for i, key := range keys {
+		if err := tree.journal(walOpRemove, key, nil); err != nil {
+			// Remove the keys which were journaled, so that the WAL matches the tree.
+			for _, key := range keys[:i] {
+				_, orphaned, _ := tree.removeLocked(key)
+				tree.addOrphans(orphaned)
+			}
+			return i, err
+		}
+	}
+	for _, key := range keys {
+		tree.addUnsavedRemoval(key)
+	}
+	tree.addOrphans(nodes)
+	tree.root = nil
+	return len(keys), nil
+}
+
 // remove tries to remove a key from the tree and if removed, returns its
 // value, nodes orphaned and 'true'.
 func (tree *MutableTree) remove(key []byte) (value []byte, orphaned []*Node, removed bool) {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	return tree.removeLocked(key)
+}
+
+// removeLocked is like remove, but expects the caller to hold workingMtx.
+func (tree *MutableTree) removeLocked(key []byte) (value []byte, orphaned []*Node, removed bool) {
 	if tree.root == nil {
 		return nil, nil, false
 	}
@@ -307,7 +910,7 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte, orphans *[]*Nod
 	}
 
 	// node.key < key; we go to the left to find the key:
-	if bytes.Compare(key, node.key) < 0 {
+	if tree.compareKeys(key, node.key) < 0 {
 		newLeftHash, newLeftNode, newKey, value := tree.recursiveRemove(node.getLeftNode(tree.ImmutableTree), key, orphans) //nolint:govet
 
 		if len(*orphans) == 0 {
@@ -358,6 +961,10 @@ func (tree *MutableTree) Load() (int64, error) {
 // performs a no-op. Otherwise, if the root does not exist, an error will be
 // returned.
 func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
+	if tree.ndb.hasStagedWrites() {
+		return 0, ErrUnflushedVersions
+	}
+
 	latestVersion := tree.ndb.getLatestVersion()
 	if latestVersion < targetVersion {
 		return latestVersion, fmt.Errorf("wanted to load target %d but only found up to %d", targetVersion, latestVersion)
@@ -387,6 +994,8 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		return latestVersion, ErrVersionDoesNotExist
 	}
 
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
@@ -400,9 +1009,16 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		// If rootHash is empty then root of tree should be nil
 		// This makes `LazyLoadVersion` to do the same thing as `LoadVersion`
 		iTree.root = tree.ndb.GetNode(rootHash)
+		if tree.ndb.opts.VerifyOnLoad {
+			if err := iTree.root.verifyHash(rootHash, tree.ndb.opts.LeafHashSalt); err != nil {
+				return latestVersion, errors.Wrapf(err, "failed to verify root of version %d", targetVersion)
+			}
+		}
 	}
 
 	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
 
@@ -414,26 +1030,68 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 	return targetVersion, nil
 }
 
-// Returns the version number of the latest version found
-func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
-	roots, err := tree.ndb.getRoots()
-	if err != nil {
-		return 0, err
+// LazyLoadVersions is like LazyLoadVersion, but registers several versions as loaded, e.g. for
+// serving queries at a few historical versions, still without reading the roots of all versions.
+// The working tree is lazily loaded at the highest given version, and the roots of the others are
+// only read when they are accessed, e.g. by GetImmutable. Other versions can still be accessed,
+// and are then looked up in the database. As with LazyLoadVersion, writes are not supported. An
+// error is returned if any of the versions doesn't exist.
+func (tree *MutableTree) LazyLoadVersions(versions []int64) error {
+	if len(versions) == 0 {
+		return errors.New("no versions given")
 	}
-
-	if len(roots) == 0 {
-		if targetVersion <= 0 {
-			tree.mtx.Lock()
-			defer tree.mtx.Unlock()
-			_, err := tree.enableFastStorageAndCommitIfNotEnabled()
-			return 0, err
+	highest := versions[0]
+	for _, version := range versions {
+		has, err := tree.ndb.HasRoot(version)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+		}
+		if version > highest {
+			highest = version
 		}
-		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
 	}
 
-	firstVersion := int64(0)
-	latestVersion := int64(0)
-
+	if _, err := tree.LazyLoadVersion(highest); err != nil {
+		return err
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for _, version := range versions {
+		tree.versions[version] = true
+	}
+	return nil
+}
+
+// Returns the version number of the latest version found
+func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	if tree.ndb.hasStagedWrites() {
+		return 0, ErrUnflushedVersions
+	}
+
+	roots, err := tree.ndb.getRoots()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(roots) == 0 {
+		if targetVersion <= 0 {
+			tree.mtx.Lock()
+			defer tree.mtx.Unlock()
+			_, err := tree.enableFastStorageAndCommitIfNotEnabled()
+			return 0, err
+		}
+		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
+	}
+
+	firstVersion := int64(0)
+	latestVersion := int64(0)
+
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
@@ -466,9 +1124,16 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 
 	if len(latestRoot) != 0 {
 		t.root = tree.ndb.GetNode(latestRoot)
+		if tree.ndb.opts.VerifyOnLoad {
+			if err := t.root.verifyHash(latestRoot, tree.ndb.opts.LeafHashSalt); err != nil {
+				return latestVersion, errors.Wrapf(err, "failed to verify root of version %d", latestVersion)
+			}
+		}
 	}
 
 	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
 	tree.ImmutableTree = t
 	tree.lastSaved = t.clone()
 	tree.allRootLoaded = true
@@ -511,6 +1176,165 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64,
 	return latestVersion, nil
 }
 
+// VerifyFastStorage compares the fast nodes in the database with the leaves of the latest saved
+// version, and returns a mismatch for each key which is missing from either, or whose value or
+// version differs. The tree and the fast nodes are iterated side by side, so they aren't loaded
+// into memory. It is a read-only diagnostic, which returns an error if fast storage isn't enabled.
+func (tree *MutableTree) VerifyFastStorage() (mismatches []FastNodeMismatch, err error) {
+	if tree.ndb.hasStagedWrites() {
+		return nil, ErrUnflushedVersions
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return nil, errors.New("fast storage is not enabled")
+	}
+	if tree.ndb.opts.Comparator != nil {
+		return nil, errors.New("fast storage can't be verified for trees with a custom comparator")
+	}
+	latest, err := tree.ndb.readLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	t := &ImmutableTree{ndb: tree.ndb}
+	if latest > 0 {
+		if t, err = tree.GetImmutable(latest); err != nil {
+			return nil, err
+		}
+	}
+
+	itr, err := dbm.IteratePrefix(tree.ndb.db, fastKeyFormat.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	// nextFastNode returns the next fast node, or nil when there are no more or on errors.
+	nextFastNode := func() *FastNode {
+		if err != nil || !itr.Valid() {
+			return nil
+		}
+		var fastNode *FastNode
+		fastNode, err = tree.ndb.decodeFastNode(cp(itr.Key()[1:]), cp(itr.Value()))
+		itr.Next()
+		return fastNode
+	}
+	extra := func(fastNode *FastNode) FastNodeMismatch {
+		return FastNodeMismatch{
+			Kind:        FastNodeExtra,
+			Key:         fastNode.key,
+			FastValue:   fastNode.value,
+			FastVersion: fastNode.versionLastUpdatedAt,
+		}
+	}
+
+	mismatches = []FastNodeMismatch{}
+	fastNode := nextFastNode()
+	t.IterateRangeInclusive(nil, nil, true, func(key, value []byte, version int64) bool {
+		for fastNode != nil && bytes.Compare(fastNode.key, key) < 0 {
+			mismatches = append(mismatches, extra(fastNode))
+			fastNode = nextFastNode()
+		}
+		mismatch := FastNodeMismatch{Key: key, TreeValue: value, TreeVersion: version}
+		switch {
+		case fastNode == nil || !bytes.Equal(fastNode.key, key):
+			mismatch.Kind = FastNodeMissing
+			mismatches = append(mismatches, mismatch)
+			return err != nil
+		case !bytes.Equal(fastNode.value, value):
+			mismatch.Kind = FastNodeValueMismatch
+		case fastNode.versionLastUpdatedAt < version || fastNode.versionLastUpdatedAt > latest:
+			mismatch.Kind = FastNodeVersionMismatch
+		default:
+			fastNode = nextFastNode()
+			return err != nil
+		}
+		mismatch.FastValue = fastNode.value
+		mismatch.FastVersion = fastNode.versionLastUpdatedAt
+		mismatches = append(mismatches, mismatch)
+		fastNode = nextFastNode()
+		return err != nil
+	})
+	for fastNode != nil {
+		mismatches = append(mismatches, extra(fastNode))
+		fastNode = nextFastNode()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = itr.Error(); err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
+
+// RepairFastStorage detects whether the fast storage is inconsistent with the latest saved
+// version, e.g. if a crash tore the write of a version's fast nodes, and rebuilds it from the
+// tree if so, returning whether it was repaired. The fast storage is inconsistent if it was last
+// updated at an older version, or if VerifyFastStorage finds any mismatches, so the whole tree is
+// traversed. Trees without fast storage are left as is. The tree must not be saved concurrently.
+func (tree *MutableTree) RepairFastStorage() (repaired bool, err error) {
+	if tree.ndb.hasStagedWrites() {
+		return false, ErrUnflushedVersions
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return false, nil
+	}
+	if !tree.ndb.shouldForceFastStorageUpgrade() {
+		mismatches, err := tree.VerifyFastStorage()
+		if err != nil {
+			return false, err
+		}
+		if len(mismatches) == 0 {
+			return false, nil
+		}
+	}
+	if err := tree.rebuildFastStorage(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rebuildFastStorage replaces all fast nodes with the leaves of the latest saved version, and
+// commits them along with the storage version.
+func (tree *MutableTree) rebuildFastStorage() error {
+	latest, err := tree.ndb.readLatestVersion()
+	if err != nil {
+		return err
+	}
+	tree.ndb.logDebug("rebuilding fast storage", "version", latest)
+	t := &ImmutableTree{ndb: tree.ndb}
+	if latest > 0 {
+		if t, err = tree.GetImmutable(latest); err != nil {
+			return err
+		}
+	}
+
+	fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+	for ; fastItr.Valid(); fastItr.Next() {
+		if err = tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
+			fastItr.Close()
+			return err
+		}
+	}
+	if err = fastItr.Error(); err != nil {
+		fastItr.Close()
+		return err
+	}
+	if err = fastItr.Close(); err != nil {
+		return err
+	}
+
+	t.IterateRangeInclusive(nil, nil, true, func(key, value []byte, version int64) bool {
+		err = tree.ndb.SaveFastNodeNoCache(NewFastNode(key, value, version))
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = tree.ndb.setFastStorageVersionToBatch(); err != nil {
+		return err
+	}
+	return tree.ndb.Commit()
+}
+
 // Returns true if the tree may be auto-upgraded, false otherwise
 // An example of when an upgrade may be performed is when we are enaling fast storage for the first time or
 // need to overwrite fast nodes due to mismatch with live state.
@@ -525,7 +1349,7 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 	shouldForceUpdate := tree.ndb.shouldForceFastStorageUpgrade()
 	isFastStorageEnabled := tree.ndb.hasUpgradedToFastStorage()
 
-	if !tree.IsUpgradeable() {
+	if !tree.IsUpgradeable() || tree.ndb.opts.VersionCeiling > 0 {
 		return false, nil
 	}
 
@@ -560,13 +1384,13 @@ func (tree *MutableTree) enableFastStorageAndCommitLocked() error {
 }
 
 func (tree *MutableTree) enableFastStorageAndCommit() error {
-	debug("enabling fast storage, might take a while.")
+	tree.ndb.logDebug("enabling fast storage, might take a while", "version", tree.version)
 	var err error
 	defer func() {
 		if err != nil {
-			debug("failed to enable fast storage: %v\n", err)
+			tree.ndb.logDebug("failed to enable fast storage", "err", err)
 		} else {
-			debug("fast storage is enabled.")
+			tree.ndb.logDebug("fast storage is enabled")
 		}
 	}()
 
@@ -655,17 +1479,248 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 	}, nil
 }
 
+// GetImmutables is like GetImmutable, but opens several versions at once, taking the tree lock
+// only once. If any of the versions does not exist, it returns an error wrapping
+// ErrVersionDoesNotExist and opens none of them.
+func (tree *MutableTree) GetImmutables(versions []int64) (map[int64]*ImmutableTree, error) {
+	rootHashes := make(map[int64][]byte, len(versions))
+	for _, version := range versions {
+		if _, ok := rootHashes[version]; ok {
+			continue
+		}
+		rootHash, err := tree.ndb.getRoot(version)
+		if err != nil {
+			return nil, err
+		}
+		if rootHash == nil {
+			return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+		}
+		rootHashes[version] = rootHash
+	}
+
+	trees := make(map[int64]*ImmutableTree, len(rootHashes))
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for version, rootHash := range rootHashes {
+		tree.versions[version] = true
+		itree := &ImmutableTree{
+			ndb:     tree.ndb,
+			version: version,
+		}
+		if len(rootHash) > 0 {
+			itree.root = tree.ndb.GetNode(rootHash)
+		}
+		trees[version] = itree
+	}
+	return trees, nil
+}
+
+// GetImmutableRelative is like GetImmutable, but takes a version offset relative to the latest
+// version saved in the database, counting only existing versions: 0 is the latest version, -1 the
+// version saved before it, and so on, regardless of gaps between version numbers. It returns
+// ErrVersionDoesNotExist if the offset is positive or before the first version.
+func (tree *MutableTree) GetImmutableRelative(offset int64) (*ImmutableTree, error) {
+	versions, err := tree.AvailableVersionsFromDisk()
+	if err != nil {
+		return nil, err
+	}
+	index := int64(len(versions)-1) + offset
+	if offset > 0 || index < 0 {
+		return nil, ErrVersionDoesNotExist
+	}
+	return tree.GetImmutable(int64(versions[index]))
+}
+
+// WarmVersions loads the top levels of the given versions' trees into the node cache, using up to
+// parallelism goroutines, so that the first queries against them don't have to read the nodes
+// from the database. The cache is shared evenly between the versions, loading each tree breadth
+// first until its share is used, so it does nothing if the cache is disabled.
+func (tree *MutableTree) WarmVersions(versions []int64, parallelism int) error {
+	_, capacity := tree.ndb.nodeCacheUtilization()
+	if len(versions) == 0 || capacity == 0 {
+		return nil
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	budget := capacity / len(versions)
+
+	queue := make(chan int64, len(versions))
+	for _, version := range versions {
+		queue <- version
+	}
+	close(queue)
+
+	errs := make(chan error, parallelism)
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			for version := range queue {
+				if err := tree.warmVersion(version, budget); err != nil {
+					errs <- err
+					// Drain the queue, so the other workers stop.
+					for range queue {
+					}
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	var err error
+	for i := 0; i < parallelism; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// warmVersion loads up to budget nodes of a version's tree into the node cache, breadth first.
+func (tree *MutableTree) warmVersion(version int64, budget int) error {
+	rootHash, err := tree.ndb.getRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootHash == nil {
+		return errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+	}
+	if len(rootHash) == 0 {
+		return nil
+	}
+
+	hashes := [][]byte{rootHash}
+	for i := 0; i < len(hashes) && i < budget; i++ {
+		node := tree.ndb.GetNode(hashes[i])
+		if !node.isLeaf() {
+			hashes = append(hashes, node.leftHash, node.rightHash)
+		}
+	}
+	return nil
+}
+
+// WorkingImmutable returns a read-only snapshot of the current working tree, including unsaved
+// modifications, at the version the next SaveVersion call will save. Unsaved nodes are copied,
+// so subsequent changes to the mutable tree do not affect the snapshot, and the returned tree is
+// safe for concurrent access as long as the saved versions it builds on are not deleted.
+func (tree *MutableTree) WorkingImmutable() *ImmutableTree {
+	tree.workingMtx.RLock()
+	defer tree.workingMtx.RUnlock()
+	return &ImmutableTree{
+		root:            tree.root.cloneUnpersisted(),
+		ndb:             tree.ndb,
+		version:         tree.workingVersion(),
+		skipFastStorage: true,
+	}
+}
+
 // Rollback resets the working tree to the latest saved version, discarding
-// any unsaved modifications.
+// any unsaved modifications. It panics if Options.WAL can't be truncated, see RollbackE.
+//
+// The saved version is kept as a shallow clone of the saved tree, which only retains its root
+// node, since SaveVersion detaches persisted nodes from their children. Rollback therefore
+// doesn't cost any memory beyond the saved root, and reloads other nodes through the node cache.
 func (tree *MutableTree) Rollback() {
+	if err := tree.RollbackE(); err != nil {
+		panic(err)
+	}
+}
+
+// RollbackE is like Rollback, but returns an error instead of panicking if Options.WAL can't be
+// truncated, in which case the working tree is left unchanged.
+func (tree *MutableTree) RollbackE() error {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
+	if err := tree.truncateWAL(); err != nil {
+		return err
+	}
+
 	if tree.version > 0 {
 		tree.ImmutableTree = tree.lastSaved.clone()
 	} else {
 		tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, version: 0}
 	}
 	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
+	tree.unsavedFastNodeAdditions = map[string]*FastNode{}
+	tree.unsavedFastNodeRemovals = map[string]interface{}{}
+	return nil
+}
+
+// RollbackToVersion discards all unsaved changes like Rollback, and also deletes all saved versions
+// after the given version, which becomes the latest version and the base of the working tree. It
+// is like LoadVersionForOverwriting, but for a tree that is already loaded.
+func (tree *MutableTree) RollbackToVersion(version int64) error {
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
+	latestVersion := tree.ndb.getLatestVersion()
+	if version > latestVersion {
+		return errors.Errorf("cannot roll back to version %d after latest version %d", version, latestVersion)
+	}
+	rootHash, err := tree.ndb.getRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootHash == nil {
+		return ErrVersionDoesNotExist
+	}
+
+	t := &ImmutableTree{
+		ndb:     tree.ndb,
+		version: version,
+	}
+	if len(rootHash) != 0 {
+		t.root = tree.ndb.GetNode(rootHash)
+	}
+	if err := tree.truncateWAL(); err != nil {
+		return err
+	}
+
+	if version < latestVersion {
+		if err = tree.ndb.DeleteVersionsFrom(version + 1); err != nil {
+			tree.ndb.discardBatch()
+			return err
+		}
+	}
+
+	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
 	tree.unsavedFastNodeAdditions = map[string]*FastNode{}
 	tree.unsavedFastNodeRemovals = map[string]interface{}{}
+	tree.ImmutableTree = t
+	tree.lastSaved = t.clone()
+
+	if version == latestVersion {
+		return nil
+	}
+
+	// The fast index reflects the deleted latest version, so it has to be rebuilt.
+	tree.ndb.resetLatestVersion(version)
+	if err = tree.enableFastStorageAndCommitLocked(); err != nil {
+		return err
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for v := range tree.versions {
+		if v > version {
+			delete(tree.versions, v)
+		}
+	}
+	for v := range tree.pendingDeletions {
+		if v > version {
+			delete(tree.pendingDeletions, v)
+		}
+	}
+	return nil
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
@@ -674,7 +1729,7 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) []byte {
 	if tree.VersionExists(version) {
 		if tree.IsFastCacheEnabled() {
 			fastNode, _ := tree.ndb.GetFastNode(key)
-			if fastNode == nil && version == tree.ndb.latestVersion {
+			if fastNode == nil && version == atomic.LoadInt64(&tree.ndb.latestVersion) {
 				return nil
 			}
 
@@ -692,20 +1747,175 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) []byte {
 	return nil
 }
 
+// GetVersionedSlow is like GetVersioned, but always reads the value from the tree nodes of the
+// version, never from fast storage. It is slower, but doesn't depend on fast storage being
+// consistent with the version. The returned value must not be modified, since it may point to
+// data stored within IAVL.
+func (tree *MutableTree) GetVersionedSlow(key []byte, version int64) []byte {
+	t, err := tree.GetImmutable(version)
+	if err != nil || t.root == nil {
+		return nil
+	}
+	_, value := t.root.get(t, key)
+	return value
+}
+
+// GetVersionedOrEarlier gets the value at the specified key from the given version or, if that
+// version does not exist (e.g. because it was pruned), from the closest earlier version. It returns
+// the version that was used, or ErrVersionDoesNotExist if no version at or below the given version
+// exists. The returned value must not be modified, since it may point to data stored within IAVL.
+func (tree *MutableTree) GetVersionedOrEarlier(key []byte, version int64) (value []byte, usedVersion int64, err error) {
+	t, usedVersion, err := tree.GetImmutableClosest(version)
+	if err != nil {
+		return nil, usedVersion, err
+	}
+	return t.Get(key), usedVersion, nil
+}
+
+// GetImmutableClosest loads an ImmutableTree at the given version or, if that version does not
+// exist (e.g. because it was pruned), at the closest earlier version. It returns the version that
+// was used, or ErrVersionDoesNotExist if no version at or below the given version exists.
+func (tree *MutableTree) GetImmutableClosest(version int64) (*ImmutableTree, int64, error) {
+	if version <= 0 {
+		return nil, 0, ErrVersionDoesNotExist
+	}
+	var usedVersion int64
+	if version < math.MaxInt64 {
+		usedVersion = tree.ndb.getPreviousVersion(version + 1)
+	} else {
+		usedVersion = tree.ndb.getLatestVersion()
+	}
+	if usedVersion <= 0 {
+		return nil, 0, ErrVersionDoesNotExist
+	}
+
+	t, err := tree.GetImmutable(usedVersion)
+	if err != nil {
+		return nil, usedVersion, err
+	}
+	return t, usedVersion, nil
+}
+
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	hash, version, _, err := tree.saveVersion(tree.workingVersion(), nil)
+	return hash, version, err
+}
+
+// SaveVersionDetailed is like SaveVersion, but also returns whether the save was a new commit.
+// It is false if the version had already been saved with the same hash, in which case the save
+// is an idempotent no-op which writes nothing.
+func (tree *MutableTree) SaveVersionDetailed() (hash []byte, version int64, wasNewCommit bool, err error) {
+	return tree.saveVersion(tree.workingVersion(), nil)
+}
+
+// SaveVersionWithMetadata is like SaveVersion, but also saves an opaque metadata blob for the
+// version, e.g. a block time, which can be read with GetVersionMetadata. The metadata is not part
+// of the tree hash, and is deleted along with the version. If the version has already been saved
+// with the same hash, its existing metadata is kept.
+func (tree *MutableTree) SaveVersionWithMetadata(metadata []byte) ([]byte, int64, error) {
+	hash, version, _, err := tree.saveVersion(tree.workingVersion(), metadata)
+	return hash, version, err
+}
+
+// GetVersionMetadata returns the metadata saved by SaveVersionWithMetadata for a version, or nil
+// if the version was saved without metadata.
+func (tree *MutableTree) GetVersionMetadata(version int64) ([]byte, error) {
+	if !tree.VersionExists(version) {
+		return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+	}
+	return tree.ndb.getVersionMetadata(version)
+}
+
+// workingVersion returns the version that the next SaveVersion call will save.
+func (tree *MutableTree) workingVersion() int64 {
 	version := tree.version + 1
 	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
 		version = int64(tree.ndb.opts.InitialVersion)
 	}
+	return version
+}
+
+// SaveVersionTo saves a new tree version to disk at the given version, based on the current state
+// of the tree. The version must be greater than the latest saved version, but gaps are allowed,
+// e.g. for chains that skip heights. Returns the hash and new version number.
+//
+// The unsaved nodes are stamped with the given version before saving, so that the nodes of every
+// saved version have its version, like those saved by SaveVersion. Node hashes include their
+// version, so after a gap, the hash differs from WorkingHash, which assumes the next version.
+func (tree *MutableTree) SaveVersionTo(version int64) ([]byte, int64, error) {
+	if err := tree.checkNewVersion(version); err != nil {
+		return nil, version, err
+	}
+	next := tree.version + 1
+	if version != next {
+		tree.stampUnsaved(version)
+	}
+	hash, saved, _, err := tree.saveVersion(version, nil)
+	if err != nil && version != next {
+		tree.stampUnsaved(next)
+	}
+	return hash, saved, err
+}
 
+// checkNewVersion checks that a version can be saved after the current and latest saved versions.
+func (tree *MutableTree) checkNewVersion(version int64) error {
+	if latest := tree.ndb.getLatestVersion(); version <= latest {
+		return errors.Errorf("version %d must be greater than the latest saved version %d", version, latest)
+	}
+	if version <= tree.version {
+		return errors.Errorf("version %d must be greater than the current version %d", version, tree.version)
+	}
+	return nil
+}
+
+// stampUnsaved sets the version of the unsaved nodes and fast nodes of the working tree, which
+// are created with the version following the current one, and clears the hashes of the nodes so
+// that they are hashed with the new version.
+func (tree *MutableTree) stampUnsaved(version int64) {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
+	var stamp func(node *Node)
+	stamp = func(node *Node) {
+		if node == nil || node.persisted {
+			return
+		}
+		node.version = version
+		node.hash = nil
+		stamp(node.leftNode)
+		stamp(node.rightNode)
+	}
+	stamp(tree.root)
+	for _, fastNode := range tree.unsavedFastNodeAdditions {
+		fastNode.versionLastUpdatedAt = version
+	}
+}
+
+// saveVersion saves the working tree as the given version, and returns whether it was a new commit,
+// rather than an idempotent re-save of an existing version with the same hash.
+func (tree *MutableTree) saveVersion(version int64, metadata []byte) (hash []byte, savedVersion int64, wasNewCommit bool, err error) {
+	// Pruning runs after the save is complete and the locks below are released.
+	defer func() {
+		if err == nil {
+			err = tree.truncateWAL()
+		}
+		if err == nil && wasNewCommit {
+			if err = tree.runPruningHook(); err != nil {
+				err = errors.Wrapf(err, "pruning after saving version %d", savedVersion)
+			}
+		}
+	}()
+	if tree.ndb.opts.VersionCeiling > 0 {
+		return nil, version, false, errVersionCeiling
+	}
 	if tree.VersionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
 		// However, the same hash means idempotent (i.e. no-op).
 		existingHash, err := tree.ndb.getRoot(version)
 		if err != nil {
-			return nil, version, err
+			return nil, version, false, err
 		}
 
 		// If the existing root hash is empty (because the tree is empty), then we need to
@@ -717,54 +1927,159 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		var newHash = tree.WorkingHash()
 
 		if bytes.Equal(existingHash, newHash) {
+			tree.workingMtx.Lock()
 			tree.version = version
 			tree.ImmutableTree = tree.ImmutableTree.clone()
+			tree.workingMtx.Unlock()
 			tree.lastSaved = tree.ImmutableTree.clone()
 			tree.orphans = map[string]int64{}
-			return existingHash, version, nil
+			tree.writeCounts = nil
+			tree.orphanCapacity = 0
+			return existingHash, version, false, nil
 		}
 
-		return nil, version, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)", version, newHash, existingHash)
+		return nil, version, false, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)", version, newHash, existingHash)
+	}
+
+	// Saving modifies the unsaved nodes, and readers can't load them until they are committed.
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
+	// There can still be orphans if the tree is empty, for example if the root is the node being
+	// removed. Large orphan sets are flushed to the database, so they are deleted again on errors.
+	// Unless the commit is deferred, the rest of the save is rolled back too, so it can be retried.
+	var snapshot *saveSnapshot
+	if !tree.ndb.opts.DeferCommit {
+		snapshot = tree.snapshotSave()
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tree.ndb.rollbackOrphans(version, tree.orphans); rollbackErr != nil {
+				err = errors.Wrapf(err, "failed to roll back orphans: %v", rollbackErr)
+			}
+			if snapshot != nil {
+				if rollbackErr := tree.rollbackSave(snapshot); rollbackErr != nil {
+					err = errors.Wrapf(err, "failed to roll back save: %v", rollbackErr)
+				}
+			}
+		}
+	}()
+	if err = tree.ndb.SaveOrphans(version, tree.orphans); err != nil {
+		return nil, version, false, err
 	}
 
 	if tree.root == nil {
-		// There can still be orphans, for example if the root is the node being
-		// removed.
-		debug("SAVE EMPTY TREE %v\n", version)
-		tree.ndb.SaveOrphans(version, tree.orphans)
+		tree.ndb.logDebug("saving empty tree", "version", version)
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
-			return nil, 0, err
+			return nil, 0, false, err
 		}
 	} else {
-		debug("SAVE TREE %v\n", version)
-		tree.ndb.SaveBranch(tree.root)
-		tree.ndb.SaveOrphans(version, tree.orphans)
+		tree.ndb.logDebug("saving tree", "version", version)
+		if tree.ndb.opts.CommitParallelism > 1 {
+			// Hash the tree up front in parallel, rather than serially while saving it.
+			tree.ImmutableTree.hashWithCount()
+		}
+		if _, err := tree.ndb.SaveBranch(tree.root, snapshot); err != nil {
+			return nil, 0, false, err
+		}
 		if err := tree.ndb.SaveRoot(tree.root, version); err != nil {
-			return nil, 0, err
+			return nil, 0, false, err
+		}
+	}
+
+	if metadata != nil {
+		if err := tree.ndb.saveVersionMetadata(version, metadata); err != nil {
+			return nil, version, false, err
 		}
 	}
 
 	if err := tree.saveFastNodeVersion(); err != nil {
-		return nil, version, err
+		return nil, version, false, err
 	}
 
-	if err := tree.ndb.Commit(); err != nil {
-		return nil, version, err
+	deleted := [][2]int64{}
+	err = tree.ndb.deleteDueVersions(version, func(fromVersion, toVersion int64) {
+		deleted = append(deleted, [2]int64{fromVersion, toVersion})
+	})
+	if err != nil {
+		return nil, version, false, err
+	}
+
+	if !tree.ndb.opts.DeferCommit {
+		if err := tree.ndb.Commit(); err != nil {
+			return nil, version, false, err
+		}
 	}
 
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 	tree.version = version
 	tree.versions[version] = true
+	for _, r := range deleted {
+		for v := r[0]; v < r[1]; v++ {
+			delete(tree.versions, v)
+		}
+	}
 
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
 	tree.lastSaved = tree.ImmutableTree.clone()
 	tree.orphans = map[string]int64{}
+	tree.writeCounts = nil
+	tree.orphanCapacity = 0
 	tree.unsavedFastNodeAdditions = make(map[string]*FastNode)
 	tree.unsavedFastNodeRemovals = make(map[string]interface{})
 
-	return tree.Hash(), version, nil
+	return tree.Hash(), version, true, nil
+}
+
+// saveSnapshot is the state modified by a save, see MutableTree.snapshotSave.
+type saveSnapshot struct {
+	saved          []savedNode // Nodes saved so far, recorded by nodeDB.SaveBranch.
+	latestVersion  int64
+	storageVersion string
+}
+
+// savedNode is a node saved by nodeDB.SaveBranch, with the children it detached.
+type savedNode struct {
+	node      *Node
+	leftNode  *Node
+	rightNode *Node
+}
+
+// snapshotSave snapshots the node database before saving the working tree, so that a failed save
+// can be rolled back by rollbackSave. Saving modifies the unsaved nodes in place, so SaveBranch
+// records each node it saves in the snapshot as it goes, rather than the tree being copied up
+// front.
+func (tree *MutableTree) snapshotSave() *saveSnapshot {
+	return &saveSnapshot{
+		latestVersion:  tree.ndb.getLatestVersion(),
+		storageVersion: tree.ndb.getStorageVersion(),
+	}
+}
+
+// rollbackSave restores the working tree and node database from a snapshot after a failed save,
+// marking the saved nodes as unsaved again and reattaching their children. Their hashes are kept,
+// since they still match the nodes.
+func (tree *MutableTree) rollbackSave(snapshot *saveSnapshot) error {
+	nodes := make([]*Node, 0, len(snapshot.saved))
+	for _, saved := range snapshot.saved {
+		saved.node.persisted = false
+		saved.node.leftNode = saved.leftNode
+		saved.node.rightNode = saved.rightNode
+		nodes = append(nodes, saved.node)
+	}
+	fastNodeKeys := make([]string, 0, len(tree.unsavedFastNodeAdditions))
+	for key := range tree.unsavedFastNodeAdditions {
+		fastNodeKeys = append(fastNodeKeys, key)
+	}
+	return tree.ndb.rollbackSave(snapshot.latestVersion, snapshot.storageVersion, nodes, fastNodeKeys)
+}
+
+// FlushToDisk commits all versions staged by SaveVersion with Options.DeferCommit to the database
+// in a single batch. Staged versions are lost if they are not flushed.
+func (tree *MutableTree) FlushToDisk() error {
+	return tree.ndb.Commit()
 }
 
 func (tree *MutableTree) saveFastNodeVersion() error {
@@ -791,6 +2106,26 @@ func (tree *MutableTree) getUnsavedFastNodeRemovals() map[string]interface{} {
 	return tree.unsavedFastNodeRemovals
 }
 
+// PendingChanges returns the keys set and removed since the last saved version, each in sorted
+// order. Keys which were set and then removed are only returned as removed, even if they didn't
+// exist in the last saved version, and vice versa.
+func (tree *MutableTree) PendingChanges() (added [][]byte, removed [][]byte) {
+	tree.workingMtx.RLock()
+	defer tree.workingMtx.RUnlock()
+
+	added = make([][]byte, 0, len(tree.unsavedFastNodeAdditions))
+	for key := range tree.unsavedFastNodeAdditions {
+		added = append(added, []byte(key))
+	}
+	removed = make([][]byte, 0, len(tree.unsavedFastNodeRemovals))
+	for key := range tree.unsavedFastNodeRemovals {
+		removed = append(removed, []byte(key))
+	}
+	sort.Slice(added, func(i, j int) bool { return tree.compareKeys(added[i], added[j]) < 0 })
+	sort.Slice(removed, func(i, j int) bool { return tree.compareKeys(removed[i], removed[j]) < 0 })
+	return added, removed
+}
+
 func (tree *MutableTree) addUnsavedAddition(key []byte, node *FastNode) {
 	delete(tree.unsavedFastNodeRemovals, string(key))
 	tree.unsavedFastNodeAdditions[string(key)] = node
@@ -830,6 +2165,9 @@ func (tree *MutableTree) saveFastNodeRemovals() error {
 }
 
 func (tree *MutableTree) deleteVersion(version int64) error {
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
 	if version <= 0 {
 		return errors.New("version must be greater than 0")
 	}
@@ -839,24 +2177,95 @@ func (tree *MutableTree) deleteVersion(version int64) error {
 	if !tree.VersionExists(version) {
 		return errors.Wrap(ErrVersionDoesNotExist, "")
 	}
+	if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+		return tree.ndb.deferDeleteVersionsRange(version, version+1)
+	}
 	if err := tree.ndb.DeleteVersion(version, true); err != nil {
+		if discardErr := tree.ndb.discardBatch(); discardErr != nil {
+			return errors.Wrap(err, discardErr.Error())
+		}
 		return err
 	}
 
 	return nil
 }
 
+// IterateOrphans calls fn for each orphaned node whose lifetime ends at the given version, i.e.
+// nodes which were replaced or removed in the next saved version, with the first and last versions
+// at which the node is part of the tree. These nodes are deleted along with the version, unless
+// they are still used by an earlier version. The iteration stops if fn returns true. Orphans
+// staged by Options.DeferCommit are not included until they are flushed.
+func (tree *MutableTree) IterateOrphans(version int64, fn func(nodeHash []byte, fromVersion, toVersion int64) bool) error {
+	itr, err := dbm.IteratePrefix(tree.ndb.db, orphanKeyFormat.Key(version))
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		var fromVersion, toVersion int64
+		orphanKeyFormat.Scan(itr.Key(), &toVersion, &fromVersion)
+		if fn(itr.Value(), fromVersion, toVersion) {
+			break
+		}
+	}
+	return itr.Error()
+}
+
+// Compact reclaims disk space by deleting nodes which are not reachable from any saved version,
+// e.g. left behind by interrupted pruning, and then compacting the database if the backend
+// supports it (currently only GoLevelDB), so that deleted data is removed from disk. Only
+// unreachable data is deleted, so the saved versions are intact if Compact is interrupted. It can
+// take a long time on large databases. Saving versions and starting imports block while
+// unreachable nodes are deleted, and it returns an error if an import is in progress, since the
+// nodes flushed by the importer are not reachable until it is committed.
+func (tree *MutableTree) Compact() error {
+	if tree.ndb.opts.VersionCeiling > 0 {
+		return errVersionCeiling
+	}
+	deleted, err := tree.deleteUnreachableNodes()
+	if err != nil {
+		return err
+	}
+	tree.ndb.logDebug("compacting: deleted unreachable nodes", "count", deleted)
+	return tree.ndb.compactDB()
+}
+
+// deleteUnreachableNodes deletes the unreachable nodes for Compact, holding workingMtx so that
+// the nodes of versions being saved concurrently aren't deleted.
+func (tree *MutableTree) deleteUnreachableNodes() (int, error) {
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+
+	if tree.ndb.hasStagedWrites() {
+		return 0, ErrUnflushedVersions
+	}
+	if atomic.LoadInt32(&tree.importers) > 0 {
+		return 0, errors.New("cannot compact while an import is in progress")
+	}
+	return tree.ndb.deleteUnreachableNodes()
+}
+
 // SetInitialVersion sets the initial version of the tree, replacing Options.InitialVersion.
 // It is only used during the initial SaveVersion() call for a tree with no other versions,
-// and is otherwise ignored.
-func (tree *MutableTree) SetInitialVersion(version uint64) {
+// and is otherwise ignored. It returns an error and leaves the initial version unchanged if
+// versions below it have already been saved, which would fail to load.
+func (tree *MutableTree) SetInitialVersion(version uint64) error {
+	first, _, err := tree.ndb.versionRange()
+	if err != nil {
+		return err
+	}
+	if first > 0 && first < int64(version) {
+		return errors.Errorf("cannot set initial version to %v, found earlier version %v", version, first)
+	}
 	tree.ndb.opts.InitialVersion = version
+	return nil
 }
 
 // DeleteVersions deletes a series of versions from the MutableTree.
 // Deprecated: please use DeleteVersionsRange instead.
 func (tree *MutableTree) DeleteVersions(versions ...int64) error {
-	debug("DELETING VERSIONS: %v\n", versions)
+	tree.ndb.logDebug("deleting versions", "versions", versions)
 
 	if len(versions) == 0 {
 		return nil
@@ -887,9 +2296,26 @@ func (tree *MutableTree) DeleteVersions(versions ...int64) error {
 
 // DeleteVersionsRange removes versions from an interval from the MutableTree (not inclusive).
 // An error is returned if any single version has active readers.
-// All writes happen in a single batch with a single commit.
+// All writes happen in a single batch with a single commit. If Options.OrphanGracePeriodVersions
+// is set, the versions remain readable until they are deleted by a later SaveVersion.
 func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error {
+	tree.ndb.logDebug("deleting version range", "from", fromVersion, "to", toVersion)
+
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+
+	if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+		if err := tree.ndb.deferDeleteVersionsRange(fromVersion, toVersion); err != nil {
+			return err
+		}
+		return tree.ndb.Commit()
+	}
+
 	if err := tree.ndb.DeleteVersionsRange(fromVersion, toVersion); err != nil {
+		if discardErr := tree.ndb.discardBatch(); discardErr != nil {
+			return errors.Wrap(err, discardErr.Error())
+		}
 		return err
 	}
 
@@ -906,10 +2332,333 @@ func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error
 	return nil
 }
 
+// DeleteVersionsExcept deletes all saved versions except those in keep, which must include the
+// latest saved version. Kept versions which don't exist are ignored. Each run of consecutive
+// deleted versions is deleted as a range, and all writes happen in a single batch with a single
+// commit. If an error is returned, e.g. because a version has active readers, no versions are
+// deleted. If Options.OrphanGracePeriodVersions is set, the versions remain readable until they
+// are deleted by a later SaveVersion.
+func (tree *MutableTree) DeleteVersionsExcept(keep []int64) error {
+	tree.ndb.logDebug("deleting versions except", "keep", keep)
+
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+	kept := make(map[int64]bool, len(keep))
+	for _, version := range keep {
+		kept[version] = true
+	}
+	versions, err := tree.AvailableVersionsFromDisk()
+	if err != nil || len(versions) == 0 {
+		return err
+	}
+	if latest := int64(versions[len(versions)-1]); !kept[latest] {
+		return errors.Errorf("cannot delete latest saved version (%d)", latest)
+	}
+	return tree.deleteVersionsBatch(versions, func(version int64) bool {
+		return !kept[version]
+	})
+}
+
+// deleteVersionsBatch deletes the saved versions for which shouldDelete returns true, given all
+// saved versions in ascending order, in a single batch with a single commit, see
+// DeleteVersionsExcept.
+func (tree *MutableTree) deleteVersionsBatch(versions []int, shouldDelete func(version int64) bool) error {
+	// Ranges span the gaps between consecutive deleted versions, since deleting a range
+	// determines the predecessor version from the database.
+	var ranges [][2]int64
+	deleted := make([]int64, 0, len(versions))
+	extend := false
+	for _, v := range versions {
+		version := int64(v)
+		if !shouldDelete(version) {
+			extend = false
+			continue
+		}
+		if extend {
+			ranges[len(ranges)-1][1] = version + 1
+		} else {
+			ranges = append(ranges, [2]int64{version, version + 1})
+		}
+		extend = true
+		deleted = append(deleted, version)
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	for _, r := range ranges {
+		var err error
+		if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+			err = tree.ndb.deferDeleteVersionsRange(r[0], r[1])
+		} else {
+			err = tree.ndb.DeleteVersionsRange(r[0], r[1])
+		}
+		if err != nil {
+			if discardErr := tree.ndb.discardBatch(); discardErr != nil {
+				return errors.Wrap(err, discardErr.Error())
+			}
+			return err
+		}
+	}
+
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+		return nil
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for _, version := range deleted {
+		delete(tree.versions, version)
+	}
+	return nil
+}
+
+// SetVersionPruningHook sets a hook which is called after each new version is saved, e.g. by
+// SaveVersion, with all saved versions in ascending order, and returns the versions to prune. They
+// are deleted in a single batch with a single commit, like DeleteVersionsExcept. The latest
+// version and versions which don't exist are never deleted. If pruning fails, the save returns
+// the error, but the new version remains saved. Versions aren't pruned while writes are staged by
+// Options.DeferCommit. A nil hook disables pruning.
+func (tree *MutableTree) SetVersionPruningHook(fn func(available []int64) (toDelete []int64)) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.pruningHook = fn
+}
+
+// runPruningHook prunes the versions returned by the hook set by SetVersionPruningHook, if any.
+func (tree *MutableTree) runPruningHook() error {
+	tree.mtx.Lock()
+	hook := tree.pruningHook
+	tree.mtx.Unlock()
+	if hook == nil || tree.ndb.hasStagedWrites() {
+		return nil
+	}
+
+	versions, err := tree.AvailableVersionsFromDisk()
+	if err != nil || len(versions) == 0 {
+		return err
+	}
+	available := make([]int64, len(versions))
+	for i, version := range versions {
+		available[i] = int64(version)
+	}
+	latest := available[len(available)-1]
+	toDelete := map[int64]bool{}
+	for _, version := range hook(available) {
+		if version != latest {
+			toDelete[version] = true
+		}
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+	tree.ndb.logDebug("pruning versions", "versions", len(toDelete))
+	return tree.deleteVersionsBatch(versions, func(version int64) bool {
+		return toDelete[version]
+	})
+}
+
+// SetPruningErrorHandler sets a handler for errors of the background pruning started by
+// StartPruning, which is called from the worker goroutine. A nil handler logs the errors to
+// Options.Logger instead.
+func (tree *MutableTree) SetPruningErrorHandler(fn func(err error)) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.pruningErrorHandler = fn
+}
+
+// StartPruning starts a background worker which prunes old versions every interval, keeping the
+// keepRecent latest versions and every version divisible by keepEvery, if it is greater than 0,
+// like the Cosmos SDK pruning options. The latest version is always kept. Pruning excludes
+// concurrent writes to the working tree, and versions with active readers, e.g. exporters, are
+// not pruned until a later run after the readers are closed. Errors are passed to the handler set
+// by SetPruningErrorHandler, and pruning is retried on the next run. The returned function stops
+// the worker, and waits for a running prune to finish.
+func (tree *MutableTree) StartPruning(keepRecent, keepEvery int64, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := tree.pruneVersions(keepRecent, keepEvery); err != nil {
+					tree.mtx.Lock()
+					onError := tree.pruningErrorHandler
+					tree.mtx.Unlock()
+					if onError != nil {
+						onError(err)
+					} else {
+						tree.ndb.logDebug("failed to prune versions", "err", err)
+					}
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// pruneVersions deletes the saved versions which aren't kept by the StartPruning policy, deleting
+// each run of consecutive pruned versions with DeleteVersionsRange. Versions saved concurrently
+// are newer than the pruned ones, so the working tree is only locked while deleting each range,
+// to keep saves from writing to the batch at the same time.
+func (tree *MutableTree) pruneVersions(keepRecent, keepEvery int64) error {
+	versions, err := tree.AvailableVersionsFromDisk()
+	if err != nil || len(versions) == 0 {
+		return err
+	}
+	latest := int64(versions[len(versions)-1])
+	keep := func(version int64) bool {
+		return version > latest-keepRecent || version == latest || (keepEvery > 0 && version%keepEvery == 0)
+	}
+
+	var from, to int64
+	for _, v := range versions {
+		version := int64(v)
+		if !keep(version) {
+			if from == 0 {
+				from = version
+			}
+			to = version + 1
+			continue
+		}
+		if from > 0 {
+			tree.workingMtx.Lock()
+			err := tree.DeleteVersionsRange(from, to)
+			tree.workingMtx.Unlock()
+			if err != nil {
+				return err
+			}
+			from = 0
+		}
+	}
+	return nil
+}
+
+// DeleteVersionsNoCommit stages the deletion of the given versions, which are deleted with a
+// single commit by CommitPending. Until then, nothing is written and the versions remain
+// readable. If any version can't be deleted, an error is returned and no versions are staged.
+func (tree *MutableTree) DeleteVersionsNoCommit(versions ...int64) error {
+	tree.ndb.logDebug("staging version deletions", "versions", versions)
+
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+	for _, version := range versions {
+		if version <= 0 {
+			return errors.New("version must be greater than 0")
+		}
+		if version == tree.version {
+			return errors.Errorf("cannot delete latest saved version (%d)", version)
+		}
+		if !tree.VersionExists(version) {
+			return errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+		}
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for _, version := range versions {
+		tree.pendingDeletions[version] = true
+	}
+	return nil
+}
+
+// CommitPending deletes all versions staged by DeleteVersionsNoCommit in a single batch with a
+// single commit. If an error is returned, e.g. because a version has active readers, no versions
+// are deleted and the staged deletions are kept. If Options.OrphanGracePeriodVersions is set, the
+// versions remain readable until they are deleted by a later SaveVersion.
+func (tree *MutableTree) CommitPending() error {
+	tree.mtx.Lock()
+	versions := make([]int64, 0, len(tree.pendingDeletions))
+	for version := range tree.pendingDeletions {
+		versions = append(versions, version)
+	}
+	tree.mtx.Unlock()
+
+	if len(versions) == 0 {
+		return nil
+	}
+	if tree.ndb.hasStagedWrites() {
+		return ErrUnflushedVersions
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+
+	// Deleting a range determines the predecessor version from the database, so ranges separated
+	// only by versions which no longer exist must be deleted together.
+	// Versions which have been deleted since they were staged are skipped.
+	var ranges [][2]int64
+	for _, version := range versions {
+		if !tree.VersionExists(version) {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			hasRoots, err := tree.ndb.hasRootsInRange(last[1], version)
+			if err != nil {
+				return err
+			}
+			if !hasRoots {
+				last[1] = version + 1
+				continue
+			}
+		}
+		ranges = append(ranges, [2]int64{version, version + 1})
+	}
+
+	for _, r := range ranges {
+		var err error
+		if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+			err = tree.ndb.deferDeleteVersionsRange(r[0], r[1])
+		} else {
+			err = tree.ndb.DeleteVersionsRange(r[0], r[1])
+		}
+		if err != nil {
+			if discardErr := tree.ndb.discardBatch(); discardErr != nil {
+				return errors.Wrap(err, discardErr.Error())
+			}
+			return err
+		}
+	}
+
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for _, version := range versions {
+		delete(tree.pendingDeletions, version)
+		if tree.ndb.opts.OrphanGracePeriodVersions == 0 {
+			delete(tree.versions, version)
+		}
+	}
+	return nil
+}
+
 // DeleteVersion deletes a tree version from disk. The version can then no
-// longer be accessed.
+// longer be accessed. If Options.OrphanGracePeriodVersions is set, the version
+// remains readable until it is deleted by a later SaveVersion.
 func (tree *MutableTree) DeleteVersion(version int64) error {
-	debug("DELETE VERSION: %d\n", version)
+	tree.ndb.logDebug("deleting version", "version", version)
 
 	if err := tree.deleteVersion(version); err != nil {
 		return err
@@ -919,6 +2668,10 @@ func (tree *MutableTree) DeleteVersion(version int64) error {
 		return err
 	}
 
+	if tree.ndb.opts.OrphanGracePeriodVersions > 0 {
+		return nil
+	}
+
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 	delete(tree.versions, version)
@@ -927,12 +2680,9 @@ func (tree *MutableTree) DeleteVersion(version int64) error {
 
 // Rotate right and return the new node and orphan.
 func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
-	version := tree.version + 1
-
-	// TODO: optimize balance & rotate.
-	node = node.clone(version)
+	node = tree.mutableNode(node)
 	orphaned := node.getLeftNode(tree.ImmutableTree)
-	newNode := orphaned.clone(version)
+	newNode := tree.mutableNode(orphaned)
 
 	newNoderHash, newNoderCached := newNode.rightHash, newNode.rightNode
 	newNode.rightHash, newNode.rightNode = node.hash, node
@@ -946,12 +2696,9 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
 
 // Rotate left and return the new node and orphan.
 func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node) {
-	version := tree.version + 1
-
-	// TODO: optimize balance & rotate.
-	node = node.clone(version)
+	node = tree.mutableNode(node)
 	orphaned := node.getRightNode(tree.ImmutableTree)
-	newNode := orphaned.clone(version)
+	newNode := tree.mutableNode(orphaned)
 
 	newNodelHash, newNodelCached := newNode.leftHash, newNode.leftNode
 	newNode.leftHash, newNode.leftNode = node.hash, node
@@ -963,8 +2710,18 @@ func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node) {
 	return newNode, orphaned
 }
 
+// mutableNode returns a node which can be modified, i.e. the node itself if it has not been
+// persisted, since it then only belongs to the working tree, or a clone otherwise. The returned
+// node's hash is nil. Unpersisted nodes are orphaned as well, but addOrphans skips them.
+func (tree *MutableTree) mutableNode(node *Node) *Node {
+	if node.persisted {
+		return node.clone(tree.version + 1)
+	}
+	node.hash = nil
+	return node
+}
+
 // NOTE: assumes that node can be modified
-// TODO: optimize balance & rotate
 func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node) {
 	if node.persisted {
 		panic("Unexpected balance() call on persisted node")
@@ -1010,6 +2767,34 @@ func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node) {
 	return node
 }
 
+// HintOrphanCapacity preallocates the maps tracking the unsaved changes of the working tree for
+// removing about n keys, e.g. before a large batch of removals, which avoids growing them
+// repeatedly. Each removal orphans a leaf and some inner nodes, so the orphan map is sized for
+// 2n nodes. It is purely a performance hint, and has no effect if the maps were already sized for
+// at least n removals since the last save.
+func (tree *MutableTree) HintOrphanCapacity(n int) {
+	if n <= 0 {
+		return
+	}
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	if n <= tree.orphanCapacity {
+		return
+	}
+
+	orphans := make(map[string]int64, 2*n)
+	for hash, version := range tree.orphans {
+		orphans[hash] = version
+	}
+	tree.orphans = orphans
+	removals := make(map[string]interface{}, n)
+	for key, value := range tree.unsavedFastNodeRemovals {
+		removals[key] = value
+	}
+	tree.unsavedFastNodeRemovals = removals
+	tree.orphanCapacity = n
+}
+
 func (tree *MutableTree) addOrphans(orphans []*Node) {
 	for _, node := range orphans {
 		if !node.persisted {
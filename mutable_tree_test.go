@@ -2,12 +2,21 @@ package iavl
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
 	"runtime"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cosmos/iavl/mock"
 	"github.com/golang/mock/gomock"
@@ -267,12 +276,24 @@ func TestMutableTree_SetInitialVersion(t *testing.T) {
 	memDB := db.NewMemDB()
 	tree, err := NewMutableTree(memDB, 0)
 	require.NoError(t, err)
-	tree.SetInitialVersion(9)
+	require.NoError(t, tree.SetInitialVersion(9))
 
 	tree.Set([]byte("a"), []byte{0x01})
 	_, version, err := tree.SaveVersion()
 	require.NoError(t, err)
 	assert.EqualValues(t, 9, version)
+
+	// Versions at or above the first saved version don't conflict.
+	require.NoError(t, tree.SetInitialVersion(9))
+	require.NoError(t, tree.SetInitialVersion(5))
+
+	// Later initial versions would fail to load the saved versions.
+	require.Error(t, tree.SetInitialVersion(10))
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.Load()
+	require.NoError(t, err)
+	assert.EqualValues(t, 9, version)
 }
 
 func BenchmarkMutableTree_Set(b *testing.B) {
@@ -654,6 +675,32 @@ func TestIterate_MutableTree_Unsaved_NextVersion(t *testing.T) {
 	assertMutableMirrorIterate(t, tree, mirror)
 }
 
+func TestIterate_MutableTree_Snapshot(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	randomizeTreeAndMirror(t, tree, mirror)
+	require.True(t, tree.IsFastCacheEnabled())
+
+	sortedKeys := getSortedMirrorKeys(mirror)
+	i := 0
+	tree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, sortedKeys[i], string(key))
+		require.Equal(t, mirror[sortedKeys[i]], string(value))
+
+		// Mutate upcoming and new keys mid-iteration.
+		if i+1 < len(sortedKeys) {
+			tree.Remove([]byte(sortedKeys[i+1]))
+		}
+		tree.Set([]byte(sortedKeys[i]+"\x00"), []byte("new"))
+		tree.Set(key, []byte("updated"))
+		i++
+		return false
+	})
+	require.Equal(t, len(sortedKeys), i)
+}
+
 func TestIterator_MutableTree_Invalid(t *testing.T) {
 	tree, err := getTestTree(0)
 	require.NoError(t, err)
@@ -729,6 +776,10 @@ func TestUpgradeStorageToFast_DbErrorConstructor_Failure(t *testing.T) {
 	expectedError := errors.New("some db error")
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, expectedError).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(nodeCodecKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(leafHashSaltKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(comparatorKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(valueCodecKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
 
@@ -753,6 +804,10 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 	batchMock := mock.NewMockBatch(ctrl)
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(nodeCodecKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(leafHashSaltKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(comparatorKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(valueCodecKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
 
@@ -790,6 +845,10 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 	batchMock := mock.NewMockBatch(ctrl)
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(nodeCodecKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(leafHashSaltKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(comparatorKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(valueCodecKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
 
@@ -832,6 +891,10 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 
 	// dbMock represents the underlying database under the hood of nodeDB
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(nodeCodecKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(leafHashSaltKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(comparatorKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(valueCodecKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(2)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
 	startFormat := fastKeyFormat.Key()
@@ -1028,3 +1091,3160 @@ func setupTreeAndMirrorForUpgrade(t *testing.T) (*MutableTree, [][]string) {
 	})
 	return tree, mirror
 }
+
+func TestMutableTree_GetRemovedUnsaved(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.True(t, tree.IsFastCacheEnabled())
+
+	// The saved fast node of a key removed from the working tree must not be returned.
+	tree.Remove([]byte("a"))
+	require.Nil(t, tree.Get([]byte("a")))
+	require.False(t, tree.Has([]byte("a")))
+	require.Equal(t, []byte("2"), tree.Get([]byte("b")))
+
+	tree.Rollback()
+	require.Equal(t, []byte("1"), tree.Get([]byte("a")))
+}
+
+func TestMutableTree_MultiGet(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	require.Equal(t, [][]byte{nil, nil}, tree.MultiGet([][]byte{[]byte("a"), []byte("b")}))
+
+	for i := 0; i < 100; i += 2 {
+		tree.Set(i2b(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Mix saved and unsaved state.
+	tree.Set(i2b(1), []byte("unsaved"))
+	tree.Set(i2b(2), []byte("updated"))
+	tree.Remove(i2b(4))
+
+	keys := [][]byte{i2b(98), i2b(1), i2b(4), i2b(2), i2b(99), i2b(0), i2b(98), {}}
+	values := tree.MultiGet(keys)
+	require.Len(t, values, len(keys))
+	for i, key := range keys {
+		_, expected := tree.GetWithIndex(key)
+		require.Equal(t, expected, values[i], "key %X", key)
+	}
+	require.Equal(t, []byte("unsaved"), values[1])
+	require.Nil(t, values[2])
+	require.Equal(t, []byte("v98"), values[6])
+}
+
+func BenchmarkMutableTree_MultiGet(b *testing.B) {
+	tree, err := NewMutableTree(db.NewMemDB(), 100000)
+	require.NoError(b, err)
+	for i := 0; i < 100000; i++ {
+		tree.Set(i2b(i), randBytes(10))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = i2b(rand.Intn(100000))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = tree.MultiGet(keys)
+	}
+}
+
+func TestMutableTree_RemoveRange(t *testing.T) {
+	newTree := func() *MutableTree {
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			tree.Set(i2b(i), []byte(fmt.Sprintf("v%d", i)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		return tree
+	}
+
+	testcases := map[string]struct {
+		start, end []byte
+		expected   int
+	}{
+		"middle":      {i2b(10), i2b(40), 30},
+		"open start":  {nil, i2b(25), 25},
+		"open end":    {i2b(90), nil, 10},
+		"entire tree": {nil, nil, 100},
+		"empty range": {i2b(100), nil, 0},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			naive := newTree()
+			keys := [][]byte{}
+			naive.IterateRange(tc.start, tc.end, true, func(key, _ []byte) bool {
+				keys = append(keys, key)
+				return false
+			})
+			for _, key := range keys {
+				_, removed := naive.Remove(key)
+				require.True(t, removed)
+			}
+
+			tree := newTree()
+			count, err := tree.RemoveRange(tc.start, tc.end)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, count)
+			require.Equal(t, naive.WorkingHash(), tree.WorkingHash())
+			require.Equal(t, naive.orphans, tree.orphans)
+			require.EqualValues(t, 100-tc.expected, tree.Size())
+
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			naiveHash, _, err := naive.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, naiveHash, hash)
+		})
+	}
+
+	// Clearing a tree with unsaved changes orphans the same saved nodes as individual removals.
+	naive, tree := newTree(), newTree()
+	for _, tree := range []*MutableTree{naive, tree} {
+		tree.Set(i2b(200), []byte("new"))
+		tree.Set(i2b(50), []byte("updated"))
+		tree.Remove(i2b(10))
+	}
+	naive.Iterate(func(key, _ []byte) bool {
+		naive.Remove(key)
+		return false
+	})
+	count, err := tree.RemoveRange(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 100, count)
+	require.Nil(t, tree.root)
+	require.Equal(t, naive.orphans, tree.orphans)
+	require.Equal(t, naive.unsavedFastNodeRemovals, tree.unsavedFastNodeRemovals)
+	require.Empty(t, tree.unsavedFastNodeAdditions)
+
+	tree = newTree()
+	_, err = tree.RemoveRange(i2b(5), i2b(5))
+	require.Error(t, err)
+	_, err = tree.RemoveRange(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, tree.root)
+}
+
+func TestMutableTree_SaveVersionTo_Gap(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	countNodes := func() int {
+		count := 0
+		require.NoError(t, tree.ndb.traverseNodes(func([]byte, *Node) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersionTo(5)
+	require.NoError(t, err)
+	nodes := countNodes()
+
+	saveGap := func() {
+		tree.Set([]byte("a"), []byte("10"))
+		tree.Set([]byte("c"), []byte("3"))
+		workingHash := tree.WorkingHash()
+		hash, _, err := tree.SaveVersionTo(10)
+		require.NoError(t, err)
+		require.NotEqual(t, workingHash, hash)
+		require.EqualValues(t, 10, tree.root.version)
+
+		itree, err := tree.GetImmutable(10)
+		require.NoError(t, err)
+		keys := []string{}
+		itree.IterateNewLeaves(10, func(key, _ []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		require.Equal(t, []string{"a", "c"}, keys)
+		size, err := tree.VersionSizeBytes(10)
+		require.NoError(t, err)
+		require.Positive(t, size)
+	}
+
+	// Overwriting or rolling back the gap version deletes all of its nodes.
+	saveGap()
+	_, err = tree.LoadVersionForOverwriting(5)
+	require.NoError(t, err)
+	require.Equal(t, nodes, countNodes())
+	require.Nil(t, tree.Get([]byte("c")))
+
+	saveGap()
+	require.NoError(t, tree.RollbackToVersion(5))
+	require.Equal(t, nodes, countNodes())
+	require.Equal(t, []byte("1"), tree.Get([]byte("a")))
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	_, _, err = tree.SaveVersionTo(5)
+	require.EqualError(t, err, "version 5 must be greater than the latest saved version 5")
+}
+
+func TestMutableTree_SaveVersionTo(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	for _, version := range []int64{1, 5, 9} {
+		tree.Set([]byte("a"), []byte(fmt.Sprintf("v%d", version)))
+		tree.Set([]byte(fmt.Sprintf("k%d", version)), []byte{1})
+		_, saved, err := tree.SaveVersionTo(version)
+		require.NoError(t, err)
+		require.Equal(t, version, saved)
+		require.Equal(t, version, tree.Version())
+	}
+	require.Equal(t, []int{1, 5, 9}, tree.AvailableVersions())
+
+	_, _, err = tree.SaveVersionTo(9)
+	require.Error(t, err)
+	_, _, err = tree.SaveVersionTo(7)
+	require.Error(t, err)
+
+	// SaveVersion continues from the latest version.
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, version)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.LoadVersion(5)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+	require.Equal(t, []byte("v5"), tree.Get([]byte("a")))
+	require.Nil(t, tree.Get([]byte("k9")))
+
+	_, err = tree.LoadVersion(3)
+	require.Error(t, err)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersion(5))
+	require.Equal(t, []int{1, 9, 10}, tree.AvailableVersions())
+
+	require.Equal(t, []byte("v1"), tree.GetVersioned([]byte("a"), 1))
+	require.Nil(t, tree.GetVersioned([]byte("a"), 5))
+	require.Equal(t, []byte("v9"), tree.GetVersioned([]byte("a"), 9))
+	require.Equal(t, []byte{1}, tree.GetVersioned([]byte("k5"), 9))
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NoError(t, tree.DeleteVersion(9))
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+	require.Equal(t, []byte("v9"), tree.Get([]byte("a")))
+	require.Equal(t, []byte{1}, tree.Get([]byte("k1")))
+	require.Equal(t, []byte{1}, tree.Get([]byte("k5")))
+	for _, key := range []string{"a", "k1", "k5", "k9"} {
+		_, value := tree.GetWithIndex([]byte(key))
+		require.NotNil(t, value)
+	}
+}
+
+func TestMutableTree_WorkingImmutable(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set(i2b(i), []byte("saved"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set(i2b(1), []byte("unsaved"))
+	tree.Set(i2b(100), []byte("new"))
+	tree.Remove(i2b(2))
+
+	snapshot := tree.WorkingImmutable()
+	require.EqualValues(t, 2, snapshot.Version())
+	require.False(t, snapshot.IsFastCacheEnabled())
+	hash := tree.WorkingHash()
+	require.Equal(t, hash, snapshot.Hash())
+
+	mirror := map[string]string{}
+	tree.Iterate(func(key, value []byte) bool {
+		mirror[string(key)] = string(value)
+		return false
+	})
+
+	// Mutate and save the tree concurrently with reads from the snapshot.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			count := 0
+			snapshot.Iterate(func(key, value []byte) bool {
+				assert.Equal(t, mirror[string(key)], string(value))
+				count++
+				return false
+			})
+			assert.Equal(t, len(mirror), count)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		tree.Set(i2b(i), []byte("changed"))
+	}
+	tree.Remove(i2b(100))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	<-done
+
+	require.Equal(t, []byte("unsaved"), snapshot.Get(i2b(1)))
+	require.Equal(t, []byte("new"), snapshot.Get(i2b(100)))
+	require.Nil(t, snapshot.Get(i2b(2)))
+	require.Equal(t, []byte("saved"), snapshot.Get(i2b(3)))
+	require.Equal(t, hash, snapshot.Hash())
+}
+
+func TestMutableTree_VerifyOnLoad(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set(i2b(i), []byte{byte(i)})
+	}
+	rootHash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Tamper with the stored root node by altering its size.
+	root := *tree.root
+	root.size++
+	var buf bytes.Buffer
+	require.NoError(t, root.writeBytes(&buf))
+	require.NoError(t, memDB.Set(tree.ndb.nodeKey(rootHash), buf.Bytes()))
+
+	for _, verify := range []bool{false, true} {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{VerifyOnLoad: verify})
+		require.NoError(t, err)
+		_, err = tree.LoadVersion(1)
+		lazyTree, lazyErr := NewMutableTreeWithOpts(memDB, 0, &Options{VerifyOnLoad: verify})
+		require.NoError(t, lazyErr)
+		_, lazyErr = lazyTree.LazyLoadVersion(1)
+		if verify {
+			require.Error(t, err)
+			require.Error(t, lazyErr)
+		} else {
+			require.NoError(t, err)
+			require.NoError(t, lazyErr)
+		}
+	}
+}
+
+func TestMutableTree_GetVersionedOrEarlier(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	_, _, err = tree.GetVersionedOrEarlier([]byte("a"), 1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte("a"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsRange(2, 4))
+
+	testcases := []struct {
+		version         int64
+		expectedVersion int64
+		expectedValue   []byte
+	}{
+		{1, 1, []byte{1}},
+		{2, 1, []byte{1}},
+		{3, 1, []byte{1}},
+		{4, 4, []byte{4}},
+		{5, 5, []byte{5}},
+		{100, 5, []byte{5}},
+		{math.MaxInt64, 5, []byte{5}},
+	}
+	for _, tc := range testcases {
+		value, version, err := tree.GetVersionedOrEarlier([]byte("a"), tc.version)
+		require.NoError(t, err)
+		require.Equal(t, tc.expectedVersion, version, "version %d", tc.version)
+		require.Equal(t, tc.expectedValue, value, "version %d", tc.version)
+	}
+
+	value, version, err := tree.GetVersionedOrEarlier([]byte("b"), 3)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Nil(t, value)
+
+	require.NoError(t, tree.DeleteVersion(1))
+	_, _, err = tree.GetVersionedOrEarlier([]byte("a"), 3)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, _, err = tree.GetVersionedOrEarlier([]byte("a"), 0)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_GetVersionedSlow(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte{byte(i)}, []byte{1, byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 20; i += 2 {
+		tree.Set([]byte{byte(i)}, []byte{2, byte(i)})
+	}
+	for i := 1; i < 20; i += 4 {
+		tree.Remove([]byte{byte(i)})
+	}
+	tree.Set([]byte{100}, []byte{2})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.True(t, tree.IsFastCacheEnabled())
+
+	for _, version := range []int64{1, 2} {
+		for i := 0; i <= 100; i++ {
+			key := []byte{byte(i)}
+			require.Equal(t, tree.GetVersioned(key, version), tree.GetVersionedSlow(key, version),
+				"key %d version %d", i, version)
+		}
+	}
+	require.Equal(t, []byte{1, 4}, tree.GetVersionedSlow([]byte{4}, 1))
+	require.Equal(t, []byte{2, 4}, tree.GetVersionedSlow([]byte{4}, 2))
+	require.Nil(t, tree.GetVersionedSlow([]byte{5}, 2))
+	require.Nil(t, tree.GetVersionedSlow([]byte{4}, 3))
+	require.Nil(t, tree.GetVersionedSlow([]byte{4}, 0))
+
+	// Fast storage is not consulted, so stale fast nodes don't affect the result.
+	tree.ndb.fastNodeCache.Add(NewFastNode([]byte{4}, []byte("stale"), 2))
+	require.Equal(t, []byte("stale"), tree.GetVersioned([]byte{4}, 2))
+	require.Equal(t, []byte{2, 4}, tree.GetVersionedSlow([]byte{4}, 2))
+}
+
+func TestMutableTree_GetImmutableClosest(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for i := 1; i <= 8; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	require.NoError(t, tree.DeleteVersionsRange(1, 3))
+	require.NoError(t, tree.DeleteVersionsRange(4, 7))
+
+	testcases := map[int64]int64{3: 3, 4: 3, 6: 3, 7: 7, 8: 8, 9: 8, math.MaxInt64: 8}
+	for version, expected := range testcases {
+		itree, usedVersion, err := tree.GetImmutableClosest(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, usedVersion, "version %d", version)
+		require.Equal(t, expected, itree.Version())
+		require.Equal(t, hashes[expected], itree.Hash())
+		require.EqualValues(t, expected, itree.Size())
+	}
+
+	for _, version := range []int64{-1, 0, 1, 2} {
+		_, _, err = tree.GetImmutableClosest(version)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist, "version %d", version)
+	}
+}
+
+func TestMutableTree_GetImmutables(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	require.NoError(t, tree.DeleteVersion(3))
+
+	trees, err := tree.GetImmutables([]int64{1, 4, 5, 4})
+	require.NoError(t, err)
+	require.Len(t, trees, 3)
+	for _, version := range []int64{1, 4, 5} {
+		itree := trees[version]
+		require.NotNil(t, itree)
+		require.Equal(t, version, itree.Version())
+		require.Equal(t, hashes[version], itree.Hash())
+		require.EqualValues(t, version, itree.Size())
+	}
+
+	trees, err = tree.GetImmutables([]int64{})
+	require.NoError(t, err)
+	require.Empty(t, trees)
+
+	for _, versions := range [][]int64{{1, 3}, {6}, {0, 5}} {
+		trees, err = tree.GetImmutables(versions)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist, "versions %v", versions)
+		require.Nil(t, trees)
+	}
+}
+
+func TestMutableTree_PreviewSaveHash(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{InitialVersion: 10})
+	require.NoError(t, err)
+
+	// Empty tree.
+	previewHash, previewVersion := tree.PreviewSaveHash()
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, version)
+	require.Equal(t, hash, previewHash)
+	require.Equal(t, version, previewVersion)
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 20; j++ {
+			tree.Set(randBytes(4), randBytes(8))
+		}
+		tree.Remove(tree.ImmutableTree.root.key)
+
+		previewHash, previewVersion = tree.PreviewSaveHash()
+		hash, version, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, hash, previewHash)
+		require.Equal(t, version, previewVersion)
+	}
+	require.EqualValues(t, 13, version)
+}
+
+func TestMutableTree_PinnedVersions(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Empty(t, tree.PinnedVersions())
+
+	itree2, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	itree1, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	exporter2 := itree2.Export()
+	exporter1 := itree1.Export()
+	exporter1b := itree1.Export()
+	require.Equal(t, []int64{1, 2}, tree.PinnedVersions())
+	require.Error(t, tree.DeleteVersion(1))
+
+	exporter1.Close()
+	require.Equal(t, []int64{1, 2}, tree.PinnedVersions())
+	exporter1b.Close()
+	require.Equal(t, []int64{2}, tree.PinnedVersions())
+	exporter2.Close()
+	require.Empty(t, tree.PinnedVersions())
+	require.NoError(t, tree.DeleteVersion(1))
+}
+
+func TestMutableTree_OrphanGracePeriodVersions(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{OrphanGracePeriodVersions: 2})
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, 4)
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NoError(t, tree.DeleteVersionsRange(2, 4))
+	require.Error(t, tree.DeleteVersionsRange(2, 5))
+
+	// The deleted versions remain readable within the grace period.
+	for _, save := range []bool{false, true} {
+		if save {
+			tree.Set([]byte("k"), []byte{4})
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		for v := int64(1); v <= 3; v++ {
+			require.True(t, tree.VersionExists(v))
+			require.Equal(t, []byte{byte(v - 1)}, tree.GetVersioned([]byte("k"), v))
+		}
+	}
+
+	// Active readers postpone the deletion past the grace period.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	tree.Set([]byte("k"), []byte{5})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.True(t, tree.VersionExists(1))
+	require.False(t, tree.VersionExists(2))
+	require.False(t, tree.VersionExists(3))
+	require.Nil(t, tree.GetVersioned([]byte("k"), 2))
+	exporter.Close()
+
+	tree.Set([]byte("k"), []byte{6})
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+	require.Equal(t, []int{4, 5, 6, 7}, tree.AvailableVersions())
+
+	nodes, err = tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, 4)
+
+	// The deletions are persisted, and are not lost on reload.
+	require.NoError(t, tree.DeleteVersion(4))
+	tree, err = NewMutableTreeWithOpts(tree.ndb.db, 0, &Options{OrphanGracePeriodVersions: 2})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.True(t, tree.VersionExists(4))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.False(t, tree.VersionExists(4))
+
+	// Rolling back trims pending deletions, so versions saved again aren't deleted.
+	tree, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{OrphanGracePeriodVersions: 2})
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsRange(2, 5))
+	require.NoError(t, tree.RollbackToVersion(3))
+	for i := 4; i <= 7; i++ {
+		tree.Set([]byte("k"), []byte{byte(i * 10)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{1, 4, 5, 6, 7}, tree.AvailableVersions())
+	versions, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 4, 5, 6, 7}, versions)
+	require.Equal(t, []byte{40}, tree.GetVersioned([]byte("k"), 4))
+}
+
+func TestMutableTree_DeferCommit(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{DeferCommit: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	hashes := [][]byte{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j <= i; j++ {
+			tree.Set([]byte{byte(j)}, []byte{byte(i)})
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	// Nothing is written to the database, but the staged versions are readable.
+	has, err := memDB.Has(rootKeyFormat.Key(int64(1)))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Equal(t, []byte{2}, tree.Get([]byte{0}))
+	require.Equal(t, []byte{1}, tree.GetVersioned([]byte{0}, 2))
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, hashes[0], itree.Hash())
+	require.Equal(t, []byte{0}, itree.Get([]byte{0}))
+	count := 0
+	tree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, []byte{byte(2)}, value)
+		count++
+		return false
+	})
+	require.Equal(t, 3, count)
+
+	require.Equal(t, ErrUnflushedVersions, tree.DeleteVersion(1))
+	_, err = tree.LoadVersion(2)
+	require.Equal(t, ErrUnflushedVersions, err)
+
+	require.NoError(t, tree.FlushToDisk())
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	for i, hash := range hashes {
+		itree, err := tree.GetImmutable(int64(i + 1))
+		require.NoError(t, err)
+		require.Equal(t, hash, itree.Hash())
+		require.EqualValues(t, i+1, itree.Size())
+		require.Equal(t, []byte{byte(i)}, itree.Get([]byte{0}))
+	}
+}
+
+func TestMutableTree_LatestVersion(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, version)
+
+	for i := 0; i < 3; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersionTo(7)
+	require.NoError(t, err)
+	version, err = tree.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+
+	// A fresh tree on a populated database reads the latest version without loading it.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+	require.EqualValues(t, 0, tree.Version())
+	require.Empty(t, tree.AvailableVersions())
+	require.Nil(t, tree.root)
+	require.EqualValues(t, 0, tree.ndb.latestVersion)
+}
+
+func TestMutableTree_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-iavl-compact")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	levelDB, err := db.NewGoLevelDB("compact", dir)
+	require.NoError(t, err)
+	defer levelDB.Close()
+
+	tree, err := NewMutableTree(levelDB, 0)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	hashes := map[int64][]byte{}
+	for v := 1; v <= 50; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte{byte(r.Intn(100))}, []byte(strconv.Itoa(r.Int())))
+		}
+		tree.Remove([]byte{byte(r.Intn(100))})
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	for v := int64(1); v < 50; v++ {
+		if v%10 != 0 {
+			require.NoError(t, tree.DeleteVersion(v))
+			delete(hashes, v)
+		}
+	}
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	liveNodes := len(nodes)
+
+	// Simulate interrupted pruning, which leaves behind unreachable nodes and orphan entries.
+	for i := 0; i < 10; i++ {
+		node := NewNode([]byte{byte(i)}, []byte("stray"), 3)
+		node._hash(nil)
+		tree.ndb.SaveNode(node)
+		tree.ndb.saveOrphan(node.hash, 3, 3)
+	}
+	require.NoError(t, tree.ndb.Commit())
+	nodes, err = tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, liveNodes+10)
+
+	require.NoError(t, tree.Compact())
+	nodes, err = tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, liveNodes)
+
+	// All remaining versions load with the correct hashes, and can still be pruned. Compacting
+	// doesn't fill the node cache.
+	tree, err = NewMutableTree(levelDB, 1000)
+	require.NoError(t, err)
+	require.NoError(t, tree.Compact())
+	require.Zero(t, tree.ndb.nodeCache.Len())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Len(t, tree.AvailableVersions(), len(hashes))
+	for version, hash := range hashes {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, itree.Hash(), "version %d", version)
+		itree.Iterate(func(key, value []byte) bool { return false })
+	}
+	require.NoError(t, tree.DeleteVersionsRange(10, 40))
+	itree, err := tree.GetImmutable(40)
+	require.NoError(t, err)
+	require.Equal(t, hashes[40], itree.Hash())
+	require.NoError(t, tree.Compact())
+
+	// The nodes flushed by an importer aren't reachable until it is committed.
+	importTree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := importTree.ImportWithOptions(1, ImporterOptions{FlushThreshold: 1})
+	require.NoError(t, err)
+	require.NoError(t, importer.Add(&ExportNode{Key: []byte("a"), Value: []byte("1"), Version: 1}))
+	require.Error(t, importTree.Compact())
+	require.NoError(t, importer.Commit())
+	require.NoError(t, importTree.Compact())
+	require.Equal(t, []byte("1"), importTree.Get([]byte("a")))
+
+	// Large databases are swept in several chunks.
+	large, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for v := 0; v < 3; v++ {
+		for i := 0; i < maxBatchSize/3; i++ {
+			large.Set([]byte(strconv.Itoa(i*(v+1))), []byte{byte(v)})
+		}
+		_, _, err = large.SaveVersion()
+		require.NoError(t, err)
+	}
+	nodes, err = large.ndb.nodes()
+	require.NoError(t, err)
+	require.Greater(t, len(nodes), maxBatchSize)
+	liveNodes = len(nodes)
+	for i := 0; i < 10; i++ {
+		node := NewNode([]byte{byte(i)}, []byte("stray"), 4)
+		node._hash(nil)
+		large.ndb.SaveNode(node)
+	}
+	require.NoError(t, large.ndb.Commit())
+	require.NoError(t, large.Compact())
+	nodes, err = large.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, liveNodes)
+
+	// Corrupt nodes are reported as errors.
+	require.NoError(t, importTree.ndb.db.Set(importTree.ndb.nodeKey(importTree.Hash()), []byte{0xff}))
+	require.Error(t, importTree.Compact())
+}
+
+func TestMutableTree_ConcurrentReads(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%04d", i))
+	}
+
+	// The writer sets keys in ascending order and only updates existing keys, so any consistent
+	// view of the tree contains a contiguous range of keys, with values prefixed by their key.
+	// The tmp keys are removed and set again.
+	const numKeys = 500
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < numKeys; i++ {
+			tree.Set(key(i), append(key(i), 'a'))
+			tree.Set(key(i/2), append(key(i/2), 'b'))
+			tree.Remove([]byte(fmt.Sprintf("tmp%d", i%7)))
+			tree.Set([]byte(fmt.Sprintf("tmp%d", (i+1)%7)), []byte("tmp"))
+			if i%50 == 49 {
+				_, _, err := tree.SaveVersion()
+				assert.NoError(t, err)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for finished := false; !finished; {
+				select {
+				case <-done:
+					finished = true // read the final state once more
+				default:
+				}
+
+				count := 0
+				tree.Iterate(func(k, v []byte) bool {
+					if bytes.HasPrefix(k, []byte("tmp")) {
+						return false
+					}
+					assert.Equal(t, key(count), k)
+					assert.True(t, bytes.HasPrefix(v, k), "value %q for key %q", v, k)
+					count++
+					return false
+				})
+				for i := 0; i < count; i++ {
+					assert.True(t, tree.Has(key(i)))
+					assert.True(t, bytes.HasPrefix(tree.Get(key(i)), key(i)))
+				}
+				if finished {
+					assert.Equal(t, numKeys, count)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMutableTree_CacheUtilization(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	entries, capacity, ratio := tree.CacheUtilization()
+	require.Zero(t, entries)
+	require.Zero(t, capacity)
+	require.Zero(t, ratio)
+
+	for i := 0; i < 4; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Loading all 7 nodes of the tree populates the cache.
+	for _, tc := range []struct {
+		cacheSize int
+		entries   int
+		ratio     float64
+	}{
+		{20, 7, 0.35},
+		{7, 7, 1},
+		{4, 4, 1},
+	} {
+		tree, err = NewMutableTree(memDB, tc.cacheSize)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		tree.root.traverse(tree.ImmutableTree, true, func(*Node) bool { return false })
+
+		entries, capacity, ratio = tree.CacheUtilization()
+		require.Equal(t, tc.entries, entries)
+		require.Equal(t, tc.cacheSize, capacity)
+		require.InDelta(t, tc.ratio, ratio, 1e-9)
+	}
+}
+
+func TestMutableTree_DeleteVersionsNoCommit(t *testing.T) {
+	newTree := func(memDB db.DB) *MutableTree {
+		tree, err := NewMutableTree(memDB, 0)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	saveVersions := func(tree *MutableTree) {
+		for v := 1; v <= 10; v++ {
+			for i := 0; i < 20; i++ {
+				tree.Set([]byte(fmt.Sprintf("key%02d", (v*7+i)%30)), []byte(fmt.Sprintf("%d-%d", v, i)))
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersion(4))
+	}
+
+	memDB := db.NewMemDB()
+	tree := newTree(memDB)
+	saveVersions(tree)
+
+	require.NoError(t, tree.DeleteVersionsNoCommit(2, 7))
+	require.NoError(t, tree.DeleteVersionsNoCommit(5, 3, 7))
+	require.ErrorIs(t, tree.DeleteVersionsNoCommit(8, 4), ErrVersionDoesNotExist)
+	require.Error(t, tree.DeleteVersionsNoCommit(10))
+	require.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9, 10}, tree.AvailableVersions())
+
+	// Nothing is written before the deletions are committed, so they are lost on a crash.
+	crashed := newTree(memDB)
+	require.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9, 10}, crashed.AvailableVersions())
+	require.Equal(t, []byte("2-0"), crashed.GetVersioned([]byte("key14"), 2))
+
+	// Deletions fail atomically if a version has active readers.
+	itree, err := tree.GetImmutable(7)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	require.Error(t, tree.CommitPending())
+	require.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9, 10}, newTree(memDB).AvailableVersions())
+	exporter.Close()
+
+	require.NoError(t, tree.CommitPending())
+	require.Equal(t, []int{1, 6, 8, 9, 10}, tree.AvailableVersions())
+	require.Equal(t, []int{1, 6, 8, 9, 10}, newTree(memDB).AvailableVersions())
+	require.NoError(t, tree.CommitPending())
+
+	// The database must be identical to deleting the versions one by one.
+	expectDB := db.NewMemDB()
+	expect := newTree(expectDB)
+	saveVersions(expect)
+	for _, version := range []int64{2, 3, 5, 7} {
+		require.NoError(t, expect.DeleteVersion(version))
+	}
+	require.Equal(t, dumpDB(t, expectDB), dumpDB(t, memDB))
+}
+
+func TestMutableTree_DeleteVersionsExcept(t *testing.T) {
+	newTree := func(memDB db.DB) *MutableTree {
+		tree, err := NewMutableTree(memDB, 0)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	saveVersions := func(tree *MutableTree) {
+		for v := 1; v <= 10; v++ {
+			for i := 0; i < 20; i++ {
+				tree.Set([]byte(fmt.Sprintf("key%02d", (v*7+i)%30)), []byte(fmt.Sprintf("%d-%d", v, i)))
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersion(4))
+	}
+
+	memDB := db.NewMemDB()
+	tree := newTree(memDB)
+	saveVersions(tree)
+
+	// The latest version can't be deleted.
+	require.Error(t, tree.DeleteVersionsExcept([]int64{1, 6}))
+	require.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9, 10}, tree.AvailableVersions())
+
+	// Deletions fail atomically if a version has active readers.
+	itree, err := tree.GetImmutable(7)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	require.Error(t, tree.DeleteVersionsExcept([]int64{10, 1, 6}))
+	require.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9, 10}, newTree(memDB).AvailableVersions())
+	exporter.Close()
+
+	// Kept versions which don't exist are ignored.
+	require.NoError(t, tree.DeleteVersionsExcept([]int64{10, 1, 6, 4, 11}))
+	require.Equal(t, []int{1, 6, 10}, tree.AvailableVersions())
+	require.Equal(t, []int{1, 6, 10}, newTree(memDB).AvailableVersions())
+	require.Equal(t, []byte("6-8"), tree.GetVersioned([]byte("key20"), 6))
+	require.NoError(t, tree.DeleteVersionsExcept([]int64{1, 6, 10}))
+	require.Equal(t, []int{1, 6, 10}, tree.AvailableVersions())
+
+	// The database must be identical to deleting the versions one by one.
+	expectDB := db.NewMemDB()
+	expect := newTree(expectDB)
+	saveVersions(expect)
+	for _, version := range []int64{2, 3, 5, 7, 8, 9} {
+		require.NoError(t, expect.DeleteVersion(version))
+	}
+	require.Equal(t, dumpDB(t, expectDB), dumpDB(t, memDB))
+
+	require.NoError(t, tree.DeleteVersionsExcept([]int64{10}))
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+}
+
+func TestMutableTree_SetVersionPruningHook(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	// Keep the 3 latest versions, and try to delete the latest one too.
+	var calls [][]int64
+	tree.SetVersionPruningHook(func(available []int64) []int64 {
+		calls = append(calls, append([]int64{}, available...))
+		toDelete := []int64{available[len(available)-1], 100}
+		if len(available) > 3 {
+			toDelete = append(toDelete, available[:len(available)-3]...)
+		}
+		return toDelete
+	})
+
+	for v := int64(1); v <= 6; v++ {
+		tree.Set([]byte(fmt.Sprintf("key%d", v)), []byte{byte(v)})
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, v, version)
+
+		expect := []int{}
+		for e := v - 2; e <= v; e++ {
+			if e >= 1 {
+				expect = append(expect, int(e))
+			}
+		}
+		require.Equal(t, expect, tree.AvailableVersions())
+		versions, err := tree.AvailableVersionsFromDisk()
+		require.NoError(t, err)
+		require.Equal(t, expect, versions)
+	}
+	require.Len(t, calls, 6)
+	require.Equal(t, []int64{3, 4, 5, 6}, calls[5])
+
+	// Pruning errors are returned, but the version remains saved.
+	itree, err := tree.GetImmutable(4)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	tree.Set([]byte("key7"), []byte{7})
+	_, version, err := tree.SaveVersion()
+	require.Error(t, err)
+	require.EqualValues(t, 7, version)
+	require.Equal(t, []int{4, 5, 6, 7}, tree.AvailableVersions())
+	exporter.Close()
+
+	tree.SetVersionPruningHook(nil)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5, 6, 7, 8}, tree.AvailableVersions())
+}
+
+func TestMutableTree_VersionCeiling(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	tree.Set([]byte("gone"), []byte{0})
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		if i == 4 {
+			tree.Remove([]byte("gone"))
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	require.True(t, tree.IsFastCacheEnabled())
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{VersionCeiling: 3})
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, hashes[3], tree.Hash())
+	require.Equal(t, []int{1, 2, 3}, tree.AvailableVersions())
+	versions, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, versions)
+	latest, err := tree.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, latest)
+	count, err := tree.VersionCount()
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// Fast storage reflects version 5, so it must not be used.
+	require.False(t, tree.IsFastCacheEnabled())
+	require.Equal(t, []byte{3}, tree.Get([]byte("k")))
+	require.Equal(t, []byte{0}, tree.Get([]byte("gone")))
+	require.Nil(t, tree.Get([]byte{4}))
+	keys := []string{}
+	tree.Iterate(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.Equal(t, []string{"\x01", "\x02", "\x03", "gone", "k"}, keys)
+
+	require.False(t, tree.VersionExists(4))
+	_, err = tree.GetImmutable(4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Nil(t, tree.GetVersioned([]byte("k"), 5))
+	require.Equal(t, []byte{2}, tree.GetVersioned([]byte("k"), 2))
+	_, err = tree.LoadVersion(5)
+	require.Error(t, err)
+
+	// The tree is read-only.
+	tree.Set([]byte("k"), []byte{9})
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Error(t, tree.DeleteVersion(1))
+	require.True(t, tree.VersionExists(1))
+	require.Equal(t, errVersionCeiling, tree.Compact())
+
+	// The hidden versions are intact.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+	for version, hash := range hashes {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, itree.Hash())
+	}
+	require.True(t, tree.IsFastCacheEnabled())
+	require.Equal(t, []byte{5}, tree.Get([]byte("k")))
+	require.Nil(t, tree.Get([]byte("gone")))
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func TestMutableTree_DuplicateWrites(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{DetectDuplicateWritesPerVersion: true})
+	require.NoError(t, err)
+	require.Empty(t, tree.DuplicateWrites())
+
+	tree.Set([]byte("b"), []byte{1})
+	tree.Set([]byte("a"), []byte{1})
+	tree.Set([]byte("c"), []byte{1})
+	require.Empty(t, tree.DuplicateWrites())
+	tree.Set([]byte("c"), []byte{2})
+	tree.Set([]byte("b"), []byte{1})
+	tree.Set([]byte("b"), []byte{2})
+	require.Equal(t, [][]byte{[]byte("b"), []byte("c")}, tree.DuplicateWrites())
+
+	// Saving starts a new version, where single writes of the same keys are fine.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, tree.DuplicateWrites())
+	tree.Set([]byte("a"), []byte{2})
+	tree.Set([]byte("b"), []byte{3})
+	require.Empty(t, tree.DuplicateWrites())
+	tree.Set([]byte("a"), []byte{3})
+	require.Equal(t, [][]byte{[]byte("a")}, tree.DuplicateWrites())
+	tree.Rollback()
+	require.Empty(t, tree.DuplicateWrites())
+
+	// Detection is disabled by default.
+	tree, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	tree.Set([]byte("a"), []byte{2})
+	require.Nil(t, tree.DuplicateWrites())
+}
+
+func TestMutableTree_IterateVersions(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.NoError(t, tree.IterateVersions(func(version int64, rootHash []byte) bool {
+		t.Fatalf("unexpected version %d", version)
+		return false
+	}))
+
+	// Version 1 is empty, and version 5 is empty again.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 2; i <= 4; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, err = tree.RemoveRange(nil, nil)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersionTo(8)
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersion(3))
+
+	versions := []int64{}
+	err = tree.IterateVersions(func(version int64, rootHash []byte) bool {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, itree.Hash(), rootHash, "version %d", version)
+		versions = append(versions, version)
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 4, 5, 8}, versions)
+
+	versions = []int64{}
+	err = tree.IterateVersions(func(version int64, rootHash []byte) bool {
+		versions = append(versions, version)
+		return len(versions) == 2
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2}, versions)
+}
+
+func TestMutableTree_HistoryFingerprint(t *testing.T) {
+	build := func(values ...string) *MutableTree {
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		for i, value := range values {
+			if value == "" {
+				tree.Remove([]byte("key"))
+			} else {
+				tree.Set([]byte("key"), []byte(value))
+				tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte(value))
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+	fingerprint := func(tree *MutableTree) []byte {
+		fingerprint, err := tree.HistoryFingerprint()
+		require.NoError(t, err)
+		return fingerprint
+	}
+
+	tree := build("a", "b", "", "c")
+	require.Equal(t, fingerprint(tree), fingerprint(build("a", "b", "", "c")))
+
+	// Trees with different histories differ.
+	require.NotEqual(t, fingerprint(tree), fingerprint(build("x", "b", "", "c")))
+	require.NotEqual(t, fingerprint(tree), fingerprint(build("a", "b", "")))
+
+	// Deleting a version changes the fingerprint.
+	before := fingerprint(tree)
+	require.NoError(t, tree.DeleteVersion(2))
+	require.NotEqual(t, before, fingerprint(tree))
+	require.Equal(t, fingerprint(tree), fingerprint(tree))
+
+	empty, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Equal(t, sha256.New().Sum(nil), fingerprint(empty))
+}
+
+func dumpDB(t *testing.T, memDB db.DB) map[string]string {
+	itr, err := memDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+
+	entries := map[string]string{}
+	for ; itr.Valid(); itr.Next() {
+		entries[string(itr.Key())] = string(itr.Value())
+	}
+	require.NoError(t, itr.Error())
+	return entries
+}
+
+func TestMutableTree_VersionMetadata(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	plain, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	for v := int64(1); v <= 6; v++ {
+		tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		plain.Set([]byte{byte(v)}, []byte{byte(v)})
+		var hash []byte
+		if v == 3 {
+			hash, _, err = tree.SaveVersion()
+		} else {
+			hash, _, err = tree.SaveVersionWithMetadata([]byte(fmt.Sprintf("meta%d", v)))
+		}
+		require.NoError(t, err)
+		expectHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectHash, hash)
+	}
+
+	metadataVersions := func() []int64 {
+		var versions []int64
+		err := tree.ndb.traversePrefix(versionMetadataKeyFormat.Key(), func(k, v []byte) error {
+			var version int64
+			versionMetadataKeyFormat.Scan(k, &version)
+			versions = append(versions, version)
+			return nil
+		})
+		require.NoError(t, err)
+		return versions
+	}
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	meta, err := tree.GetVersionMetadata(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("meta2"), meta)
+	meta, err = tree.GetVersionMetadata(3)
+	require.NoError(t, err)
+	require.Nil(t, meta)
+	_, err = tree.GetVersionMetadata(7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Equal(t, []int64{1, 2, 4, 5, 6}, metadataVersions())
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NoError(t, tree.DeleteVersionsRange(2, 4))
+	_, err = tree.GetVersionMetadata(2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Equal(t, []int64{4, 5, 6}, metadataVersions())
+
+	_, err = tree.LoadVersionForOverwriting(4)
+	require.NoError(t, err)
+	require.Equal(t, []int64{4}, metadataVersions())
+	meta, err = tree.GetVersionMetadata(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("meta4"), meta)
+}
+
+func TestMutableTree_RandomizedRotations(t *testing.T) {
+	// The hashes were generated before rotations reused unpersisted nodes, and must not change.
+	expectHashes := []string{
+		"a4a7868bfefa47648b185fb89d651381ea1fe2e6cdefdd3453e55e6fea4430c9",
+		"78a2698c595ad8bebc99c74ae1022da1487316f83cd5dc05129fefe788590c71",
+		"38dd70de71f87aa8b0b25681c1eb23f1079f97cb6dd8d6d76e3d507c803fe22c",
+		"c0774f6bcbca788b46f1e1bdff4cab57fe171f00ae2268dfe16c7ffb0b31c8f3",
+		"19988db80d4452c3c3ad4ccde824773d28e0e4c0e0149aecd175df74c4fbbdff",
+		"58c3390ba02b86e771e2ac45a271f16a2fb5f639ae75167fecf143c7df2a9be3",
+		"a26951b3095cd2c4acd80ec9db8df54894832fd1e59308a539ca3e7116e71c39",
+		"047b252e627014531ecc6239e2234b9fa241601b5e13188afb65b4a85e9485ba",
+		"aa7b76094fae5f6f0c0bcdfe975fd42fdfe103a6f2e9797b4fd45a25adaf4a8b",
+		"1e4749cc05a8d4c1de527d566bd971f96d5bec09c70ee01d15eb82afd7a2bd30",
+	}
+
+	r := rand.New(rand.NewSource(1562))
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hashes := []string{}
+	for version := 0; version < 10; version++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%04d", r.Intn(500)))
+			if r.Intn(3) == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, []byte(fmt.Sprintf("%d-%d", version, i)))
+			}
+			// Hashing the working tree caches the hashes of unpersisted nodes, which must be
+			// reset when they are modified.
+			if r.Intn(10) == 0 {
+				tree.WorkingHash()
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+	require.Equal(t, expectHashes, hashes)
+}
+
+func BenchmarkMutableTree_SetRemove(b *testing.B) {
+	for _, saved := range []bool{false, true} {
+		b.Run(fmt.Sprintf("saved=%v", saved), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1562))
+			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(b, err)
+			for i := 0; i < 100000; i++ {
+				tree.Set([]byte(fmt.Sprintf("%08d", r.Intn(200000))), []byte{})
+			}
+			if saved {
+				_, _, err = tree.SaveVersion()
+				require.NoError(b, err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				key := []byte(fmt.Sprintf("%08d", r.Intn(200000)))
+				if i%2 == 0 {
+					tree.Set(key, []byte{})
+				} else {
+					tree.Remove(key)
+				}
+			}
+		})
+	}
+}
+
+func TestMutableTree_HintOrphanCapacity(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+
+	tree.HintOrphanCapacity(1000)
+	require.Equal(t, 1000, tree.orphanCapacity)
+	// The maps are already sized, so further hints up to that size don't reallocate them.
+	require.Zero(t, testing.AllocsPerRun(10, func() {
+		tree.HintOrphanCapacity(1000)
+		tree.HintOrphanCapacity(10)
+	}))
+
+	// Saving replaces the maps, so the hint applies again.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Zero(t, tree.orphanCapacity)
+	tree.HintOrphanCapacity(10)
+	require.Equal(t, 10, tree.orphanCapacity)
+}
+
+func BenchmarkMutableTree_HintOrphanCapacity(b *testing.B) {
+	const size, removals = 100000, 20000
+	for _, hint := range []bool{false, true} {
+		b.Run(fmt.Sprintf("hint=%v", hint), func(b *testing.B) {
+			tree, err := NewMutableTree(db.NewMemDB(), 2*size)
+			require.NoError(b, err)
+			for i := 0; i < size; i++ {
+				tree.Set([]byte(fmt.Sprintf("%08d", i)), []byte{})
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(b, err)
+			keys := make([][]byte, removals)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("%08d", i*size/removals))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if hint {
+					tree.HintOrphanCapacity(removals)
+				}
+				for _, key := range keys {
+					tree.Remove(key)
+				}
+				b.StopTimer()
+				tree.Rollback()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestMutableTree_MaxCommitBatchEntries(t *testing.T) {
+	batch := newBatch(db.NewMemDB(), Options{MaxCommitBatchEntries: 3})
+	for i := 0; i < 7; i++ {
+		require.NoError(t, batch.Set([]byte{byte(i)}, []byte{byte(i)}))
+	}
+	require.Len(t, batch.(*splitBatch).batches, 3)
+	require.NoError(t, batch.Close())
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{MaxCommitBatchEntries: 10})
+	require.NoError(t, err)
+	reference, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for version := 0; version < 3; version++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%03d", (i*7+version)%150))
+			tree.Set(key, []byte{byte(version)})
+			reference.Set(key, []byte{byte(version)})
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expected, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expected, hash)
+	}
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, reference.Hash(), tree.Hash())
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func BenchmarkMutableTree_MaxCommitBatchEntries(b *testing.B) {
+	const size = 50000
+	for _, maxEntries := range []int{0, 1000, 10000} {
+		b.Run(fmt.Sprintf("max=%d", maxEntries), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench-iavl-batch")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			levelDB, err := db.NewGoLevelDB("bench", dir)
+			require.NoError(b, err)
+			defer levelDB.Close()
+			tree, err := NewMutableTreeWithOpts(levelDB, 0, &Options{MaxCommitBatchEntries: maxEntries})
+			require.NoError(b, err)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < size; j++ {
+					tree.Set(randBytes(16), randBytes(32))
+				}
+				b.StartTimer()
+				_, _, err := tree.SaveVersion()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestMutableTree_SetWithPrevious(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	previous, updated := tree.SetWithPrevious([]byte("a"), []byte("1"))
+	require.False(t, updated)
+	require.Nil(t, previous)
+	previous, updated = tree.SetWithPrevious([]byte("b"), []byte("2"))
+	require.False(t, updated)
+	require.Nil(t, previous)
+
+	previous, updated = tree.SetWithPrevious([]byte("a"), []byte("3"))
+	require.True(t, updated)
+	require.Equal(t, []byte("1"), previous)
+
+	// Setting an unchanged value is still an update.
+	previous, updated = tree.SetWithPrevious([]byte("b"), []byte("2"))
+	require.True(t, updated)
+	require.Equal(t, []byte("2"), previous)
+
+	// Previous values are also returned for keys loaded from disk.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	previous, updated = tree.SetWithPrevious([]byte("a"), []byte("4"))
+	require.True(t, updated)
+	require.Equal(t, []byte("3"), previous)
+	previous, updated = tree.SetWithPrevious([]byte("c"), []byte("5"))
+	require.False(t, updated)
+	require.Nil(t, previous)
+	require.Equal(t, []byte("4"), tree.Get([]byte("a")))
+
+	require.Panics(t, func() { tree.SetWithPrevious([]byte("a"), nil) })
+}
+
+func TestNewInMemoryTree(t *testing.T) {
+	tree, err := NewInMemoryTree(100, nil)
+	require.NoError(t, err)
+	memDB, ok := tree.ndb.db.(*db.MemDB)
+	require.True(t, ok)
+
+	for v := 1; v <= 5; v++ {
+		tree.Set([]byte("key"), []byte{byte(v)})
+		tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsRange(1, 3))
+	require.Equal(t, []int{3, 4, 5}, tree.AvailableVersions())
+	require.Equal(t, []byte{4}, tree.GetVersioned([]byte("key"), 4))
+
+	_, err = tree.LoadVersion(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, tree.Get([]byte("key")))
+	require.Nil(t, tree.Get([]byte{5}))
+
+	// Closing the tree releases its database.
+	released := make(chan struct{})
+	runtime.SetFinalizer(memDB, func(*db.MemDB) { close(released) })
+	memDB = nil
+	require.NoError(t, tree.Close())
+	defer runtime.KeepAlive(tree)
+	entries, _, _ := tree.CacheUtilization()
+	require.Zero(t, entries)
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-released:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("database was not released")
+}
+
+func TestMutableTree_IterateOrphans(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	type orphan struct {
+		hash     string
+		from, to int64
+	}
+	orphans := func(version int64) []orphan {
+		result := []orphan{}
+		err := tree.IterateOrphans(version, func(hash []byte, from, to int64) bool {
+			result = append(result, orphan{hex.EncodeToString(hash), from, to})
+			return false
+		})
+		require.NoError(t, err)
+		sort.Slice(result, func(i, j int) bool { return result[i].hash < result[j].hash })
+		return result
+	}
+	nodeHash := func(version int64, key string) string {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		if key == "" {
+			return hex.EncodeToString(itree.root.hash)
+		}
+		var hash []byte
+		itree.root.traverse(itree, true, func(node *Node) bool {
+			if node.isLeaf() && string(node.key) == key {
+				hash = node.hash
+			}
+			return false
+		})
+		require.NotNil(t, hash)
+		return hex.EncodeToString(hash)
+	}
+	expect := func(orphans ...orphan) []orphan {
+		sort.Slice(orphans, func(i, j int) bool { return orphans[i].hash < orphans[j].hash })
+		return orphans
+	}
+
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("1"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("c"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("3"))
+	tree.Remove([]byte("c"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Adding c only replaces the root, since the existing leaves are reused.
+	require.Equal(t, expect(orphan{nodeHash(1, ""), 1, 1}), orphans(1))
+	// Updating a and removing c replaces all nodes except the leaf b.
+	root2, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	expected := []orphan{
+		{nodeHash(2, ""), 2, 2},
+		{nodeHash(2, "a"), 1, 2},
+		{nodeHash(2, "c"), 2, 2},
+	}
+	root2.root.traverse(root2, true, func(node *Node) bool {
+		if !node.isLeaf() && node != root2.root {
+			expected = append(expected, orphan{hex.EncodeToString(node.hash), 2, 2})
+		}
+		return false
+	})
+	require.Equal(t, expect(expected...), orphans(2))
+	require.Empty(t, orphans(3))
+
+	count := 0
+	require.NoError(t, tree.IterateOrphans(2, func([]byte, int64, int64) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 1, count)
+
+	// Deleting version 2 extends the lifetime of orphans from version 1 to it.
+	require.NoError(t, tree.DeleteVersion(2))
+	require.Empty(t, orphans(2))
+	require.Equal(t, expect(orphan{nodeHash(1, ""), 1, 1}, orphan{nodeHash(1, "a"), 1, 1}), orphans(1))
+}
+
+// nodeReadCountingDB counts the nodes read from the database.
+type nodeReadCountingDB struct {
+	db.DB
+	reads int64
+}
+
+func (c *nodeReadCountingDB) Get(key []byte) ([]byte, error) {
+	if len(key) > 0 && key[0] == nodeKeyFormat.Prefix()[0] {
+		atomic.AddInt64(&c.reads, 1)
+	}
+	return c.DB.Get(key)
+}
+
+func TestMutableTree_WarmVersions(t *testing.T) {
+	countingDB := &nodeReadCountingDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTree(countingDB, 0)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 100; i++ {
+			tree.Set([]byte(fmt.Sprintf("%03d", (v*37+i)%300)), []byte{byte(v)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	tree, err = NewMutableTree(countingDB, 90)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.WarmVersions([]int64{1, 6}, 2), ErrVersionDoesNotExist)
+
+	// Each version gets a third of the cache, which holds the top 4 levels.
+	versions := []int64{1, 2, 3}
+	require.NoError(t, tree.WarmVersions(versions, 2))
+	entries, capacity, _ := tree.CacheUtilization()
+	require.LessOrEqual(t, entries, capacity)
+
+	atomic.StoreInt64(&countingDB.reads, 0)
+	for _, version := range versions {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		nodes := []*Node{itree.root}
+		for depth := 1; depth < 4; depth++ {
+			children := []*Node{}
+			for _, node := range nodes {
+				children = append(children, node.getLeftNode(itree), node.getRightNode(itree))
+			}
+			nodes = children
+		}
+	}
+	require.Zero(t, atomic.LoadInt64(&countingDB.reads))
+
+	// Unwarmed versions are read from the database.
+	_, err = tree.GetImmutable(4)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt64(&countingDB.reads))
+}
+
+func TestMutableTree_ExternalValueThreshold(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{ExternalValueThreshold: 16}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	plain, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	value := func(version, i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("small-%d-%d", version, i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("large-%d-%d", version, i)), 10)
+	}
+	for version := 1; version <= 3; version++ {
+		for i := version; i < 20; i++ {
+			tree.Set([]byte{byte(i)}, value(version, i))
+			plain.Set([]byte{byte(i)}, value(version, i))
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectHash, hash)
+	}
+
+	externalValues := func() int {
+		count := 0
+		err := tree.ndb.traversePrefix(externalValueKeyFormat.Key(), func(k, v []byte) error {
+			require.Greater(t, len(v), 16)
+			count++
+			return nil
+		})
+		require.NoError(t, err)
+		return count
+	}
+	// Large values are odd keys 1-19, rewritten in each version from 1, 2 and 3 onwards.
+	require.Equal(t, 10+9+9, externalValues())
+	err = tree.ndb.traversePrefix(nodeKeyFormat.Key(), func(k, v []byte) error {
+		require.NotContains(t, string(v), "large")
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Values are loaded transparently, also when reading nodes from disk.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for version := 1; version <= 3; version++ {
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			expect := []byte(nil)
+			for v := version; v >= 1; v-- {
+				if i >= v {
+					expect = value(v, i)
+					break
+				}
+			}
+			require.Equal(t, expect, itree.Get([]byte{byte(i)}), "version %d key %d", version, i)
+		}
+	}
+	_, proof, err := tree.GetVersionedWithProof([]byte{3}, 2)
+	require.NoError(t, err)
+	hash2, err := tree.ndb.getRoot(2)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(hash2))
+	require.NoError(t, proof.VerifyItem([]byte{3}, value(2, 3)))
+
+	// External values are deleted along with their nodes.
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Equal(t, 9+9+1, externalValues())
+	require.NoError(t, tree.DeleteVersion(2))
+	require.Equal(t, 9+1, externalValues())
+}
+
+func TestMutableTree_AvailableVersionsFromDisk(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	versions, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	for v := 1; v <= 6; v++ {
+		tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(2))
+	require.NoError(t, tree.DeleteVersionsRange(4, 6))
+	expect := []int{1, 3, 6}
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, expect, versions)
+	require.Equal(t, expect, tree.AvailableVersions())
+
+	// A full load agrees with the database.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(3)
+	require.NoError(t, err)
+	require.Equal(t, expect, tree.AvailableVersions())
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, expect, versions)
+
+	// A lazy load only knows the loaded version, but the database is authoritative.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LazyLoadVersion(3)
+	require.NoError(t, err)
+	require.Equal(t, []int{3}, tree.AvailableVersions())
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, expect, versions)
+}
+
+func TestMutableTree_RemoveIfPresent(t *testing.T) {
+	r := rand.New(rand.NewSource(1573))
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	expect, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	value, removed := tree.RemoveIfPresent([]byte("a"))
+	require.False(t, removed)
+	require.Nil(t, value)
+
+	for version := 0; version < 5; version++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("%04d", r.Intn(500)))
+			if r.Intn(2) == 0 {
+				tree.Set(key, key)
+				expect.Set(key, key)
+				continue
+			}
+			expectValue, expectRemoved := expect.Remove(key)
+			value, removed := tree.RemoveIfPresent(key)
+			require.Equal(t, expectRemoved, removed)
+			require.Equal(t, expectValue, value)
+		}
+		require.Equal(t, expect.WorkingHash(), tree.WorkingHash())
+		require.Equal(t, expect.orphans, tree.orphans)
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = expect.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func BenchmarkMutableTree_RemoveMiss(b *testing.B) {
+	tree, err := NewMutableTree(db.NewMemDB(), 200000)
+	require.NoError(b, err)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("%08d", 2*i)), []byte{})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+
+	// Only odd keys are absent, so all removes are misses.
+	r := rand.New(rand.NewSource(1573))
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%08d", 2*r.Intn(100000)+1))
+	}
+
+	for _, name := range []string{"Remove", "RemoveIfPresent"} {
+		b.Run(name, func(b *testing.B) {
+			remove := tree.Remove
+			if name == "RemoveIfPresent" {
+				remove = tree.RemoveIfPresent
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, removed := remove(keys[i%len(keys)]); removed {
+					b.Fatal("unexpected remove")
+				}
+			}
+		})
+	}
+}
+
+func TestMutableTree_RollbackToVersion(t *testing.T) {
+	r := rand.New(rand.NewSource(1574))
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	hashes := map[int64][]byte{}
+	for version := int64(1); version <= 5; version++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("%03d", r.Intn(100)))
+			if r.Intn(3) == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, []byte(fmt.Sprintf("%d", version)))
+			}
+		}
+		hashes[version], _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	expect, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	tree.Set([]byte("unsaved"), []byte("unsaved"))
+
+	require.Error(t, tree.RollbackToVersion(6))
+	require.NoError(t, tree.DeleteVersion(2))
+	require.Equal(t, ErrVersionDoesNotExist, tree.RollbackToVersion(2))
+
+	require.NoError(t, tree.RollbackToVersion(3))
+	require.EqualValues(t, 3, tree.Version())
+	require.Equal(t, hashes[3], tree.WorkingHash())
+	require.Equal(t, []int{1, 3}, tree.AvailableVersions())
+	require.False(t, tree.VersionExists(4))
+	require.False(t, tree.Has([]byte("unsaved")))
+
+	// The working tree, including its fast index, matches the target version.
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		require.Equal(t, expect.Get(key), tree.Get(key))
+	}
+
+	// Rolling back to the latest version only discards unsaved changes.
+	tree.Set([]byte("unsaved"), []byte("unsaved"))
+	require.NoError(t, tree.RollbackToVersion(3))
+	require.Equal(t, hashes[3], tree.WorkingHash())
+
+	// New versions can be saved on top, and the result survives a reload.
+	tree.Set([]byte("new"), []byte("new"))
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+	require.NotEqual(t, hashes[4], hash)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+	require.Equal(t, hash, tree.Hash())
+	require.Equal(t, []int{1, 3, 4}, tree.AvailableVersions())
+	require.False(t, tree.IsUpgradeable())
+	require.Equal(t, []byte("new"), tree.Get([]byte("new")))
+}
+
+func TestMutableTree_VersionCountAndRange(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	requireVersions := func(count int, first, last int64) {
+		t.Helper()
+		actualCount, err := tree.VersionCount()
+		require.NoError(t, err)
+		require.Equal(t, count, actualCount)
+		actualFirst, actualLast, err := tree.VersionRange()
+		require.NoError(t, err)
+		require.Equal(t, first, actualFirst)
+		require.Equal(t, last, actualLast)
+	}
+	requireVersions(0, 0, 0)
+
+	for _, version := range []int64{3, 4, 10, 17, 20} {
+		tree.Set([]byte(fmt.Sprintf("k%d", version)), []byte{1})
+		_, _, err = tree.SaveVersionTo(version)
+		require.NoError(t, err)
+	}
+	requireVersions(5, 3, 20)
+
+	require.NoError(t, tree.DeleteVersion(3))
+	require.NoError(t, tree.DeleteVersion(10))
+	requireVersions(3, 4, 20)
+
+	// The versions are read from the database, even after a lazy load.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LazyLoadVersion(17)
+	require.NoError(t, err)
+	require.Equal(t, []int{17}, tree.AvailableVersions())
+	requireVersions(3, 4, 20)
+
+	// Database errors are returned.
+	tree.ndb.db = &iteratorErrorDB{DB: memDB}
+	_, err = tree.VersionCount()
+	require.Error(t, err)
+	_, _, err = tree.VersionRange()
+	require.Error(t, err)
+}
+
+// iteratorErrorDB fails to create iterators.
+type iteratorErrorDB struct {
+	db.DB
+}
+
+func (d *iteratorErrorDB) Iterator(start, end []byte) (db.Iterator, error) {
+	return nil, errors.New("iterator failure")
+}
+
+func (d *iteratorErrorDB) ReverseIterator(start, end []byte) (db.Iterator, error) {
+	return nil, errors.New("iterator failure")
+}
+
+func TestMutableTree_CopyTo(t *testing.T) {
+	r := rand.New(rand.NewSource(1578))
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	hashes := map[int64][]byte{}
+	for version := int64(1); version <= 6; version++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%05d", r.Intn(5000)))
+			if r.Intn(4) == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, []byte(fmt.Sprintf("%d", version)))
+			}
+		}
+		hashes[version], _, err = tree.SaveVersionWithMetadata([]byte{byte(version)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(2))
+	delete(hashes, 2)
+	tree.Set([]byte("unsaved"), []byte{1})
+
+	dst := db.NewMemDB()
+	require.NoError(t, tree.CopyTo(dst))
+	require.Equal(t, dumpDB(t, memDB), dumpDB(t, dst))
+	require.Error(t, tree.CopyTo(dst))
+
+	copied, err := NewMutableTree(dst, 0)
+	require.NoError(t, err)
+	version, err := copied.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 6, version)
+	require.Equal(t, tree.AvailableVersions(), copied.AvailableVersions())
+	require.False(t, copied.Has([]byte("unsaved")))
+	for version, hash := range hashes {
+		itree, err := copied.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, itree.Hash())
+		metadata, err := copied.GetVersionMetadata(version)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(version)}, metadata)
+	}
+
+	// The copy is independent of the source.
+	require.NoError(t, copied.DeleteVersion(1))
+	require.True(t, tree.VersionExists(1))
+}
+
+type logEntry struct {
+	msg string
+	kv  []interface{}
+}
+
+type recordingLogger struct {
+	entries []logEntry
+}
+
+func (l *recordingLogger) Debug(msg string, kv ...interface{}) {
+	l.entries = append(l.entries, logEntry{msg, kv})
+}
+
+func TestMutableTree_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Logger: logger})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Remove([]byte("a"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersion(1))
+
+	require.Equal(t, []logEntry{
+		{"enabling fast storage, might take a while", []interface{}{"version", int64(0)}},
+		{"fast storage is enabled", nil},
+		{"saving tree", []interface{}{"version", int64(1)}},
+		{"saving empty tree", []interface{}{"version", int64(2)}},
+		{"deleting version", []interface{}{"version", int64(1)}},
+	}, logger.entries)
+}
+
+func TestMutableTree_SaveVersionDetailed(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte{1})
+	hash, version, wasNewCommit, err := tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.True(t, wasNewCommit)
+	require.EqualValues(t, 1, version)
+	tree.Set([]byte("b"), []byte{2})
+	hash2, _, wasNewCommit, err := tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.True(t, wasNewCommit)
+
+	// Re-saving version 2 with the same contents is a no-op, while different contents fail.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	tree.Set([]byte("b"), []byte{2})
+	before := dumpDB(t, memDB)
+	resaved, version, wasNewCommit, err := tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.False(t, wasNewCommit)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, hash2, resaved)
+	require.Equal(t, before, dumpDB(t, memDB))
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	tree.Set([]byte("b"), []byte{3})
+	_, _, wasNewCommit, err = tree.SaveVersionDetailed()
+	require.Error(t, err)
+	require.False(t, wasNewCommit)
+}
+
+func TestMutableTree_VerifyFastStorage(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.VerifyFastStorage()
+	require.Error(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte{3}, []byte{33})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	mismatches, err = tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	setFastNode := func(key, value []byte, version int64) {
+		var buf bytes.Buffer
+		require.NoError(t, NewFastNode(key, value, version).writeBytes(&buf))
+		require.NoError(t, memDB.Set(tree.ndb.fastNodeKey(key), buf.Bytes()))
+	}
+	require.NoError(t, memDB.Delete(tree.ndb.fastNodeKey([]byte{0})))
+	setFastNode([]byte{2}, []byte{22}, 1)
+	setFastNode([]byte{3}, []byte{33}, 1)
+	setFastNode([]byte{4, 0}, []byte{40}, 2)
+	setFastNode([]byte{20}, []byte{20}, 2)
+
+	mismatches, err = tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Equal(t, []FastNodeMismatch{
+		{Kind: FastNodeMissing, Key: []byte{0}, TreeValue: []byte{0}, TreeVersion: 1},
+		{Kind: FastNodeValueMismatch, Key: []byte{2}, TreeValue: []byte{2}, TreeVersion: 1, FastValue: []byte{22}, FastVersion: 1},
+		{Kind: FastNodeVersionMismatch, Key: []byte{3}, TreeValue: []byte{33}, TreeVersion: 2, FastValue: []byte{33}, FastVersion: 1},
+		{Kind: FastNodeExtra, Key: []byte{4, 0}, FastValue: []byte{40}, FastVersion: 2},
+		{Kind: FastNodeExtra, Key: []byte{20}, FastValue: []byte{20}, FastVersion: 2},
+	}, mismatches)
+}
+
+func TestMutableTree_RepairFastStorage(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	repaired, err := tree.RepairFastStorage()
+	require.NoError(t, err)
+	require.False(t, repaired)
+
+	// Keep the fast nodes of version 1, to simulate a torn write of those of version 2.
+	fastNodes := map[string][]byte{}
+	itr, err := memDB.Iterator(fastKeyFormat.Key(), fastKeyFormat.Key([]byte{0xff}))
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		fastNodes[string(itr.Key())] = itr.Value()
+	}
+	require.NoError(t, itr.Close())
+	require.Len(t, fastNodes, 10)
+
+	tree.Set([]byte{3}, []byte{33})
+	tree.Set([]byte{20}, []byte{20})
+	_, removed := tree.Remove([]byte{5})
+	require.True(t, removed)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, key := range [][]byte{{3}, {5}, {20}} {
+		require.NoError(t, memDB.Delete(tree.ndb.fastNodeKey(key)))
+	}
+	for key, value := range fastNodes {
+		require.NoError(t, memDB.Set([]byte(key), value))
+	}
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.True(t, tree.IsFastCacheEnabled())
+	require.Equal(t, []byte{3}, tree.Get([]byte{3}))
+	require.Equal(t, []byte{5}, tree.Get([]byte{5}))
+	require.Nil(t, tree.Get([]byte{20}))
+
+	repaired, err = tree.RepairFastStorage()
+	require.NoError(t, err)
+	require.True(t, repaired)
+	require.Equal(t, []byte{33}, tree.Get([]byte{3}))
+	require.Nil(t, tree.Get([]byte{5}))
+	require.Equal(t, []byte{20}, tree.Get([]byte{20}))
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+	repaired, err = tree.RepairFastStorage()
+	require.NoError(t, err)
+	require.False(t, repaired)
+
+	// Fast storage last updated at an older version is rebuilt as well.
+	tree.ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + "1"
+	repaired, err = tree.RepairFastStorage()
+	require.NoError(t, err)
+	require.True(t, repaired)
+	require.False(t, tree.ndb.shouldForceFastStorageUpgrade())
+	require.Equal(t, []byte{33}, tree.Get([]byte{3}))
+}
+
+func TestMutableTree_LazyLoadVersions(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for version := int64(1); version <= 5; version++ {
+		tree.Set([]byte{byte(version)}, []byte{byte(version)})
+		hashes[version], _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	require.Error(t, tree.LazyLoadVersions(nil))
+	require.ErrorIs(t, tree.LazyLoadVersions([]int64{2, 6}), ErrVersionDoesNotExist)
+
+	require.NoError(t, tree.LazyLoadVersions([]int64{4, 2}))
+	require.EqualValues(t, 4, tree.Version())
+	require.Equal(t, hashes[4], tree.Hash())
+	require.Equal(t, []int{2, 4}, tree.AvailableVersions())
+	for _, version := range []int64{2, 4} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], itree.Hash())
+	}
+
+	// Other versions are looked up in the database.
+	require.True(t, tree.VersionExists(5))
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	require.Equal(t, hashes[3], itree.Hash())
+	require.Equal(t, []byte{1}, tree.GetVersioned([]byte{1}, 1))
+	require.Equal(t, []int{1, 2, 3, 4, 5}, tree.AvailableVersions())
+}
+
+func TestMutableTree_SyncVersions(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for version := int64(1); version <= 6; version++ {
+		tree.Set([]byte{byte(version)}, []byte{byte(version)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(2))
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.LazyLoadVersion(4)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+	require.Equal(t, []int{4}, tree.AvailableVersions())
+	root := tree.root
+
+	require.NoError(t, tree.SyncVersions())
+	require.Equal(t, []int{1, 3, 4, 5, 6}, tree.AvailableVersions())
+	fromDisk, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, fromDisk, tree.AvailableVersions())
+	require.True(t, tree.VersionExists(6))
+	require.False(t, tree.VersionExists(2))
+	require.False(t, tree.VersionExists(7))
+	require.Same(t, root, tree.root)
+	require.EqualValues(t, 4, tree.Version())
+}
+
+func TestMutableTree_GetCopy(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Nil(t, tree.GetCopy([]byte("a")))
+
+	tree.Set([]byte("a"), []byte("value"))
+	tree.Set([]byte("b"), []byte{})
+	value := tree.GetCopy([]byte("a"))
+	value[0] = 'X'
+	require.Equal(t, []byte("value"), tree.Get([]byte("a")))
+	require.Equal(t, []byte{}, tree.GetCopy([]byte("b")))
+	require.Nil(t, tree.GetCopy([]byte("c")))
+
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	value = tree.GetCopy([]byte("a"))
+	value[0] = 'X'
+	require.Equal(t, []byte("value"), tree.Get([]byte("a")))
+
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	value = itree.GetCopy([]byte("a"))
+	require.Equal(t, []byte("value"), value)
+	value[0] = 'X'
+	require.Equal(t, []byte("value"), itree.Get([]byte("a")))
+	require.Equal(t, []byte("value"), itree.GetCopy([]byte("a")))
+	require.Nil(t, itree.GetCopy([]byte("c")))
+}
+
+func TestMutableTree_PruneVersions(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	// Keep the last 3 versions and every 5th version, pruning after each save.
+	for version := 1; version <= 12; version++ {
+		tree.Set([]byte(fmt.Sprintf("k%d", version%4)), []byte(fmt.Sprintf("v%d", version)))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.NoError(t, tree.pruneVersions(3, 5))
+	}
+	versions, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 11, 12}, versions)
+	require.Equal(t, versions, tree.AvailableVersions())
+
+	// The latest version is always kept, and the remaining versions are readable.
+	require.NoError(t, tree.pruneVersions(0, 0))
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, []int{12}, versions)
+	require.Equal(t, []byte("v12"), tree.GetVersioned([]byte("k0"), 12))
+
+	// Versions with active readers are not pruned.
+	for version := 13; version <= 15; version++ {
+		tree.Set([]byte("k"), []byte(fmt.Sprintf("v%d", version)))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(13)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	require.Error(t, tree.pruneVersions(1, 0))
+	exporter.Close()
+	require.NoError(t, tree.pruneVersions(1, 0))
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, []int{15}, versions)
+}
+
+func TestMutableTree_StartPruning(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	tree.SetPruningErrorHandler(func(err error) {
+		t.Errorf("unexpected pruning error: %v", err)
+	})
+	stop := tree.StartPruning(2, 4, time.Millisecond)
+	for version := 1; version <= 20; version++ {
+		tree.Set([]byte(fmt.Sprintf("k%d", version%5)), []byte(fmt.Sprintf("v%d", version)))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		versions, err := tree.AvailableVersionsFromDisk()
+		return err == nil && len(versions) == 6
+	}, 5*time.Second, time.Millisecond)
+	stop()
+	stop()
+
+	expected := []int{4, 8, 12, 16, 19, 20}
+	versions, err := tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, expected, versions)
+	require.Equal(t, expected, tree.AvailableVersions())
+
+	// Nothing is pruned after the worker is stopped.
+	for version := 21; version <= 23; version++ {
+		tree.Set([]byte("k"), []byte(fmt.Sprintf("v%d", version)))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	versions, err = tree.AvailableVersionsFromDisk()
+	require.NoError(t, err)
+	require.Equal(t, append(expected, 21, 22, 23), versions)
+
+	// Errors are passed to the error handler, e.g. when a version has active readers.
+	itree, err := tree.GetImmutable(21)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	errs := make(chan error, 1)
+	tree.SetPruningErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	stop = tree.StartPruning(1, 0, time.Millisecond)
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "pruning error was not reported")
+	}
+	stop()
+	exporter.Close()
+	require.True(t, tree.VersionExists(21))
+}
+
+// faultyDB fails the given number of batch writes after skipping the given number of writes,
+// before passing them through.
+type faultyDB struct {
+	db.DB
+	skip     int
+	failures int
+}
+
+func (d *faultyDB) NewBatch() db.Batch {
+	return &faultyBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type faultyBatch struct {
+	db.Batch
+	db *faultyDB
+}
+
+func (b *faultyBatch) Write() error {
+	if b.db.skip > 0 {
+		b.db.skip--
+		return b.Batch.Write()
+	}
+	if b.db.failures > 0 {
+		b.db.failures--
+		return errors.New("transient write failure")
+	}
+	return b.Batch.Write()
+}
+
+func (b *faultyBatch) WriteSync() error {
+	return b.Write()
+}
+
+func TestMutableTree_CommitRetry(t *testing.T) {
+	setVersion := func(tree *MutableTree, version int) {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%02d", (i*3+version)%30)), []byte(fmt.Sprintf("v%d", version)))
+		}
+	}
+	expect, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hashes := [][]byte{}
+	for version := 1; version <= 3; version++ {
+		setVersion(expect, version)
+		hash, _, err := expect.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	// A failed commit is retried.
+	faulty := &faultyDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTreeWithOpts(faulty, 0, &Options{CommitRetry: CommitRetryOptions{Attempts: 3, Backoff: time.Millisecond}})
+	require.NoError(t, err)
+	for version := 1; version <= 3; version++ {
+		setVersion(tree, version)
+		faulty.failures = 2
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, hashes[version-1], hash)
+	}
+
+	// Without retries, the save fails, and the tree is rolled back so that the save can be retried.
+	// This includes the first version, whose nodes are flushed while they are saved.
+	faulty = &faultyDB{DB: db.NewMemDB()}
+	tree, err = NewMutableTree(faulty, 0)
+	require.NoError(t, err)
+	for version := 1; version <= 3; version++ {
+		setVersion(tree, version)
+		workingHash := tree.WorkingHash()
+		if version == 1 {
+			// Fail after some of the nodes have been flushed.
+			faulty.skip = 5
+		}
+		faulty.failures = 1
+		_, _, err := tree.SaveVersion()
+		require.Error(t, err)
+		require.Equal(t, int64(version-1), tree.Version())
+		require.Equal(t, workingHash, tree.WorkingHash())
+		require.Equal(t, []byte(fmt.Sprintf("v%d", version)), tree.Get([]byte(fmt.Sprintf("k%02d", version))))
+
+		hash, savedVersion, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, int64(version), savedVersion)
+		require.Equal(t, hashes[version-1], hash)
+	}
+
+	// The retried saves are persisted.
+	tree, err = NewMutableTree(faulty.DB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, hashes[2], tree.Hash())
+	itree, err := expect.GetImmutable(2)
+	require.NoError(t, err)
+	loaded, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	equal, diffKey := loaded.StructuralEqual(itree)
+	require.True(t, equal, "differs at %q", diffKey)
+	mismatches, err := tree.VerifyFastStorage()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func TestMutableTree_OnNodePersisted(t *testing.T) {
+	persisted := map[string][]byte{}
+	var fail error
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{OnNodePersisted: func(hash, encoded []byte) error {
+		if fail != nil {
+			return fail
+		}
+		persisted[string(hash)] = encoded
+		return nil
+	}})
+	require.NoError(t, err)
+
+	// Each new node of a version is reported once, with the bytes stored in the database.
+	requirePersisted := func(version int64) {
+		nodes, err := tree.ndb.nodes()
+		require.NoError(t, err)
+		count := 0
+		for _, node := range nodes {
+			if node.version == version {
+				count++
+				stored, err := memDB.Get(tree.ndb.nodeKey(node.hash))
+				require.NoError(t, err)
+				require.Equal(t, stored, persisted[string(node.hash)])
+			}
+		}
+		require.Positive(t, count)
+		require.Len(t, persisted, count)
+	}
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	requirePersisted(1)
+
+	persisted = map[string][]byte{}
+	tree.Set([]byte{3}, []byte{33})
+	tree.Set([]byte{30}, []byte{30})
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	requirePersisted(2)
+
+	// A callback error aborts the save, which can then be retried.
+	persisted = map[string][]byte{}
+	tree.Set([]byte{4}, []byte{44})
+	workingHash := tree.WorkingHash()
+	fail = errors.New("backup unavailable")
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "backup unavailable")
+	require.EqualValues(t, 2, tree.Version())
+	require.Equal(t, workingHash, tree.WorkingHash())
+	fail = nil
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	requirePersisted(3)
+
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	require.Equal(t, hash, itree.Hash())
+
+	// Write errors while the nodes of the first version are flushed also abort the save.
+	faulty := &faultyDB{DB: db.NewMemDB(), failures: 1}
+	tree, err = NewMutableTree(faulty, 0)
+	require.NoError(t, err)
+	tree.Set([]byte{1}, []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "transient write failure")
+}
+
+func TestMutableTree_PendingChanges(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	keys := func(keys ...string) [][]byte {
+		bzs := [][]byte{}
+		for _, key := range keys {
+			bzs = append(bzs, []byte(key))
+		}
+		return bzs
+	}
+
+	added, removed := tree.PendingChanges()
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	tree.Set([]byte("c"), []byte("1"))
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("1"))
+	tree.Set([]byte("a"), []byte("2"))
+	added, removed = tree.PendingChanges()
+	require.Equal(t, keys("a", "b", "c"), added)
+	require.Empty(t, removed)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	added, removed = tree.PendingChanges()
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	// Updates are additions, and a key set and then removed is only removed, and vice versa.
+	tree.Set([]byte("b"), []byte("2"))
+	tree.Set([]byte("d"), []byte("1"))
+	tree.Remove([]byte("d"))
+	tree.Remove([]byte("c"))
+	tree.Remove([]byte("a"))
+	tree.Set([]byte("a"), []byte("3"))
+	tree.Remove([]byte("x"))
+	added, removed = tree.PendingChanges()
+	require.Equal(t, keys("a", "b"), added)
+	require.Equal(t, keys("c", "d"), removed)
+
+	// The returned keys are copies.
+	added[0][0] = 'z'
+	added, _ = tree.PendingChanges()
+	require.Equal(t, keys("a", "b"), added)
+
+	tree.Rollback()
+	added, removed = tree.PendingChanges()
+	require.Empty(t, added)
+	require.Empty(t, removed)
+}
+
+func TestMutableTree_SkipUnchangedWrites(t *testing.T) {
+	orphanCount := func(memDB db.DB) int {
+		count := 0
+		for k := range dumpDB(t, memDB) {
+			if k[0] == orphanKeyFormat.Prefix()[0] {
+				count++
+			}
+		}
+		return count
+	}
+
+	for _, skip := range []bool{true, false} {
+		skip := skip
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			memDB := db.NewMemDB()
+			tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{SkipUnchangedWrites: skip})
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+			}
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// Setting identical values.
+			for i := 0; i < 10; i++ {
+				previous, updated := tree.SetWithPrevious([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+				require.Equal(t, !skip, updated)
+				if skip {
+					require.Nil(t, previous)
+				}
+			}
+			added, _ := tree.PendingChanges()
+			if skip {
+				require.Empty(t, tree.orphans)
+				require.Empty(t, added)
+			} else {
+				require.NotEmpty(t, tree.orphans)
+				require.Len(t, added, 10)
+			}
+			hash2, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, skip, bytes.Equal(hash, hash2))
+			if skip {
+				require.Zero(t, orphanCount(memDB))
+			} else {
+				require.NotZero(t, orphanCount(memDB))
+			}
+
+			// Changed values and new keys are still written.
+			require.True(t, tree.Set([]byte("k1"), []byte("changed")))
+			require.False(t, tree.Set([]byte("k10"), []byte("v10")))
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, []byte("changed"), tree.Get([]byte("k1")))
+			require.Equal(t, []byte("v10"), tree.Get([]byte("k10")))
+			require.NotZero(t, orphanCount(memDB))
+		})
+	}
+}
+
+func TestMutableTree_GetImmutableRelative(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, err = tree.GetImmutableRelative(0)
+	require.Equal(t, ErrVersionDoesNotExist, err)
+
+	// Save versions 1-6, 8 and 10, and delete 2 and 5, leaving 1, 3, 4, 6, 8 and 10.
+	for _, version := range []int64{1, 2, 3, 4, 5, 6, 8, 10} {
+		tree.Set([]byte("key"), []byte(fmt.Sprintf("v%d", version)))
+		_, _, err := tree.SaveVersionTo(version)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(2))
+	require.NoError(t, tree.DeleteVersion(5))
+
+	expected := []int64{10, 8, 6, 4, 3, 1}
+	for i, version := range expected {
+		itree, err := tree.GetImmutableRelative(-int64(i))
+		require.NoError(t, err)
+		require.Equal(t, version, itree.Version())
+		require.Equal(t, []byte(fmt.Sprintf("v%d", version)), itree.Get([]byte("key")))
+	}
+
+	_, err = tree.GetImmutableRelative(-int64(len(expected)))
+	require.Equal(t, ErrVersionDoesNotExist, err)
+	_, err = tree.GetImmutableRelative(1)
+	require.Equal(t, ErrVersionDoesNotExist, err)
+}
+
+func TestMutableTree_VersionSizeBytes(t *testing.T) {
+	// prefixSize sums the sizes of the database entries with the given key prefixes.
+	prefixSize := func(memDB db.DB, prefixes ...string) int64 {
+		size := int64(0)
+		for k, v := range dumpDB(t, memDB) {
+			for _, prefix := range prefixes {
+				if k[:1] == prefix {
+					size += int64(len(k) + len(v))
+				}
+			}
+		}
+		return size
+	}
+	nodePrefixes := []string{nodeKeyFormat.Prefix(), externalValueKeyFormat.Prefix()}
+
+	for _, threshold := range []int{0, 16} {
+		threshold := threshold
+		t.Run(fmt.Sprintf("threshold=%d", threshold), func(t *testing.T) {
+			memDB := db.NewMemDB()
+			tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{ExternalValueThreshold: threshold})
+			require.NoError(t, err)
+
+			// Each version inserts new keys, and the later ones also update and remove keys.
+			sizes := map[int64]int64{}
+			for version := int64(1); version <= 4; version++ {
+				written := map[string][]byte{}
+				set := func(key string, value []byte) {
+					tree.Set([]byte(key), value)
+					written[key] = value
+				}
+				for i := 0; i < 30; i++ {
+					key := fmt.Sprintf("k%d-%02d", version, i)
+					set(key, []byte(fmt.Sprintf("value %d %s", i, key[:i%6])))
+				}
+				if version > 2 {
+					for i := 0; i < 10; i++ {
+						key := fmt.Sprintf("k1-%02d", i*3+int(version))
+						set(key, []byte(fmt.Sprintf("updated value %d", version)))
+					}
+					tree.Remove([]byte(fmt.Sprintf("k2-%02d", version)))
+				}
+
+				nodesBefore, fastBefore := prefixSize(memDB, nodePrefixes...), prefixSize(memDB, fastKeyFormat.Prefix())
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				nodeGrowth := prefixSize(memDB, nodePrefixes...) - nodesBefore
+				fastGrowth := prefixSize(memDB, fastKeyFormat.Prefix()) - fastBefore
+				require.Greater(t, nodeGrowth, int64(0))
+
+				fastSize := int64(0)
+				for key, value := range written {
+					fastSize += int64(len(fastKeyFormat.KeyBytes([]byte(key))) + NewFastNode([]byte(key), value, version).encodedSize())
+				}
+				size, err := tree.VersionSizeBytes(version)
+				require.NoError(t, err)
+				require.Equal(t, nodeGrowth+fastSize, size)
+				sizes[version] = size
+				if version <= 2 {
+					// Without updates and removals, the fast nodes grow the database by their size.
+					require.Equal(t, nodeGrowth+fastGrowth, size)
+				}
+			}
+
+			// The sizes of earlier versions are unaffected by later ones.
+			for version, expected := range sizes {
+				size, err := tree.VersionSizeBytes(version)
+				require.NoError(t, err)
+				require.Equal(t, expected, size)
+			}
+			_, err = tree.VersionSizeBytes(5)
+			require.Equal(t, ErrVersionDoesNotExist, err)
+		})
+	}
+}
+
+func TestMutableTree_Reset(t *testing.T) {
+	opts := &Options{InitialVersion: 3}
+	// build modifies and saves a tree the same way, returning its hashes.
+	build := func(tree *MutableTree) [][]byte {
+		hashes := [][]byte{}
+		for version := 0; version < 3; version++ {
+			for i := 0; i < 20; i++ {
+				tree.Set([]byte(fmt.Sprintf("k%02d", (i*7+version)%25)), []byte(fmt.Sprintf("v%d", version)))
+			}
+			tree.Remove([]byte(fmt.Sprintf("k%02d", version)))
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			hashes = append(hashes, hash)
+		}
+		return hashes
+	}
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 100, opts)
+	require.NoError(t, err)
+	expectHashes := build(tree)
+	tree.Set([]byte("unsaved"), []byte{1})
+	itree, err := tree.GetImmutable(4)
+	require.NoError(t, err)
+
+	// Trees with active readers can't be reset.
+	exporter := itree.Export()
+	require.Error(t, tree.Reset(db.NewMemDB()))
+	exporter.Close()
+
+	// Databases which don't match the options are rejected, leaving the tree unchanged.
+	saltedDB := db.NewMemDB()
+	salted, err := NewMutableTreeWithOpts(saltedDB, 0, &Options{LeafHashSalt: []byte("salt")})
+	require.NoError(t, err)
+	salted.Set([]byte("a"), []byte{1})
+	_, _, err = salted.SaveVersion()
+	require.NoError(t, err)
+	require.Error(t, tree.Reset(saltedDB))
+	require.EqualValues(t, 5, tree.Version())
+	require.Equal(t, []byte{1}, tree.Get([]byte("unsaved")))
+	require.Equal(t, []byte("v2"), tree.Get([]byte("k07")))
+	itree, err = tree.GetImmutable(4)
+	require.NoError(t, err)
+	require.Equal(t, expectHashes[1], itree.Hash())
+
+	// Resetting to an empty database behaves like a new tree.
+	require.NoError(t, tree.Reset(db.NewMemDB()))
+	require.EqualValues(t, 0, tree.Version())
+	require.True(t, tree.IsEmpty())
+	require.Empty(t, tree.AvailableVersions())
+	added, removed := tree.PendingChanges()
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Nil(t, tree.Get([]byte("k07")))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, expectHashes, build(tree))
+	require.Equal(t, []int{3, 4, 5}, tree.AvailableVersions())
+	require.NoError(t, tree.DeleteVersion(4))
+
+	// Resetting to an existing database loads like a new tree.
+	require.NoError(t, tree.Reset(memDB))
+	fresh, err := NewMutableTreeWithOpts(memDB, 100, opts)
+	require.NoError(t, err)
+	for _, tree := range []*MutableTree{tree, fresh} {
+		version, err := tree.Load()
+		require.NoError(t, err)
+		require.EqualValues(t, 5, version)
+		require.Equal(t, expectHashes[2], tree.Hash())
+		require.Equal(t, []int{3, 4, 5}, tree.AvailableVersions())
+		require.True(t, tree.IsFastCacheEnabled())
+		require.Equal(t, []byte("v2"), tree.Get([]byte("k07")))
+		require.Nil(t, tree.Get([]byte("unsaved")))
+	}
+
+	// Trees created by NewInMemoryTree don't own the database they are reset to.
+	inMemory, err := NewInMemoryTree(0, nil)
+	require.NoError(t, err)
+	inMemory.Set([]byte("a"), []byte{1})
+	_, _, err = inMemory.SaveVersion()
+	require.NoError(t, err)
+	require.Error(t, inMemory.Reset(saltedDB))
+	require.Equal(t, []byte{1}, inMemory.Get([]byte("a")))
+	inMemoryVersion, err := inMemory.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, inMemoryVersion.Get([]byte("a")))
+	require.NoError(t, inMemory.Reset(memDB))
+	require.NoError(t, inMemory.Close())
+	_, err = tree.GetImmutable(5)
+	require.NoError(t, err)
+}
+
+func TestMutableTree_LeafHashSalt(t *testing.T) {
+	build := func(memDB db.DB, salt []byte) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{LeafHashSalt: salt, VerifyOnLoad: true})
+		require.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		return tree
+	}
+
+	// The same content has a different hash for each salt, and the same one for the same salt.
+	unsalted := build(db.NewMemDB(), nil)
+	saltedDB := db.NewMemDB()
+	salted := build(saltedDB, []byte("salt"))
+	require.NotEqual(t, unsalted.Hash(), salted.Hash())
+	require.NotEqual(t, salted.Hash(), build(db.NewMemDB(), []byte("other")).Hash())
+	require.Equal(t, salted.Hash(), build(db.NewMemDB(), []byte("salt")).Hash())
+	require.Equal(t, unsalted.Hash(), build(db.NewMemDB(), []byte{}).Hash())
+	equal, _ := salted.StructuralEqual(unsalted.ImmutableTree)
+	require.False(t, equal)
+
+	// Inner nodes are hashed as usual, so range proofs verify against the root hash, but their
+	// values can't be verified without the salt.
+	_, values, proof, err := salted.GetRangeWithProof([]byte("k03"), []byte("k08"), 0)
+	require.NoError(t, err)
+	require.Len(t, values, 5)
+	require.NoError(t, proof.Verify(salted.Hash()))
+	require.Error(t, proof.VerifyItem([]byte("k03"), []byte("v3")))
+
+	// The salted tree loads and verifies with the same salt.
+	tree, err := NewMutableTreeWithOpts(saltedDB, 0, &Options{LeafHashSalt: []byte("salt"), VerifyOnLoad: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, salted.Hash(), tree.Hash())
+	tree.Set([]byte("k00"), []byte("new"))
+	salted.Set([]byte("k00"), []byte("new"))
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, salted.WorkingHash(), hash)
+
+	// Other salts are rejected, in both directions.
+	_, err = NewMutableTreeWithOpts(saltedDB, 0, &Options{LeafHashSalt: []byte("other")})
+	require.Error(t, err)
+	_, err = NewMutableTree(saltedDB, 0)
+	require.Error(t, err)
+	_, err = NewMutableTreeWithOpts(unsalted.ndb.db, 0, &Options{LeafHashSalt: []byte("salt")})
+	require.Error(t, err)
+}
+
+// numericComparator orders decimal keys by their numeric value.
+func numericComparator(a, b []byte) int {
+	x, err := strconv.Atoi(string(a))
+	if err != nil {
+		panic(err)
+	}
+	y, err := strconv.Atoi(string(b))
+	if err != nil {
+		panic(err)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func TestMutableTree_Comparator(t *testing.T) {
+	opts := &Options{Comparator: numericComparator, ComparatorName: "numeric", VerifyOnLoad: true}
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	bytewise, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for _, i := range rand.Perm(30) {
+		key := []byte(strconv.Itoa(i))
+		tree.Set(key, key)
+		bytewise.Set(key, key)
+	}
+
+	requireNumeric := func(itr db.Iterator, from, to int, ascending bool) {
+		defer itr.Close()
+		for i := 0; i < to-from; i++ {
+			expected := from + i
+			if !ascending {
+				expected = to - 1 - i
+			}
+			require.True(t, itr.Valid())
+			require.Equal(t, strconv.Itoa(expected), string(itr.Key()))
+			itr.Next()
+		}
+		require.False(t, itr.Valid())
+		require.NoError(t, itr.Error())
+	}
+	requireNumeric(tree.Iterator(nil, nil, true), 0, 30, true)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = bytewise.SaveVersion()
+	require.NoError(t, err)
+	require.NotEqual(t, bytewise.Hash(), tree.Hash())
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	for _, ascending := range []bool{true, false} {
+		requireNumeric(tree.Iterator(nil, nil, ascending), 0, 30, ascending)
+		requireNumeric(itree.Iterator(nil, nil, ascending), 0, 30, ascending)
+		requireNumeric(itree.Iterator([]byte("5"), []byte("12"), ascending), 5, 12, ascending)
+	}
+	for i := 0; i < 30; i++ {
+		require.Equal(t, []byte(strconv.Itoa(i)), tree.Get([]byte(strconv.Itoa(i))))
+	}
+	_, _, err = itree.GetWithProof([]byte("1"))
+	require.Error(t, err)
+
+	// The tree reloads and stays in numeric order with the same comparator.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	tree.Remove([]byte("3"))
+	tree.Set([]byte("100"), []byte("100"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	keys := []string{}
+	tree.Iterate(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.Equal(t, []string{"0", "1", "2", "4", "5"}, keys[:5])
+	require.Equal(t, []string{"28", "29", "100"}, keys[len(keys)-3:])
+
+	// Other comparators are rejected, in both directions.
+	_, err = NewMutableTree(memDB, 0)
+	require.Error(t, err)
+	_, err = NewMutableTreeWithOpts(memDB, 0, &Options{Comparator: numericComparator, ComparatorName: "other"})
+	require.Error(t, err)
+	_, err = NewMutableTreeWithOpts(bytewise.ndb.db, 0, opts)
+	require.Error(t, err)
+	_, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Comparator: numericComparator})
+	require.Error(t, err)
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
+	"sync"
 
 	"github.com/cosmos/iavl/cache"
 	"github.com/pkg/errors"
@@ -42,6 +44,10 @@ func NewNode(key []byte, value []byte, version int64) *Node {
 	}
 }
 
+// externalValueFlag is appended to the encoding of leaf nodes whose value is stored separately
+// (see Options.ExternalValueThreshold), in which case the encoded value is the value hash.
+const externalValueFlag byte = 0x01
+
 // MakeNode constructs an *Node from an encoded byte slice.
 //
 // The new node doesn't have its hash saved or set. The caller must set it
@@ -145,6 +151,22 @@ func (node *Node) clone(version int64) *Node {
 	}
 }
 
+// cloneUnpersisted creates a deep copy of the node and all of its unpersisted descendants.
+// Persisted nodes are never modified, so they are shared rather than copied.
+func (node *Node) cloneUnpersisted() *Node {
+	if node == nil || node.persisted {
+		return node
+	}
+	clone := *node
+	if node.leftNode != nil {
+		clone.leftNode = node.leftNode.cloneUnpersisted()
+	}
+	if node.rightNode != nil {
+		clone.rightNode = node.rightNode.cloneUnpersisted()
+	}
+	return &clone
+}
+
 func (node *Node) isLeaf() bool {
 	return node.height == 0
 }
@@ -157,7 +179,7 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool) {
 	if node.isLeaf() {
 		return false
 	}
-	if bytes.Compare(key, node.key) < 0 {
+	if t.compareKeys(key, node.key) < 0 {
 		return node.getLeftNode(t).has(t, key)
 	}
 	return node.getRightNode(t).has(t, key)
@@ -165,21 +187,21 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool) {
 
 // Get a key under the node.
 //
-// The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
+// The index is the index in the list of leaf nodes sorted by key. The leftmost leaf has index 0.
 // It's neighbor has index 1 and so on.
 func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte) {
 	if node.isLeaf() {
-		switch bytes.Compare(node.key, key) {
-		case -1:
+		switch cmp := t.compareKeys(node.key, key); {
+		case cmp < 0:
 			return 1, nil
-		case 1:
+		case cmp > 0:
 			return 0, nil
 		default:
 			return 0, node.value
 		}
 	}
 
-	if bytes.Compare(key, node.key) < 0 {
+	if t.compareKeys(key, node.key) < 0 {
 		return node.getLeftNode(t).get(t, key)
 	}
 	rightNode := node.getRightNode(t)
@@ -188,6 +210,100 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte)
 	return index, value
 }
 
+// floor returns the largest key under the node which is less than or equal to the given key. Inner
+// node keys are the smallest keys of their right subtrees, so the descent for the key ends at the
+// floor unless the descent only went left, in which case the leaf is the smallest key.
+func (node *Node) floor(t *ImmutableTree, key []byte) (k, v []byte, ok bool) {
+	for !node.isLeaf() {
+		if t.compareKeys(key, node.key) < 0 {
+			node = node.getLeftNode(t)
+		} else {
+			node = node.getRightNode(t)
+		}
+	}
+	if t.compareKeys(node.key, key) > 0 {
+		return nil, nil, false
+	}
+	return node.key, node.value, true
+}
+
+// ceiling returns the smallest key under the node which is greater than or equal to the given
+// key. If the descent for the key ends at a smaller leaf, the ceiling is the leftmost leaf of the
+// right subtree where the descent last went left, if any.
+func (node *Node) ceiling(t *ImmutableTree, key []byte) (k, v []byte, ok bool) {
+	var lastLeft *Node
+	for !node.isLeaf() {
+		if t.compareKeys(key, node.key) < 0 {
+			lastLeft = node
+			node = node.getLeftNode(t)
+		} else {
+			node = node.getRightNode(t)
+		}
+	}
+	if t.compareKeys(node.key, key) >= 0 {
+		return node.key, node.value, true
+	}
+	if lastLeft == nil {
+		return nil, nil, false
+	}
+	node = lastLeft.getRightNode(t)
+	for !node.isLeaf() {
+		node = node.getLeftNode(t)
+	}
+	return node.key, node.value, true
+}
+
+// heightAfterSet returns the height the node would have after setting the key below it, without
+// modifying it. An insertion grows a subtree by at most one level, and rotations restore the
+// height the subtree had before the insertion.
+func (node *Node) heightAfterSet(t *ImmutableTree, key []byte) int8 {
+	if node.isLeaf() {
+		if bytes.Equal(key, node.key) {
+			return 0
+		}
+		return 1
+	}
+
+	var changed, other *Node
+	if t.compareKeys(key, node.key) < 0 {
+		changed, other = node.getLeftNode(t), node.getRightNode(t)
+	} else {
+		changed, other = node.getRightNode(t), node.getLeftNode(t)
+	}
+	height := changed.heightAfterSet(t, key)
+	if height == changed.height {
+		return node.height
+	}
+	if height-other.height > 1 {
+		// The node is rebalanced.
+		return node.height
+	}
+	return maxInt8(height, other.height) + 1
+}
+
+// multiGet looks up the keys at the given indexes under the node, storing each value at the same
+// index in values. The indexes must be sorted by key, so that keys sharing a path are resolved
+// in a single descent.
+func (node *Node) multiGet(t *ImmutableTree, keys [][]byte, indexes []int, values [][]byte) {
+	if len(indexes) == 0 {
+		return
+	}
+	if node.isLeaf() {
+		for _, i := range indexes {
+			if bytes.Equal(keys[i], node.key) {
+				values[i] = node.value
+			}
+		}
+		return
+	}
+
+	split := sort.Search(len(indexes), func(i int) bool {
+		return t.compareKeys(keys[indexes[i]], node.key) >= 0
+	})
+	node.getLeftNode(t).multiGet(t, keys, indexes[:split], values)
+	node.getRightNode(t).multiGet(t, keys, indexes[split:], values)
+}
+
 func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value []byte) {
 	if node.isLeaf() {
 		if index == 0 {
@@ -205,16 +321,16 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 	return node.getRightNode(t).getByIndex(t, index-leftNode.size)
 }
 
-// Computes the hash of the node without computing its descendants. Must be
-// called on nodes which have descendant node hashes already computed.
-func (node *Node) _hash() []byte {
+// Computes the hash of the node without computing its descendants, with the given
+// Options.LeafHashSalt. Must be called on nodes which have descendant node hashes already computed.
+func (node *Node) _hash(salt []byte) []byte {
 	if node.hash != nil {
 		return node.hash
 	}
 
 	h := sha256.New()
 	buf := new(bytes.Buffer)
-	if err := node.writeHashBytes(buf); err != nil {
+	if err := node.writeHashBytes(buf, salt); err != nil {
 		panic(err)
 	}
 	_, err := h.Write(buf.Bytes())
@@ -226,11 +342,22 @@ func (node *Node) _hash() []byte {
 	return node.hash
 }
 
+// verifyHash recomputes the hash of the node from its contents and child hashes, and returns an
+// error if it doesn't match the expected hash.
+func (node *Node) verifyHash(expected, salt []byte) error {
+	clone := *node
+	clone.hash = nil
+	if hash := clone._hash(salt); !bytes.Equal(hash, expected) {
+		return errors.Errorf("node hash mismatch, expected %X but computed %X", expected, hash)
+	}
+	return nil
+}
+
 // Hash the node and its descendants recursively. This usually mutates all
 // descendant nodes. Returns the node hash and number of nodes hashed.
 // If the tree is empty (i.e. the node is nil), returns the hash of an empty input,
 // to conform with RFC-6962.
-func (node *Node) hashWithCount() ([]byte, int64) {
+func (node *Node) hashWithCount(salt []byte) ([]byte, int64) {
 	if node == nil {
 		return sha256.New().Sum(nil), 0
 	}
@@ -240,7 +367,7 @@ func (node *Node) hashWithCount() ([]byte, int64) {
 
 	h := sha256.New()
 	buf := new(bytes.Buffer)
-	hashCount, err := node.writeHashBytesRecursively(buf)
+	hashCount, err := node.writeHashBytesRecursively(buf, salt)
 	if err != nil {
 		panic(err)
 	}
@@ -253,6 +380,34 @@ func (node *Node) hashWithCount() ([]byte, int64) {
 	return node.hash, hashCount + 1
 }
 
+// hashWithCountParallel is like hashWithCount, but hashes the unhashed left and right subtrees
+// concurrently, spawning goroutines down to the given depth.
+func (node *Node) hashWithCountParallel(depth int, salt []byte) ([]byte, int64) {
+	if depth <= 0 || node == nil || node.hash != nil || node.isLeaf() {
+		return node.hashWithCount(salt)
+	}
+
+	var (
+		wg                    sync.WaitGroup
+		leftCount, rightCount int64
+	)
+	if node.leftNode != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.leftHash, leftCount = node.leftNode.hashWithCountParallel(depth-1, salt)
+		}()
+	}
+	if node.rightNode != nil {
+		node.rightHash, rightCount = node.rightNode.hashWithCountParallel(depth-1, salt)
+	}
+	wg.Wait()
+
+	// The children are hashed now, so this only hashes the node itself.
+	hash, count := node.hashWithCount(salt)
+	return hash, leftCount + rightCount + count
+}
+
 // validate validates the node contents
 func (node *Node) validate() error {
 	if node == nil {
@@ -294,9 +449,9 @@ func (node *Node) validate() error {
 	return nil
 }
 
-// Writes the node's hash to the given io.Writer. This function expects
-// child hashes to be already set.
-func (node *Node) writeHashBytes(w io.Writer) error {
+// Writes the node's hash to the given io.Writer, with the given Options.LeafHashSalt. This
+// function expects child hashes to be already set.
+func (node *Node) writeHashBytes(w io.Writer, salt []byte) error {
 	err := encodeVarint(w, int64(node.height))
 	if err != nil {
 		return errors.Wrap(err, "writing height")
@@ -320,9 +475,7 @@ func (node *Node) writeHashBytes(w io.Writer) error {
 
 		// Indirection needed to provide proofs without values.
 		// (e.g. ProofLeafNode.ValueHash)
-		valueHash := sha256.Sum256(node.value)
-
-		err = encodeBytes(w, valueHash[:])
+		err = encodeBytes(w, leafValueHash(node.value, salt))
 		if err != nil {
 			return errors.Wrap(err, "writing value")
 		}
@@ -345,22 +498,35 @@ func (node *Node) writeHashBytes(w io.Writer) error {
 
 // Writes the node's hash to the given io.Writer.
 // This function has the side-effect of calling hashWithCount.
-func (node *Node) writeHashBytesRecursively(w io.Writer) (hashCount int64, err error) {
+func (node *Node) writeHashBytesRecursively(w io.Writer, salt []byte) (hashCount int64, err error) {
 	if node.leftNode != nil {
-		leftHash, leftCount := node.leftNode.hashWithCount()
+		leftHash, leftCount := node.leftNode.hashWithCount(salt)
 		node.leftHash = leftHash
 		hashCount += leftCount
 	}
 	if node.rightNode != nil {
-		rightHash, rightCount := node.rightNode.hashWithCount()
+		rightHash, rightCount := node.rightNode.hashWithCount(salt)
 		node.rightHash = rightHash
 		hashCount += rightCount
 	}
-	err = node.writeHashBytes(w)
+	err = node.writeHashBytes(w, salt)
 
 	return
 }
 
+// leafValueHash returns the hash of a leaf value, which is part of the leaf hash. A non-empty
+// Options.LeafHashSalt is prepended to the value.
+func leafValueHash(value, salt []byte) []byte {
+	if len(salt) == 0 {
+		h := sha256.Sum256(value)
+		return h[:]
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
 func (node *Node) encodedSize() int {
 	n := 1 +
 		encodeVarintSize(node.size) +
@@ -0,0 +1,215 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// defaultNodeCodecName is the name of DefaultNodeCodec. Databases without a persisted codec name
+// were written with it.
+const defaultNodeCodecName = "default"
+
+// NodeCodec encodes and decodes nodes stored in the database, see Options.NodeCodec. Node hashes
+// are computed from the node fields rather than their encoding, so the codec doesn't affect tree
+// hashes or proofs.
+type NodeCodec interface {
+	// Name identifies the codec. It is persisted in the database, which can then only be opened
+	// with a codec of the same name.
+	Name() string
+
+	// Encode encodes a node, excluding its hash, which is stored as part of the database key.
+	Encode(node *Node) []byte
+
+	// Decode decodes a node encoded by Encode. The caller sets the node hash afterwards.
+	Decode(buf []byte) (*Node, error)
+}
+
+// DefaultNodeCodec is the node encoding used when Options.NodeCodec is nil. Custom codecs may wrap
+// it, e.g. to compress its output.
+type DefaultNodeCodec struct{}
+
+var _ NodeCodec = DefaultNodeCodec{}
+
+// Name implements NodeCodec.
+func (DefaultNodeCodec) Name() string {
+	return defaultNodeCodecName
+}
+
+// Encode implements NodeCodec.
+func (DefaultNodeCodec) Encode(node *Node) []byte {
+	var buf bytes.Buffer
+	buf.Grow(node.encodedSize())
+	if err := node.writeBytes(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Decode implements NodeCodec.
+func (DefaultNodeCodec) Decode(buf []byte) (*Node, error) {
+	return MakeNode(buf)
+}
+
+// ValueCodec encodes and decodes the values of leaf nodes and fast nodes stored in the database,
+// e.g. to compress them, see Options.ValueCodec. Tree hashes and proofs are computed from the
+// decoded values, so the codec doesn't affect them.
+type ValueCodec interface {
+	// Name identifies the codec. It is persisted in the database, which can then only be opened
+	// with a codec of the same name.
+	Name() string
+
+	// Encode encodes a value. It must not modify the value.
+	Encode(value []byte) ([]byte, error)
+
+	// Decode decodes a value encoded by Encode.
+	Decode(buf []byte) ([]byte, error)
+}
+
+// checkNodeCodec checks that the nodes in the database were encoded with the configured codec, and
+// persists the codec name in a new database. Existing databases without a codec name were written
+// with the default codec.
+func (ndb *nodeDB) checkNodeCodec() error {
+	key := metadataKeyFormat.Key([]byte(nodeCodecKey))
+	name := ndb.codec.Name()
+	stored, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if name == defaultNodeCodecName {
+			return nil
+		}
+		latest, err := ndb.readLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			return ndb.db.SetSync(key, []byte(name))
+		}
+		stored = []byte(defaultNodeCodecName)
+	}
+	if string(stored) != name {
+		return errors.Errorf("nodes are encoded with the %q codec, but the %q codec was given", stored, name)
+	}
+	return nil
+}
+
+// checkValueCodec checks that the values in the database were encoded with the configured
+// Options.ValueCodec, and persists the codec name in a new database, like checkNodeCodec. Existing
+// databases without a codec name store raw values.
+func (ndb *nodeDB) checkValueCodec() error {
+	key := metadataKeyFormat.Key([]byte(valueCodecKey))
+	name := ""
+	if ndb.opts.ValueCodec != nil {
+		name = ndb.opts.ValueCodec.Name()
+	}
+	stored, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if name == "" {
+			return nil
+		}
+		latest, err := ndb.readLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			return ndb.db.SetSync(key, []byte(name))
+		}
+		return errors.Errorf("values are stored raw, but the %q value codec was given", name)
+	}
+	if name == "" {
+		return errors.Errorf("values are encoded with the %q codec, but no value codec was given", stored)
+	}
+	if string(stored) != name {
+		return errors.Errorf("values are encoded with the %q codec, but the %q codec was given", stored, name)
+	}
+	return nil
+}
+
+// encodeValue encodes a value for storage with Options.ValueCodec, if any.
+func (ndb *nodeDB) encodeValue(value []byte) ([]byte, error) {
+	if ndb.opts.ValueCodec == nil {
+		return value, nil
+	}
+	encoded, err := ndb.opts.ValueCodec.Encode(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding value")
+	}
+	return encoded, nil
+}
+
+// decodeValue decodes a value encoded by encodeValue.
+func (ndb *nodeDB) decodeValue(buf []byte) ([]byte, error) {
+	if ndb.opts.ValueCodec == nil {
+		return buf, nil
+	}
+	value, err := ndb.opts.ValueCodec.Decode(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding value")
+	}
+	return value, nil
+}
+
+// checkLeafHashSalt checks that the tree in the database was hashed with the configured
+// Options.LeafHashSalt, and persists the salt in a new database, like checkNodeCodec. Existing
+// databases without a salt were hashed without one. The salts are not included in errors.
+func (ndb *nodeDB) checkLeafHashSalt() error {
+	key := metadataKeyFormat.Key([]byte(leafHashSaltKey))
+	salt := ndb.opts.LeafHashSalt
+	stored, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if len(salt) == 0 {
+			return nil
+		}
+		latest, err := ndb.readLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			return ndb.db.SetSync(key, salt)
+		}
+	}
+	if !bytes.Equal(stored, salt) {
+		return errors.New("the tree was hashed with a different leaf hash salt than the given one")
+	}
+	return nil
+}
+
+// checkComparator checks that the keys in the database were ordered with the configured
+// comparator, and persists the comparator name in a new database. Existing databases without a
+// comparator name are ordered by bytes.Compare.
+func (ndb *nodeDB) checkComparator() error {
+	key := metadataKeyFormat.Key([]byte(comparatorKey))
+	name := ndb.opts.ComparatorName
+	stored, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if name == "" {
+			return nil
+		}
+		latest, err := ndb.readLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			return ndb.db.SetSync(key, []byte(name))
+		}
+		return errors.Errorf("keys are ordered by bytes, but the %q comparator was given", name)
+	}
+	if name == "" {
+		return errors.Errorf("keys are ordered by the %q comparator, but no comparator was given", stored)
+	}
+	if string(stored) != name {
+		return errors.Errorf("keys are ordered by the %q comparator, but the %q comparator was given", stored, name)
+	}
+	return nil
+}
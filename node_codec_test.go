@@ -0,0 +1,247 @@
+package iavl
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// fixedNodeCodec encodes node integers with a fixed width instead of as varints.
+type fixedNodeCodec struct{}
+
+func (fixedNodeCodec) Name() string {
+	return "fixed"
+}
+
+func (fixedNodeCodec) Encode(node *Node) []byte {
+	buf := make([]byte, 17)
+	buf[0] = byte(node.height)
+	binary.BigEndian.PutUint64(buf[1:], uint64(node.size))
+	binary.BigEndian.PutUint64(buf[9:], uint64(node.version))
+	fields := [][]byte{node.key, node.value}
+	if !node.isLeaf() {
+		fields = [][]byte{node.key, node.leftHash, node.rightHash}
+	}
+	for _, field := range fields {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(field)))
+		buf = append(buf, n[:]...)
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func (fixedNodeCodec) Decode(buf []byte) (*Node, error) {
+	if len(buf) < 17 {
+		return nil, errors.New("node too short")
+	}
+	node := &Node{
+		height:  int8(buf[0]),
+		size:    int64(binary.BigEndian.Uint64(buf[1:])),
+		version: int64(binary.BigEndian.Uint64(buf[9:])),
+	}
+	buf = buf[17:]
+	fields := []*[]byte{&node.key, &node.value}
+	if !node.isLeaf() {
+		fields = []*[]byte{&node.key, &node.leftHash, &node.rightHash}
+	}
+	for _, field := range fields {
+		if len(buf) < 4 {
+			return nil, errors.New("node too short")
+		}
+		n := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < n {
+			return nil, errors.New("node too short")
+		}
+		*field = buf[:n]
+		buf = buf[n:]
+	}
+	if len(buf) > 0 {
+		return nil, errors.New("trailing bytes")
+	}
+	return node, nil
+}
+
+func TestNodeCodec_RoundTrip(t *testing.T) {
+	nodes := map[string]*Node{
+		"inner": {
+			height:    3,
+			version:   2,
+			size:      7,
+			key:       []byte("key"),
+			leftHash:  randBytes(hashSize),
+			rightHash: randBytes(hashSize),
+		},
+		"leaf": {
+			height:  0,
+			version: 3,
+			size:    1,
+			key:     []byte("key"),
+			value:   []byte("value"),
+		},
+	}
+	for name, node := range nodes {
+		node := node
+		t.Run(name, func(t *testing.T) {
+			hashed := *node
+			hash := hashed._hash(nil)
+			for _, codec := range []NodeCodec{DefaultNodeCodec{}, fixedNodeCodec{}} {
+				decoded, err := codec.Decode(codec.Encode(node))
+				require.NoError(t, err)
+				require.Equal(t, node, decoded)
+				require.Equal(t, hash, decoded._hash(nil))
+			}
+		})
+	}
+}
+
+func TestNodeCodec_Tree(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{NodeCodec: fixedNodeCodec{}}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	expect, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("%03d", (i*7+version)%100))
+			value := []byte(fmt.Sprintf("%d", version))
+			tree.Set(key, value)
+			expect.Set(key, value)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectHash, _, err := expect.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectHash, hash)
+	}
+
+	// Nodes are stored with the codec.
+	stored, err := memDB.Get(tree.ndb.nodeKey(tree.root.hash))
+	require.NoError(t, err)
+	require.Equal(t, fixedNodeCodec{}.Encode(tree.root), stored)
+
+	// The tree loads with the same codec.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(2)
+	require.NoError(t, err)
+	itree, err := expect.GetImmutable(2)
+	require.NoError(t, err)
+	equal, _ := tree.StructuralEqual(itree)
+	require.True(t, equal)
+	require.Equal(t, itree.Get([]byte("042")), tree.Get([]byte("042")))
+
+	// Other codecs are rejected, in both directions.
+	_, err = NewMutableTree(memDB, 0)
+	require.Error(t, err)
+	_, err = NewMutableTreeWithOpts(expect.ndb.db, 0, opts)
+	require.Error(t, err)
+
+	_, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{NodeCodec: fixedNodeCodec{}, ExternalValueThreshold: 1})
+	require.Error(t, err)
+}
+
+// flateValueCodec compresses values with DEFLATE.
+type flateValueCodec struct{}
+
+func (flateValueCodec) Name() string {
+	return "flate"
+}
+
+func (flateValueCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateValueCodec) Decode(buf []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(buf)))
+}
+
+func TestValueCodec_Tree(t *testing.T) {
+	for _, threshold := range []int{0, 64} {
+		threshold := threshold
+		t.Run(fmt.Sprintf("threshold-%d", threshold), func(t *testing.T) {
+			memDB := db.NewMemDB()
+			opts := &Options{ValueCodec: flateValueCodec{}, ExternalValueThreshold: threshold}
+			tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+			require.NoError(t, err)
+			expect, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(t, err)
+
+			value := func(i, version int) []byte {
+				return bytes.Repeat([]byte(fmt.Sprintf(`{"key":%d,"version":%d},`, i, version)), 20)
+			}
+			for version := 1; version <= 3; version++ {
+				for i := 0; i < 50; i++ {
+					key := []byte(fmt.Sprintf("%03d", (i*7+version)%100))
+					tree.Set(key, value(i, version))
+					expect.Set(key, value(i, version))
+				}
+				hash, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				expectHash, _, err := expect.SaveVersion()
+				require.NoError(t, err)
+				require.Equal(t, expectHash, hash)
+			}
+
+			// Values are stored compressed.
+			key := []byte("042")
+			stored, err := memDB.Get(tree.ndb.fastNodeKey(key))
+			require.NoError(t, err)
+			expectStored, err := expect.ndb.db.Get(expect.ndb.fastNodeKey(key))
+			require.NoError(t, err)
+			require.Less(t, len(stored), len(expectStored)/4)
+
+			// The tree loads with the same codec, and reads decoded values from nodes and fast nodes.
+			tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+			require.NoError(t, err)
+			_, err = tree.Load()
+			require.NoError(t, err)
+			require.Equal(t, expect.Get(key), tree.Get(key))
+			_, treeValue := tree.GetWithIndex(key)
+			require.Equal(t, expect.Get(key), treeValue)
+			for version := int64(1); version <= 3; version++ {
+				require.Equal(t, expect.GetVersioned(key, version), tree.GetVersioned(key, version))
+			}
+			var values, expectValues [][]byte
+			tree.Iterate(func(key, value []byte) bool {
+				values = append(values, value)
+				return false
+			})
+			expect.Iterate(func(key, value []byte) bool {
+				expectValues = append(expectValues, value)
+				return false
+			})
+			require.Equal(t, expectValues, values)
+			mismatches, err := tree.VerifyFastStorage()
+			require.NoError(t, err)
+			require.Empty(t, mismatches)
+
+			// Trees with other codecs or without one are rejected, in both directions.
+			_, err = NewMutableTree(memDB, 0)
+			require.Error(t, err)
+			_, err = NewMutableTreeWithOpts(expect.ndb.db, 0, opts)
+			require.Error(t, err)
+		})
+	}
+}
@@ -9,9 +9,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cosmos/iavl/cache"
 	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	dbm "github.com/tendermint/tm-db"
 )
 
@@ -20,6 +23,10 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	nodeCodecKey      = "node_codec"
+	leafHashSaltKey   = "leaf_hash_salt"
+	comparatorKey     = "comparator"
+	valueCodecKey     = "value_codec"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -30,6 +37,11 @@ const (
 	defaultStorageVersionValue = "1.0.0"
 	fastStorageVersionValue    = "1.1.0"
 	fastNodeCacheLimit = 100000
+
+	// The node cache is split into at most nodeCacheShards shards of at least
+	// minNodeCacheShardSize nodes each, see newNodeCache.
+	nodeCacheShards       = 16
+	minNodeCacheShardSize = 1024
 )
 
 var (
@@ -61,6 +73,17 @@ var (
 
 	// Root nodes are indexed separately by their version
 	rootKeyFormat = NewKeyFormat('r', int64Size) // r<version>
+
+	// Deferred version deletions (see Options.OrphanGracePeriodVersions) are indexed by the
+	// version at which they are due, followed by the range of versions to delete.
+	deferredDeletionKeyFormat = NewKeyFormat('d', int64Size, int64Size, int64Size) // d<due-version><from-version><to-version>
+
+	// Values of leaf nodes stored outside the node (see Options.ExternalValueThreshold) are
+	// indexed by the hash of the leaf node.
+	externalValueKeyFormat = NewKeyFormat('x', hashSize) // x<hash>
+
+	// Opaque metadata attached to saved versions by the caller, which is not part of the tree hash.
+	versionMetadataKeyFormat = NewKeyFormat('v', int64Size) // v<version>
 )
 
 var (
@@ -68,17 +91,28 @@ var (
 )
 
 type nodeDB struct {
+	latestVersion  int64            // Accessed atomically, first for 64-bit alignment.
 	mtx            sync.Mutex       // Read/write lock.
 	db             dbm.DB           // Persistent node storage.
 	batch          dbm.Batch        // Batched writing buffer.
 	opts           Options          // Options to customize for pruning/writing
 	versionReaders map[int64]uint32 // Number of active version readers
 	storageVersion string           // Storage version
-	latestVersion  int64
+	codec          NodeCodec        // Node encoding, from Options.NodeCodec
 	nodeCache      cache.Cache
 	fastNodeCache  cache.Cache
 }
 
+// newNodeCache returns the node cache, which is sharded for large caches so that concurrent
+// readers, e.g. of the same version, don't contend on a single lock for cached nodes.
+func newNodeCache(cacheSize int) cache.Cache {
+	shards := cacheSize / minNodeCacheShardSize
+	if shards > nodeCacheShards {
+		shards = nodeCacheShards
+	}
+	return cache.NewSharded(cacheSize, shards)
+}
+
 func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 	if opts == nil {
 		o := DefaultOptions()
@@ -91,58 +125,156 @@ func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 		storeVersion = []byte(defaultStorageVersionValue)
 	}
 
+	codec := opts.NodeCodec
+	if codec == nil {
+		codec = DefaultNodeCodec{}
+	}
+
 	return &nodeDB{
 		db:             db,
-		batch:          db.NewBatch(),
+		codec:          codec,
+		batch:          newBatch(db, *opts),
 		opts:           *opts,
 		latestVersion:  0, // initially invalid
-		nodeCache:      cache.New(cacheSize),
+		nodeCache:      newNodeCache(cacheSize),
 		fastNodeCache:  cache.New(fastNodeCacheLimit),
 		versionReaders: make(map[int64]uint32, 8),
 		storageVersion: string(storeVersion),
 	}
 }
 
+// reset discards uncommitted writes and clears the caches, and rebinds the nodeDB to the given
+// database, keeping its options and cache sizes. The result is like a new nodeDB, but reuses its
+// allocations. It fails if any version has active readers, which would read from the new database.
+func (ndb *nodeDB) reset(db dbm.DB) error {
+	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	if err != nil || storeVersion == nil {
+		storeVersion = []byte(defaultStorageVersionValue)
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for version, readers := range ndb.versionReaders {
+		if readers > 0 {
+			return errors.Errorf("unable to reset, version %v has %v active readers", version, readers)
+		}
+	}
+	err = ndb.batch.Close()
+	ndb.db = db
+	ndb.batch = newBatch(db, ndb.opts)
+	atomic.StoreInt64(&ndb.latestVersion, 0)
+	for version := range ndb.versionReaders {
+		delete(ndb.versionReaders, version)
+	}
+	ndb.storageVersion = string(storeVersion)
+	ndb.nodeCache.Clear()
+	ndb.fastNodeCache.Clear()
+	return err
+}
+
+// close discards uncommitted writes and clears the caches, and closes the database if closeDB is
+// true. The nodeDB must not be used afterwards.
+func (ndb *nodeDB) close(closeDB bool) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	err := ndb.batch.Close()
+	ndb.batch = nil
+	ndb.nodeCache = cache.New(0)
+	ndb.fastNodeCache = cache.New(0)
+	if closeDB {
+		if closeErr := ndb.db.Close(); err == nil {
+			err = closeErr
+		}
+		ndb.db = nil
+	}
+	return err
+}
+
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
 // load its children.
 func (ndb *nodeDB) GetNode(hash []byte) *Node {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	node, err := ndb.getNode(hash)
+	if err != nil {
+		panic(err.Error())
+	}
+	return node
+}
 
+// getNode is like GetNode, but returns an error if the node can't be loaded.
+func (ndb *nodeDB) getNode(hash []byte) (*Node, error) {
 	if len(hash) == 0 {
 		panic("nodeDB.GetNode() requires hash")
 	}
 
-	// Check the cache.
+	// Check the cache. It is safe for concurrent use, and cached nodes are persisted and never
+	// modified, so cache hits don't need to take the nodeDB lock.
+	if cachedNode := ndb.nodeCache.Get(hash); cachedNode != nil {
+		return cachedNode.(*Node), nil
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	// Check the cache again, in case the node was loaded while waiting for the lock.
 	if cachedNode := ndb.nodeCache.Get(hash); cachedNode != nil {
-		return cachedNode.(*Node)
+		return cachedNode.(*Node), nil
 	}
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.nodeKey(hash))
+	node, err := ndb.loadNode(hash)
 	if err != nil {
-		panic(fmt.Sprintf("can't get node %X: %v", hash, err))
+		return nil, err
+	}
+	ndb.nodeCache.Add(node)
+
+	return node, nil
+}
+
+// getNodeUncached is like getNode, but doesn't add nodes loaded from the database to the node
+// cache, e.g. for scans that would otherwise evict frequently used nodes.
+func (ndb *nodeDB) getNodeUncached(hash []byte) (*Node, error) {
+	if len(hash) == 0 {
+		panic("nodeDB.GetNode() requires hash")
+	}
+	if cachedNode := ndb.nodeCache.Get(hash); cachedNode != nil {
+		return cachedNode.(*Node), nil
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.loadNode(hash)
+}
+
+// loadNode reads the node with the given hash from the database. The caller must hold ndb.mtx.
+func (ndb *nodeDB) loadNode(hash []byte) (*Node, error) {
+	buf, err := ndb.dbGet(ndb.nodeKey(hash))
+	if err != nil {
+		return nil, errors.Errorf("can't get node %X: %v", hash, err)
 	}
 	if buf == nil {
-		panic(fmt.Sprintf("Value missing for hash %x corresponding to nodeKey %x", hash, ndb.nodeKey(hash)))
+		return nil, errors.Errorf("Value missing for hash %x corresponding to nodeKey %x", hash, ndb.nodeKey(hash))
 	}
 
-	node, err := MakeNode(buf)
+	node, err := ndb.makeNode(hash, buf)
 	if err != nil {
-		panic(fmt.Sprintf("Error reading Node. bytes: %x, error: %v", buf, err))
+		return nil, errors.Errorf("Error reading Node. bytes: %x, error: %v", buf, err)
 	}
 
 	node.hash = hash
 	node.persisted = true
-	ndb.nodeCache.Add(node)
-
-	return node
+	return node, nil
 }
 
 func (ndb *nodeDB) GetFastNode(key []byte) (*FastNode, error) {
 	if !ndb.hasUpgradedToFastStorage() {
 		return nil, errors.New("storage version is not fast")
 	}
+	if ndb.opts.VersionCeiling > 0 {
+		// Fast nodes reflect the latest version in the database, which may be hidden.
+		return nil, errors.New("fast storage is not used with a version ceiling")
+	}
 
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -156,7 +288,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*FastNode, error) {
 	}
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
+	buf, err := ndb.dbGet(ndb.fastNodeKey(key))
 	if err != nil {
 		return nil, fmt.Errorf("can't get FastNode %X: %w", key, err)
 	}
@@ -164,7 +296,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*FastNode, error) {
 		return nil, nil
 	}
 
-	fastNode, err := DeserializeFastNode(key, buf)
+	fastNode, err := ndb.decodeFastNode(key, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
@@ -175,6 +307,14 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*FastNode, error) {
 
 // SaveNode saves a node to disk.
 func (ndb *nodeDB) SaveNode(node *Node) {
+	if err := ndb.saveNode(node); err != nil {
+		panic(err)
+	}
+}
+
+// saveNode is like SaveNode, but returns write errors and errors of Options.OnNodePersisted,
+// which is called with the encoded node once it has been written to the batch.
+func (ndb *nodeDB) saveNode(node *Node) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
@@ -185,20 +325,92 @@ func (ndb *nodeDB) SaveNode(node *Node) {
 		panic("Shouldn't be calling save on an already persisted node.")
 	}
 
-	// Save node bytes to db.
-	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-
-	if err := node.writeBytes(&buf); err != nil {
-		panic(err)
+	encoded, err := ndb.writeNode(ndb.batch, node)
+	if err != nil {
+		return err
 	}
-
-	if err := ndb.batch.Set(ndb.nodeKey(node.hash), buf.Bytes()); err != nil {
-		panic(err)
+	if ndb.opts.OnNodePersisted != nil {
+		if err := ndb.opts.OnNodePersisted(node.hash, encoded); err != nil {
+			return errors.Wrapf(err, "persisting node %X", node.hash)
+		}
 	}
 	debug("BATCH SAVE %X %p\n", node.hash, node)
 	node.persisted = true
 	ndb.nodeCache.Add(node)
+	return nil
+}
+
+// writeNode writes the node to the batch, storing its value separately if it is a leaf with a
+// value larger than Options.ExternalValueThreshold. Since the value hash is part of the leaf hash,
+// the value is then replaced by its hash, and marked by a trailing externalValueFlag. Leaf values
+// are encoded with Options.ValueCodec first, if any. It returns the encoded node written under the
+// node key.
+func (ndb *nodeDB) writeNode(batch dbm.Batch, node *Node) ([]byte, error) {
+	if ndb.opts.ValueCodec != nil && node.isLeaf() {
+		value, err := ndb.encodeValue(node.value)
+		if err != nil {
+			return nil, err
+		}
+		encoded := *node
+		encoded.value = value
+		node = &encoded
+	}
+	threshold := ndb.opts.ExternalValueThreshold
+	if threshold <= 0 || !node.isLeaf() || len(node.value) <= threshold {
+		encoded := ndb.codec.Encode(node)
+		return encoded, batch.Set(ndb.nodeKey(node.hash), encoded)
+	}
+
+	if err := batch.Set(externalValueKeyFormat.Key(node.hash), node.value); err != nil {
+		return nil, err
+	}
+	valueHash := sha256.Sum256(node.value)
+	ref := *node
+	ref.value = valueHash[:]
+	var buf bytes.Buffer
+	buf.Grow(ref.encodedSize() + 1)
+	if err := ref.writeBytes(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(externalValueFlag)
+	return buf.Bytes(), batch.Set(ndb.nodeKey(node.hash), buf.Bytes())
+}
+
+// makeNode decodes a node read from the database, and loads its value if it is stored externally
+// (see writeNode).
+func (ndb *nodeDB) makeNode(hash, buf []byte) (*Node, error) {
+	node, err := ndb.codec.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isLeaf() {
+		return node, nil
+	}
+	if ndb.opts.NodeCodec == nil && len(buf) == node.encodedSize()+1 && buf[len(buf)-1] == externalValueFlag {
+		value, err := ndb.dbGet(externalValueKeyFormat.Key(hash))
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, errors.Errorf("external value missing for node %X", hash)
+		}
+		node.value = value
+	}
+	if node.value, err = ndb.decodeValue(node.value); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// deleteNode deletes a node from the batch, along with its external value if any.
+func (ndb *nodeDB) deleteNode(batch dbm.Batch, hash []byte) error {
+	if err := batch.Delete(ndb.nodeKey(hash)); err != nil {
+		return err
+	}
+	if ndb.opts.ExternalValueThreshold > 0 {
+		return batch.Delete(externalValueKeyFormat.Key(hash))
+	}
+	return nil
 }
 
 // SaveNode saves a FastNode to disk and add to cache.
@@ -273,14 +485,12 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *FastNode, shouldAddToCache bool) e
 	}
 
 	// Save node bytes to db.
-	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-
-	if err := node.writeBytes(&buf); err != nil {
+	buf, err := ndb.encodeFastNode(node)
+	if err != nil {
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
-	if err := ndb.batch.Set(ndb.fastNodeKey(node.key), buf.Bytes()); err != nil {
+	if err := ndb.batch.Set(ndb.fastNodeKey(node.key), buf); err != nil {
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
@@ -289,10 +499,44 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *FastNode, shouldAddToCache bool) e
 	return nil
 }
 
+// encodeFastNode encodes a fast node for storage, encoding its value with Options.ValueCodec, if
+// any.
+func (ndb *nodeDB) encodeFastNode(node *FastNode) ([]byte, error) {
+	if ndb.opts.ValueCodec != nil {
+		value, err := ndb.encodeValue(node.value)
+		if err != nil {
+			return nil, err
+		}
+		node = NewFastNode(node.key, value, node.versionLastUpdatedAt)
+	}
+	var buf bytes.Buffer
+	buf.Grow(node.encodedSize())
+	if err := node.writeBytes(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFastNode decodes a fast node encoded by encodeFastNode.
+func (ndb *nodeDB) decodeFastNode(key, buf []byte) (*FastNode, error) {
+	node, err := DeserializeFastNode(key, buf)
+	if err != nil {
+		return nil, err
+	}
+	if node.value, err = ndb.decodeValue(node.value); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
 // Has checks if a hash exists in the database.
 func (ndb *nodeDB) Has(hash []byte) (bool, error) {
 	key := ndb.nodeKey(hash)
 
+	if value, ok := ndb.stagedGet(key); ok {
+		return value != nil, nil
+	}
+
 	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
 		exists, err := ldb.DB().Has(key, nil)
 		if err != nil {
@@ -310,52 +554,51 @@ func (ndb *nodeDB) Has(hash []byte) (bool, error) {
 
 // SaveBranch saves the given node and all of its descendants.
 // NOTE: This function clears leftNode/rigthNode recursively and
-// calls _hash() on the given node.
+// calls _hash() on the given node. If snapshot is given, the saved nodes are recorded in it, so
+// that a failed save can be undone by MutableTree.rollbackSave.
 // TODO refactor, maybe use hashWithCount() but provide a callback.
-func (ndb *nodeDB) SaveBranch(node *Node) []byte {
+func (ndb *nodeDB) SaveBranch(node *Node, snapshot *saveSnapshot) ([]byte, error) {
 	if node.persisted {
-		return node.hash
+		return node.hash, nil
 	}
 
+	var err error
 	if node.leftNode != nil {
-		node.leftHash = ndb.SaveBranch(node.leftNode)
+		if node.leftHash, err = ndb.SaveBranch(node.leftNode, snapshot); err != nil {
+			return nil, err
+		}
 	}
 	if node.rightNode != nil {
-		node.rightHash = ndb.SaveBranch(node.rightNode)
+		if node.rightHash, err = ndb.SaveBranch(node.rightNode, snapshot); err != nil {
+			return nil, err
+		}
 	}
 
-	node._hash()
-	ndb.SaveNode(node)
+	node._hash(ndb.opts.LeafHashSalt)
+	if err = ndb.saveNode(node); err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		snapshot.saved = append(snapshot.saved, savedNode{node: node, leftNode: node.leftNode, rightNode: node.rightNode})
+	}
 
 	// resetBatch only working on generate a genesis block
-	if node.version <= genesisVersion {
-		ndb.resetBatch()
+	if node.version <= genesisVersion && !ndb.opts.DeferCommit {
+		if err = ndb.resetBatch(); err != nil {
+			return nil, err
+		}
 	}
 	node.leftNode = nil
 	node.rightNode = nil
 
-	return node.hash
+	return node.hash, nil
 }
 
-// resetBatch reset the db batch, keep low memory used
+// resetBatch reset the db batch, keep low memory used. Failed writes are retried like Commit.
 func (ndb *nodeDB) resetBatch() error {
-	var err error
-	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
-	} else {
-		err = ndb.batch.Write()
-	}
-	if err != nil {
-		return err
-	}
-	err = ndb.batch.Close()
-	if err != nil {
-		return err
-	}
-
-	ndb.batch = ndb.db.NewBatch()
-
-	return nil
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.writeBatch()
 }
 
 // DeleteVersion deletes a tree version from disk.
@@ -418,7 +661,7 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 			if err = ndb.batch.Delete(key); err != nil {
 				return err
 			}
-			if err = ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			if err = ndb.deleteNode(ndb.batch, hash); err != nil {
 				return err
 			}
 			ndb.nodeCache.Remove(hash)
@@ -446,6 +689,31 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 		return err
 	}
 
+	err = ndb.deleteVersionMetadataRange(version, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+
+	// Trim deferred deletions to the remaining versions, so that versions saved again after the
+	// rollback aren't deleted when they are due.
+	err = ndb.traversePrefix(deferredDeletionKeyFormat.Key(), func(k, v []byte) error {
+		var due, from, to int64
+		deferredDeletionKeyFormat.Scan(k, &due, &from, &to)
+		if to <= version {
+			return nil
+		}
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+		if from < version {
+			return ndb.batch.Set(deferredDeletionKeyFormat.Key(due, from, version), []byte{})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	// Delete fast node entries
 	err = ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
 		key := keyWithPrefix[1:]
@@ -507,10 +775,9 @@ func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
 				return err
 			}
 			if from > predecessor {
-				if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-					panic(err)
+				if err := ndb.deleteOrphanedNode(hash, version); err != nil {
+					return err
 				}
-				ndb.nodeCache.Remove(hash)
 			} else {
 				ndb.saveOrphan(hash, from, predecessor)
 			}
@@ -532,9 +799,286 @@ func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
 	if err != nil {
 		return err
 	}
+	return ndb.deleteVersionMetadataRange(fromVersion, toVersion)
+}
+
+// saveVersionMetadata saves the metadata of a version.
+func (ndb *nodeDB) saveVersionMetadata(version int64, metadata []byte) error {
+	return ndb.batch.Set(versionMetadataKeyFormat.Key(version), metadata)
+}
+
+// getVersionMetadata returns the metadata of a version, or nil if it has none.
+func (ndb *nodeDB) getVersionMetadata(version int64) ([]byte, error) {
+	return ndb.dbGet(versionMetadataKeyFormat.Key(version))
+}
+
+// deleteVersionMetadataRange deletes the metadata of versions from an interval (not inclusive).
+func (ndb *nodeDB) deleteVersionMetadataRange(fromVersion, toVersion int64) error {
+	return ndb.traverseRange(versionMetadataKeyFormat.Key(fromVersion), versionMetadataKeyFormat.Key(toVersion), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+}
+
+// deferDeleteVersionsRange schedules the deletion of versions from an interval (not inclusive)
+// once Options.OrphanGracePeriodVersions newer versions have been saved.
+func (ndb *nodeDB) deferDeleteVersionsRange(fromVersion, toVersion int64) error {
+	if fromVersion >= toVersion {
+		return errors.New("toVersion must be greater than fromVersion")
+	}
+	if toVersion == 0 {
+		return errors.New("toVersion must be greater than 0")
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	latest := ndb.getLatestVersion()
+	if latest < toVersion {
+		return errors.Errorf("cannot delete latest saved version (%d)", latest)
+	}
+
+	due := latest + int64(ndb.opts.OrphanGracePeriodVersions)
+	return ndb.batch.Set(deferredDeletionKeyFormat.Key(due, fromVersion, toVersion), []byte{})
+}
+
+// deleteDueVersions deletes the deferred version ranges that are due at or before the given
+// version, calling fn for each deleted range. Ranges with active readers are left pending.
+func (ndb *nodeDB) deleteDueVersions(version int64, fn func(fromVersion, toVersion int64)) error {
+	type deferredDeletion struct {
+		key      []byte
+		from, to int64
+	}
+	deletions := []deferredDeletion{}
+	err := ndb.traverseRange(deferredDeletionKeyFormat.Key(), deferredDeletionKeyFormat.Key(version+1), func(k, v []byte) error {
+		var due, from, to int64
+		deferredDeletionKeyFormat.Scan(k, &due, &from, &to)
+		deletions = append(deletions, deferredDeletion{key: cp(k), from: from, to: to})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deletions {
+		if ndb.hasVersionReaders(d.from, d.to) {
+			ndb.logDebug("postponing deletion of versions with active readers", "from", d.from, "to", d.to)
+			continue
+		}
+		if err := ndb.DeleteVersionsRange(d.from, d.to); err != nil {
+			return err
+		}
+		ndb.mtx.Lock()
+		err := ndb.batch.Delete(d.key)
+		ndb.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		fn(d.from, d.to)
+	}
 	return nil
 }
 
+// hasVersionReaders returns whether any version in the interval (not inclusive) has active readers.
+func (ndb *nodeDB) hasVersionReaders(fromVersion, toVersion int64) bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for v, r := range ndb.versionReaders {
+		if v >= fromVersion && v < toVersion && r > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRootsInRange returns whether any version in an interval (not inclusive) has a root.
+func (ndb *nodeDB) hasRootsInRange(fromVersion, toVersion int64) (bool, error) {
+	itr, err := ndb.db.Iterator(rootKeyFormat.Key(fromVersion), rootKeyFormat.Key(toVersion))
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	return itr.Valid(), itr.Error()
+}
+
+// countVersions returns the number of versions with a root in the database.
+func (ndb *nodeDB) countVersions() (int, error) {
+	count := 0
+	err := ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		var version int64
+		rootKeyFormat.Scan(k, &version)
+		if !ndb.hidesVersion(version) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// versionRange returns the first and last versions with a root in the database, or 0 if there
+// are none.
+func (ndb *nodeDB) versionRange() (first, last int64, err error) {
+	for _, reverse := range []bool{false, true} {
+		var itr dbm.Iterator
+		if reverse {
+			itr, err = ndb.db.ReverseIterator(rootKeyFormat.Key(1), rootKeyFormat.Key(ndb.versionLimit()))
+		} else {
+			itr, err = ndb.db.Iterator(rootKeyFormat.Key(1), rootKeyFormat.Key(ndb.versionLimit()))
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if !itr.Valid() {
+			err = itr.Error()
+			itr.Close()
+			return 0, 0, err
+		}
+		if reverse {
+			rootKeyFormat.Scan(itr.Key(), &last)
+		} else {
+			rootKeyFormat.Scan(itr.Key(), &first)
+		}
+		itr.Close()
+	}
+	return first, last, nil
+}
+
+// versionSize returns the size of the database entries of the nodes in a subtree which were
+// created at the given version, and of the fast nodes of its leaves. Nodes of earlier versions
+// only have children of earlier versions, so they are not traversed.
+func (ndb *nodeDB) versionSize(node *Node, version int64) (int64, error) {
+	if node.version != version {
+		return 0, nil
+	}
+	batch := &sizeBatch{}
+	if _, err := ndb.writeNode(batch, node); err != nil {
+		return 0, err
+	}
+	if node.isLeaf() {
+		encoded, err := ndb.encodeFastNode(NewFastNode(node.key, node.value, version))
+		if err != nil {
+			return 0, err
+		}
+		return batch.size + int64(len(ndb.fastNodeKey(node.key))+len(encoded)), nil
+	}
+	for _, hash := range [][]byte{node.leftHash, node.rightHash} {
+		size, err := ndb.versionSize(ndb.GetNode(hash), version)
+		if err != nil {
+			return 0, err
+		}
+		batch.size += size
+	}
+	return batch.size, nil
+}
+
+// sizeBatch is a batch which only sums the sizes of the keys and values set, e.g. to compute the
+// size of the database entries written by writeNode.
+type sizeBatch struct {
+	size int64
+}
+
+var _ dbm.Batch = (*sizeBatch)(nil)
+
+// Set implements dbm.Batch.
+func (b *sizeBatch) Set(key, value []byte) error {
+	b.size += int64(len(key) + len(value))
+	return nil
+}
+
+// Delete implements dbm.Batch.
+func (b *sizeBatch) Delete(key []byte) error {
+	return nil
+}
+
+// Write implements dbm.Batch.
+func (b *sizeBatch) Write() error {
+	return nil
+}
+
+// WriteSync implements dbm.Batch.
+func (b *sizeBatch) WriteSync() error {
+	return nil
+}
+
+// Close implements dbm.Batch.
+func (b *sizeBatch) Close() error {
+	return nil
+}
+
+// copyTo copies all tree data to the empty database dst, committing every maxBatchSize writes so
+// that the data isn't held in memory at once.
+func (ndb *nodeDB) copyTo(dst dbm.DB) error {
+	itr, err := dst.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	empty := !itr.Valid()
+	itr.Close()
+	if !empty {
+		return errors.New("destination database is not empty")
+	}
+
+	batch := dst.NewBatch()
+	defer func() { batch.Close() }()
+	writes := 0
+	formats := []*KeyFormat{
+		nodeKeyFormat, orphanKeyFormat, fastKeyFormat, metadataKeyFormat, rootKeyFormat,
+		deferredDeletionKeyFormat, externalValueKeyFormat, versionMetadataKeyFormat,
+	}
+	for _, format := range formats {
+		err = ndb.traversePrefix(format.Key(), func(k, v []byte) error {
+			if err := batch.Set(cp(k), cp(v)); err != nil {
+				return err
+			}
+			writes++
+			if writes%maxBatchSize != 0 {
+				return nil
+			}
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Close()
+			batch = dst.NewBatch()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return batch.WriteSync()
+}
+
+// rollbackSave discards the batch after a failed save, and restores the state modified while
+// staging it: the latest version, the storage version, and the cached nodes and fast nodes which
+// were saved by it.
+func (ndb *nodeDB) rollbackSave(latestVersion int64, storageVersion string, nodes []*Node, fastNodeKeys []string) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	err := ndb.batch.Close()
+	ndb.batch = newBatch(ndb.db, ndb.opts)
+	ndb.resetLatestVersion(latestVersion)
+	ndb.storageVersion = storageVersion
+	for _, node := range nodes {
+		ndb.nodeCache.Remove(node.hash)
+	}
+	for _, key := range fastNodeKeys {
+		ndb.fastNodeCache.Remove([]byte(key))
+	}
+	return err
+}
+
+// discardBatch discards all uncommitted writes.
+func (ndb *nodeDB) discardBatch() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	err := ndb.batch.Close()
+	ndb.batch = newBatch(ndb.db, ndb.opts)
+	return err
+}
+
 func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -565,7 +1109,7 @@ func (ndb *nodeDB) deleteNodesFrom(version int64, hash []byte) error {
 	}
 
 	if node.version >= version {
-		if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+		if err := ndb.deleteNode(ndb.batch, hash); err != nil {
 			return err
 		}
 
@@ -578,15 +1122,72 @@ func (ndb *nodeDB) deleteNodesFrom(version int64, hash []byte) error {
 // Saves orphaned nodes to disk under a special prefix.
 // version: the new version being saved.
 // orphans: the orphan nodes created since version-1
-func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) {
+//
+// Large orphan sets are flushed to the database in chunks if Options.OrphanFlushThreshold is set,
+// to bound the batch size. If the version then fails to save, rollbackOrphans must be called to
+// delete them again.
+func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	flush := ndb.flushesOrphans(orphans)
 	toVersion := ndb.getPreviousVersion(version)
+	saved := 0
 	for hash, fromVersion := range orphans {
 		debug("SAVEORPHAN %v-%v %X\n", fromVersion, toVersion, hash)
 		ndb.saveOrphan([]byte(hash), fromVersion, toVersion)
+		saved++
+		if flush && saved%ndb.opts.OrphanFlushThreshold == 0 {
+			if err := ndb.writeBatch(); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// flushesOrphans returns whether SaveOrphans flushes the orphans to the database in chunks, see
+// Options.OrphanFlushThreshold. This isn't done with Options.DeferCommit, where nothing is written
+// until FlushToDisk.
+func (ndb *nodeDB) flushesOrphans(orphans map[string]int64) bool {
+	threshold := ndb.opts.OrphanFlushThreshold
+	return threshold > 0 && !ndb.opts.DeferCommit && len(orphans) > threshold
+}
+
+// rollbackOrphans deletes the orphans saved by SaveOrphans for a version which then failed to
+// save, if they were flushed to the database in chunks. The flushed orphans are deleted with a
+// separate batch, while the remaining ones are deleted from the uncommitted batch, which is kept
+// along with the other writes of the failed save. Otherwise, it does nothing.
+func (ndb *nodeDB) rollbackOrphans(version int64, orphans map[string]int64) error {
+	if !ndb.flushesOrphans(orphans) {
+		return nil
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	batch := ndb.db.NewBatch()
+	defer func() { batch.Close() }()
+	toVersion := ndb.getPreviousVersion(version)
+	deleted := 0
+	for hash, fromVersion := range orphans {
+		key := ndb.orphanKey(fromVersion, toVersion, []byte(hash))
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+		deleted++
+		if deleted%ndb.opts.OrphanFlushThreshold == 0 {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Close()
+			batch = ndb.db.NewBatch()
+		}
+	}
+	return batch.WriteSync()
 }
 
 // Saves a single orphan to disk.
@@ -627,10 +1228,9 @@ func (ndb *nodeDB) deleteOrphans(version int64) error {
 		// moving its endpoint to the previous version.
 		if predecessor < fromVersion || fromVersion == toVersion {
 			debug("DELETE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
-			if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			if err := ndb.deleteOrphanedNode(hash, version); err != nil {
 				return err
 			}
-			ndb.nodeCache.Remove(hash)
 		} else {
 			debug("MOVE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
 			ndb.saveOrphan(hash, fromVersion, predecessor)
@@ -639,6 +1239,21 @@ func (ndb *nodeDB) deleteOrphans(version int64) error {
 	})
 }
 
+// deleteOrphanedNode deletes an orphaned node of the given version being deleted from disk and
+// cache, after notifying Options.OnOrphanDeleted if set.
+func (ndb *nodeDB) deleteOrphanedNode(hash []byte, version int64) error {
+	if ndb.opts.OnOrphanDeleted != nil {
+		if err := ndb.opts.OnOrphanDeleted(hash, version); err != nil {
+			return errors.Wrapf(err, "OnOrphanDeleted failed for node %X", hash)
+		}
+	}
+	if err := ndb.deleteNode(ndb.batch, hash); err != nil {
+		return err
+	}
+	ndb.nodeCache.Remove(hash)
+	return nil
+}
+
 func (ndb *nodeDB) nodeKey(hash []byte) []byte {
 	return nodeKeyFormat.KeyBytes(hash)
 }
@@ -656,20 +1271,53 @@ func (ndb *nodeDB) rootKey(version int64) []byte {
 }
 
 func (ndb *nodeDB) getLatestVersion() int64 {
-	if ndb.latestVersion == 0 {
-		ndb.latestVersion = ndb.getPreviousVersion(1<<63 - 1)
+	latestVersion := atomic.LoadInt64(&ndb.latestVersion)
+	if latestVersion == 0 {
+		latestVersion = ndb.getPreviousVersion(ndb.versionLimit())
+		atomic.StoreInt64(&ndb.latestVersion, latestVersion)
+	}
+	return latestVersion
+}
+
+// nodeCacheUtilization returns the number of nodes in the node cache, and its capacity.
+func (ndb *nodeDB) nodeCacheUtilization() (entries, capacity int) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.nodeCache.Len(), ndb.nodeCache.Cap()
+}
+
+// readLatestVersion returns the latest saved version like getLatestVersion, but returns
+// database errors instead of panicking, and does not cache the version.
+func (ndb *nodeDB) readLatestVersion() (int64, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if latestVersion := atomic.LoadInt64(&ndb.latestVersion); latestVersion > 0 {
+		return latestVersion, nil
+	}
+
+	itr, err := ndb.db.ReverseIterator(rootKeyFormat.Key(1), rootKeyFormat.Key(ndb.versionLimit()))
+	if err != nil {
+		return 0, err
 	}
-	return ndb.latestVersion
+	defer itr.Close()
+
+	if itr.Valid() {
+		var version int64
+		rootKeyFormat.Scan(itr.Key(), &version)
+		return version, nil
+	}
+	return 0, itr.Error()
 }
 
 func (ndb *nodeDB) updateLatestVersion(version int64) {
-	if ndb.latestVersion < version {
-		ndb.latestVersion = version
+	if atomic.LoadInt64(&ndb.latestVersion) < version {
+		atomic.StoreInt64(&ndb.latestVersion, version)
 	}
 }
 
 func (ndb *nodeDB) resetLatestVersion(version int64) {
-	ndb.latestVersion = version
+	atomic.StoreInt64(&ndb.latestVersion, version)
 }
 
 func (ndb *nodeDB) getPreviousVersion(version int64) int64 {
@@ -685,15 +1333,31 @@ func (ndb *nodeDB) getPreviousVersion(version int64) int64 {
 	pversion := int64(-1)
 	for ; itr.Valid(); itr.Next() {
 		k := itr.Key()
+		if value, ok := ndb.stagedGet(k); ok && value == nil {
+			continue
+		}
 		rootKeyFormat.Scan(k, &pversion)
-		return pversion
+		return ndb.getPreviousStagedVersion(version, pversion)
 	}
 
 	if err := itr.Error(); err != nil {
 		panic(err)
 	}
 
-	return 0
+	return ndb.getPreviousStagedVersion(version, 0)
+}
+
+// getPreviousStagedVersion returns the latest version staged by Options.DeferCommit before the
+// given version, if it is after pversion. Otherwise, pversion is returned.
+func (ndb *nodeDB) getPreviousStagedVersion(version int64, pversion int64) int64 {
+	if b, ok := ndb.batch.(*stagedBatch); ok {
+		for v, exists := range b.roots {
+			if exists && v < version && v > pversion {
+				pversion = v
+			}
+		}
+	}
+	return pversion
 }
 
 // deleteRoot deletes the root entry from disk, but not the node it points to.
@@ -704,6 +1368,9 @@ func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) error {
 	if err := ndb.batch.Delete(ndb.rootKey(version)); err != nil {
 		return err
 	}
+	if err := ndb.batch.Delete(versionMetadataKeyFormat.Key(version)); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -793,41 +1460,370 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (dbm.Itera
 func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
+	return ndb.writeBatch()
+}
 
+// writeBatch writes the batch to the database like Commit, for callers holding the mutex. Failed
+// writes are retried as configured by Options.CommitRetry.
+func (ndb *nodeDB) writeBatch() error {
+	if ndb.opts.VersionCeiling > 0 {
+		return errVersionCeiling
+	}
 	var err error
-	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
-	} else {
-		err = ndb.batch.Write()
+	backoff := ndb.opts.CommitRetry.Backoff
+	for attempt := 1; ; attempt++ {
+		if ndb.opts.Sync {
+			err = ndb.batch.WriteSync()
+		} else {
+			err = ndb.batch.Write()
+		}
+		if err == nil || attempt >= ndb.opts.CommitRetry.Attempts {
+			break
+		}
+		ndb.logDebug("retrying failed batch write", "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 	if err != nil {
 		return errors.Wrap(err, "failed to write batch")
 	}
 
 	ndb.batch.Close()
-	ndb.batch = ndb.db.NewBatch()
+	ndb.batch = newBatch(ndb.db, ndb.opts)
 
 	return nil
 }
 
 func (ndb *nodeDB) HasRoot(version int64) (bool, error) {
+	if ndb.hidesVersion(version) {
+		return false, nil
+	}
+	if value, ok := ndb.stagedGet(ndb.rootKey(version)); ok {
+		return value != nil, nil
+	}
 	return ndb.db.Has(ndb.rootKey(version))
 }
 
 func (ndb *nodeDB) getRoot(version int64) ([]byte, error) {
-	return ndb.db.Get(ndb.rootKey(version))
+	if ndb.hidesVersion(version) {
+		return nil, nil
+	}
+	return ndb.dbGet(ndb.rootKey(version))
+}
+
+// hidesVersion returns whether the version is above Options.VersionCeiling, and must be treated as
+// if it doesn't exist.
+func (ndb *nodeDB) hidesVersion(version int64) bool {
+	return ndb.opts.VersionCeiling > 0 && version > ndb.opts.VersionCeiling
+}
+
+// versionLimit returns the exclusive upper bound of the versions which are not hidden by
+// Options.VersionCeiling.
+func (ndb *nodeDB) versionLimit() int64 {
+	if ndb.opts.VersionCeiling > 0 && ndb.opts.VersionCeiling < math.MaxInt64 {
+		return ndb.opts.VersionCeiling + 1
+	}
+	return math.MaxInt64
+}
+
+// errVersionCeiling is returned when attempting to write to a tree opened with
+// Options.VersionCeiling.
+var errVersionCeiling = errors.New("tree is read-only, since it was opened with a version ceiling")
+
+// stagedBatch is a batch which also records its writes, so that they can be read back before the
+// batch is written. It is used when Options.DeferCommit is set.
+type stagedBatch struct {
+	dbm.Batch
+	writes map[string][]byte // deleted keys have nil values
+	roots  map[int64]bool    // versions of written roots, false if deleted
+}
+
+// newBatch creates a new batch for the database, which stages its writes if Options.DeferCommit
+// is set, and is split into sub-batches if Options.MaxCommitBatchEntries is set.
+func newBatch(db dbm.DB, opts Options) dbm.Batch {
+	var batch dbm.Batch
+	if opts.MaxCommitBatchEntries > 0 {
+		batch = &splitBatch{db: db, maxEntries: opts.MaxCommitBatchEntries}
+	} else {
+		batch = db.NewBatch()
+	}
+	if opts.DeferCommit {
+		return &stagedBatch{Batch: batch, writes: map[string][]byte{}, roots: map[int64]bool{}}
+	}
+	return batch
+}
+
+// Set implements dbm.Batch.
+func (b *stagedBatch) Set(key, value []byte) error {
+	if err := b.Batch.Set(key, value); err != nil {
+		return err
+	}
+	b.writes[string(key)] = cp(value)
+	b.stageRoot(key, true)
+	return nil
+}
+
+// Delete implements dbm.Batch.
+func (b *stagedBatch) Delete(key []byte) error {
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	b.writes[string(key)] = nil
+	b.stageRoot(key, false)
+	return nil
+}
+
+func (b *stagedBatch) stageRoot(key []byte, exists bool) {
+	if len(key) == 1+int64Size && string(key[:1]) == rootKeyFormat.Prefix() {
+		var version int64
+		rootKeyFormat.Scan(key, &version)
+		b.roots[version] = exists
+	}
+}
+
+// splitBatch is a batch which is split into sub-batches of at most maxEntries sets and deletes,
+// which are written sequentially in the order of the writes. It is used when
+// Options.MaxCommitBatchEntries is set.
+type splitBatch struct {
+	db         dbm.DB
+	maxEntries int
+	batches    []dbm.Batch // sub-batches which haven't been written yet
+	entries    int         // entries in the last sub-batch
+}
+
+var _ dbm.Batch = (*splitBatch)(nil)
+
+// current returns the sub-batch to add an entry to, starting a new one if the last one is full.
+func (b *splitBatch) current() dbm.Batch {
+	if len(b.batches) == 0 || b.entries >= b.maxEntries {
+		b.batches = append(b.batches, b.db.NewBatch())
+		b.entries = 0
+	}
+	b.entries++
+	return b.batches[len(b.batches)-1]
+}
+
+// Set implements dbm.Batch.
+func (b *splitBatch) Set(key, value []byte) error {
+	return b.current().Set(key, value)
+}
+
+// Delete implements dbm.Batch.
+func (b *splitBatch) Delete(key []byte) error {
+	return b.current().Delete(key)
+}
+
+// Write implements dbm.Batch.
+func (b *splitBatch) Write() error {
+	return b.write(dbm.Batch.Write)
+}
+
+// WriteSync implements dbm.Batch.
+func (b *splitBatch) WriteSync() error {
+	return b.write(dbm.Batch.WriteSync)
+}
+
+// write writes the sub-batches in order. Written sub-batches are discarded, so that writing again
+// after a failure resumes with the sub-batch that failed.
+func (b *splitBatch) write(write func(dbm.Batch) error) error {
+	for len(b.batches) > 0 {
+		if err := write(b.batches[0]); err != nil {
+			return err
+		}
+		if err := b.batches[0].Close(); err != nil {
+			return err
+		}
+		b.batches = b.batches[1:]
+	}
+	return nil
+}
+
+// Close implements dbm.Batch.
+func (b *splitBatch) Close() error {
+	var err error
+	for _, batch := range b.batches {
+		if closeErr := batch.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	b.batches = nil
+	return err
+}
+
+// stagedGet returns the value of a key written to the uncommitted batch, if any. A nil value
+// means the key was deleted.
+func (ndb *nodeDB) stagedGet(key []byte) ([]byte, bool) {
+	if b, ok := ndb.batch.(*stagedBatch); ok {
+		value, ok := b.writes[string(key)]
+		return value, ok
+	}
+	return nil, false
+}
+
+// dbGet gets a key from the database, including writes staged by Options.DeferCommit.
+func (ndb *nodeDB) dbGet(key []byte) ([]byte, error) {
+	if value, ok := ndb.stagedGet(key); ok {
+		return value, nil
+	}
+	return ndb.db.Get(key)
+}
+
+// hasStagedWrites returns whether there are writes staged by Options.DeferCommit which have not
+// been committed yet.
+func (ndb *nodeDB) hasStagedWrites() bool {
+	b, ok := ndb.batch.(*stagedBatch)
+	return ok && len(b.writes) > 0
 }
 
 func (ndb *nodeDB) getRoots() (map[int64][]byte, error) {
 	roots := map[int64][]byte{}
 
-	ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+	err := ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
 		var version int64
 		rootKeyFormat.Scan(k, &version)
-		roots[version] = v
+		if !ndb.hidesVersion(version) {
+			roots[version] = cp(v)
+		}
 		return nil
 	})
-	return roots, nil
+	return roots, err
+}
+
+// deleteUnreachableNodes deletes the nodes which are not reachable from any saved version,
+// along with their orphan entries, and returns the number of deleted nodes. Deletions are
+// committed periodically, and only unreachable data is deleted, so it is safe to interrupt.
+//
+// A node is part of a contiguous range of versions, from the version it was created in until it
+// is orphaned, so it is reachable if and only if it is part of the first saved version at or
+// after its own version. It is then on the path to its key in that version, so each node can be
+// checked with a single descent, without keeping the set of reachable nodes in memory. The
+// database is scanned in chunks, which are checked and deleted before the next one is read.
+func (ndb *nodeDB) deleteUnreachableNodes() (int, error) {
+	roots, err := ndb.getRoots()
+	if err != nil {
+		return 0, err
+	}
+	versions := make([]int64, 0, len(roots))
+	for version := range roots {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	deleted := 0
+	err = ndb.sweepPrefix(nodeKeyFormat.Key(), func(k, v []byte) (bool, error) {
+		var hash []byte
+		nodeKeyFormat.Scan(k, &hash)
+		node, err := ndb.codec.Decode(v)
+		if err != nil {
+			return false, errors.Wrapf(err, "decoding node %X", hash)
+		}
+		node.hash = hash
+		i := sort.Search(len(versions), func(i int) bool { return versions[i] >= node.version })
+		if i < len(versions) {
+			reachable, err := ndb.onPath(roots[versions[i]], node)
+			if err != nil || reachable {
+				return false, err
+			}
+		}
+		ndb.nodeCache.Remove(hash)
+		if ndb.opts.ExternalValueThreshold > 0 {
+			if err := ndb.batch.Delete(externalValueKeyFormat.Key(hash)); err != nil {
+				return false, err
+			}
+		}
+		deleted++
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The nodes of stale orphan entries have now been deleted.
+	err = ndb.sweepPrefix(orphanKeyFormat.Key(), func(k, v []byte) (bool, error) {
+		exists, err := ndb.db.Has(ndb.nodeKey(v))
+		return !exists, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// onPath returns whether the node is on the path to its key in the tree with the given root.
+// Inner node keys are the smallest keys of their right subtrees, so the descent for the key of an
+// inner node passes through it. Nodes are read without caching them.
+func (ndb *nodeDB) onPath(rootHash []byte, node *Node) (bool, error) {
+	tree := &ImmutableTree{ndb: ndb}
+	hash := rootHash
+	for len(hash) > 0 {
+		if bytes.Equal(hash, node.hash) {
+			return true, nil
+		}
+		current, err := ndb.getNodeUncached(hash)
+		if err != nil {
+			return false, err
+		}
+		// Children are never newer than their parents.
+		if current.isLeaf() || current.version < node.version {
+			return false, nil
+		}
+		if tree.compareKeys(node.key, current.key) < 0 {
+			hash = current.leftHash
+		} else {
+			hash = current.rightHash
+		}
+	}
+	return false, nil
+}
+
+// sweepPrefix calls fn for the entries with the given prefix, and deletes those for which it
+// returns true. The database can't be modified while iterating over it, so the entries are read in
+// chunks of maxBatchSize, and the deletions of each chunk are committed before the next is read.
+func (ndb *nodeDB) sweepPrefix(prefix []byte, fn func(k, v []byte) (bool, error)) error {
+	start, end := prefix, cpIncr(prefix)
+	for {
+		keys, values := make([][]byte, 0, maxBatchSize), make([][]byte, 0, maxBatchSize)
+		err := ndb.traverseRange(start, end, func(k, v []byte) error {
+			keys = append(keys, cp(k))
+			values = append(values, cp(v))
+			if len(keys) == maxBatchSize {
+				return errSweepChunk
+			}
+			return nil
+		})
+		if err != nil && err != errSweepChunk {
+			return err
+		}
+		for i, key := range keys {
+			remove, err := fn(key, values[i])
+			if err != nil {
+				return err
+			}
+			if remove {
+				if err := ndb.batch.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		if err := ndb.Commit(); err != nil {
+			return err
+		}
+		if len(keys) < maxBatchSize {
+			return nil
+		}
+		start = append(keys[len(keys)-1], 0)
+	}
+}
+
+// errSweepChunk stops the traversal of sweepPrefix once a chunk has been read.
+var errSweepChunk = errors.New("sweep chunk complete")
+
+// compactDB compacts the underlying database, if supported by the backend.
+func (ndb *nodeDB) compactDB() error {
+	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
+		return ldb.DB().CompactRange(util.Range{})
+	}
+	return nil
 }
 
 // SaveRoot creates an entry on disk for the given root, so that it can be
@@ -848,10 +1844,10 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	// We allow the initial version to be arbitrary
+	// We allow the initial version to be arbitrary, and gaps between subsequent versions
 	latest := ndb.getLatestVersion()
-	if latest > 0 && version != latest+1 {
-		return fmt.Errorf("must save consecutive versions; expected %d, got %d", latest+1, version)
+	if latest > 0 && version <= latest {
+		return fmt.Errorf("must save increasing versions; expected greater than %d, got %d", latest, version)
 	}
 
 	if err := ndb.batch.Set(ndb.rootKey(version), hash); err != nil {
@@ -877,6 +1873,23 @@ func (ndb *nodeDB) decrVersionReaders(version int64) {
 	}
 }
 
+// pinnedVersions returns the versions with active readers, in ascending order.
+func (ndb *nodeDB) pinnedVersions() []int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	versions := make([]int64, 0, len(ndb.versionReaders))
+	for version, readers := range ndb.versionReaders {
+		if readers > 0 {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+	return versions
+}
+
 // Utility and test functions
 
 func (ndb *nodeDB) leafNodes() ([]*Node, error) {
@@ -951,11 +1964,13 @@ func (ndb *nodeDB) traverseNodes(fn func(hash []byte, node *Node) error) error {
 	nodes := []*Node{}
 
 	err := ndb.traversePrefix(nodeKeyFormat.Key(), func(key, value []byte) error {
-		node, err := MakeNode(value)
+		var hash []byte
+		nodeKeyFormat.Scan(key, &hash)
+		node, err := ndb.makeNode(hash, value)
 		if err != nil {
 			return err
 		}
-		nodeKeyFormat.Scan(key, &node.hash)
+		node.hash = hash
 		nodes = append(nodes, node)
 		return nil
 	})
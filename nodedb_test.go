@@ -248,3 +248,171 @@ func makeHashes(b *testing.B, seed int64) [][]byte {
 	b.StartTimer()
 	return hashes
 }
+
+func TestNodeDB_OnOrphanDeleted(t *testing.T) {
+	deleted := map[string]int64{}
+	var failure error
+	opts := &Options{
+		OnOrphanDeleted: func(hash []byte, version int64) error {
+			if failure != nil {
+				return failure
+			}
+			_, ok := deleted[string(hash)]
+			require.False(t, ok, "node %X deleted twice", hash)
+			deleted[string(hash)] = version
+			return nil
+		},
+	}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts)
+	require.NoError(t, err)
+
+	for v := 0; v < 6; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(strconv.Itoa(rand.Intn(50))), []byte(strconv.Itoa(v)))
+		}
+		tree.Remove([]byte(strconv.Itoa(rand.Intn(50))))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	countNodes := func() int {
+		nodes, err := tree.ndb.nodes()
+		require.NoError(t, err)
+		return len(nodes)
+	}
+
+	before := countNodes()
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NotEmpty(t, deleted)
+	require.Equal(t, before-len(deleted), countNodes())
+	for hash, version := range deleted {
+		require.EqualValues(t, 1, version, "node %X", hash)
+	}
+
+	// A failing callback aborts the deletion without writing anything.
+	failure = errors.New("index unavailable")
+	before, invocations := countNodes(), len(deleted)
+	require.ErrorIs(t, tree.DeleteVersionsRange(2, 5), failure)
+	require.ErrorIs(t, tree.DeleteVersion(2), failure)
+	require.Equal(t, before, countNodes())
+	require.Equal(t, []int{2, 3, 4, 5, 6}, tree.AvailableVersions())
+
+	failure = nil
+	require.NoError(t, tree.DeleteVersionsRange(2, 5))
+	require.Greater(t, len(deleted), invocations)
+	require.Equal(t, before-(len(deleted)-invocations), countNodes())
+
+	for hash, version := range deleted {
+		require.Greater(t, version, int64(0), "node %X", hash)
+		require.Less(t, version, int64(5), "node %X", hash)
+	}
+}
+
+// batchRecordingDB records the number of orphans in each batch written to the database, and can
+// fail writes of batches saving a root.
+type batchRecordingDB struct {
+	db.DB
+	orphanCounts []int
+	failRoots    bool
+}
+
+func (d *batchRecordingDB) NewBatch() db.Batch {
+	return &recordingBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type recordingBatch struct {
+	db.Batch
+	db      *batchRecordingDB
+	orphans int
+	root    bool
+}
+
+func (b *recordingBatch) Set(key, value []byte) error {
+	switch key[0] {
+	case orphanKeyFormat.Prefix()[0]:
+		b.orphans++
+	case rootKeyFormat.Prefix()[0]:
+		b.root = true
+	}
+	return b.Batch.Set(key, value)
+}
+
+func (b *recordingBatch) Write() error {
+	if b.db.failRoots && b.root {
+		return errors.New("write failed")
+	}
+	b.db.orphanCounts = append(b.db.orphanCounts, b.orphans)
+	return b.Batch.Write()
+}
+
+func (b *recordingBatch) WriteSync() error {
+	return b.Write()
+}
+
+func orphanEntries(t *testing.T, memDB db.DB) map[string]string {
+	entries := map[string]string{}
+	for k, v := range dumpDB(t, memDB) {
+		if k[0] == orphanKeyFormat.Prefix()[0] {
+			entries[k] = v
+		}
+	}
+	return entries
+}
+
+func TestNodeDB_SaveOrphansChunked(t *testing.T) {
+	const keys = maxBatchSize
+	newTree := func(memDB db.DB, opts *Options) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+		require.NoError(t, err)
+		for i := 0; i < keys; i++ {
+			key := []byte(strconv.Itoa(i))
+			tree.Set(key, key)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.NoError(t, tree.FlushToDisk())
+		for i := 0; i < keys; i++ {
+			tree.Remove([]byte(strconv.Itoa(i)))
+		}
+		require.Len(t, tree.orphans, 2*keys-1)
+		return tree
+	}
+
+	// By default, the orphans are written in a single batch with the rest of the commit.
+	recordingDB := &batchRecordingDB{DB: db.NewMemDB()}
+	tree := newTree(recordingDB, nil)
+	recordingDB.orphanCounts = nil
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{2*keys - 1}, recordingDB.orphanCounts)
+
+	// With a threshold, the orphans are written in chunks, and identical to those written in a
+	// single batch with Options.DeferCommit.
+	opts := &Options{OrphanFlushThreshold: maxBatchSize}
+	recordingDB = &batchRecordingDB{DB: db.NewMemDB()}
+	tree = newTree(recordingDB, opts)
+	deferredDB := db.NewMemDB()
+	deferred := newTree(deferredDB, &Options{DeferCommit: true, OrphanFlushThreshold: maxBatchSize})
+
+	recordingDB.orphanCounts = nil
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = deferred.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, deferred.FlushToDisk())
+
+	require.Len(t, orphanEntries(t, recordingDB), 2*keys-1)
+	require.Equal(t, orphanEntries(t, deferredDB), orphanEntries(t, recordingDB))
+	require.Greater(t, len(recordingDB.orphanCounts), 1)
+	for _, count := range recordingDB.orphanCounts {
+		require.LessOrEqual(t, count, maxBatchSize)
+	}
+
+	// A failed save deletes the orphans already flushed to the database.
+	recordingDB = &batchRecordingDB{DB: db.NewMemDB()}
+	tree = newTree(recordingDB, opts)
+	recordingDB.failRoots = true
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Empty(t, orphanEntries(t, recordingDB))
+}
@@ -1,18 +1,217 @@
 package iavl
 
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NilValuePolicy defines how MutableTree.Set handles nil values.
+type NilValuePolicy uint8
+
+const (
+	// PanicOnNil panics when attempting to store a nil value. This is the default.
+	PanicOnNil NilValuePolicy = iota
+	// RejectNil returns an error from SetE when attempting to store a nil value.
+	RejectNil
+	// TreatNilAsEmpty stores nil values as empty values.
+	TreatNilAsEmpty
+)
+
 // Options define tree options.
 type Options struct {
 	// Sync synchronously flushes all writes to storage, using e.g. the fsync syscall.
 	// Disabling this significantly improves performance, but can lose data on e.g. power loss.
 	Sync bool
 
+	// VersionCeiling hides the versions above it, as if they didn't exist, without deleting them,
+	// e.g. to reproduce the state of a database at an earlier version in tests. Loading the latest
+	// version loads the highest version at or below the ceiling, and GetImmutable, GetVersioned and
+	// AvailableVersions ignore the versions above it. Since fast storage reflects the actual latest
+	// version, it isn't used, and the tree is read-only: saving, deleting and importing versions
+	// returns an error. Zero disables the ceiling.
+	VersionCeiling int64
+
 	// InitialVersion specifies the initial version number. If any versions already exist below
 	// this, an error is returned when loading the tree. Only used for the initial SaveVersion()
 	// call.
 	InitialVersion uint64
+
+	// VerifyOnLoad recomputes the hash of the root node when loading a version, and returns an
+	// error if it doesn't match the stored root hash. Only the root node is checked, which is cheap
+	// but catches gross corruption early.
+	VerifyOnLoad bool
+
+	// OnOrphanDeleted is called with the hash of each orphaned node deleted while deleting versions,
+	// e.g. to keep external indexes in sync, along with the version being deleted whose orphans
+	// include the node. It is called before the deletion is committed to the database, and an error
+	// aborts the deletion of the versions, discarding the uncommitted writes.
+	OnOrphanDeleted func(hash []byte, version int64) error
+
+	// NilValuePolicy defines how nil values given to Set and SetE are handled. Since Set cannot
+	// return an error, it panics on rejected values.
+	NilValuePolicy NilValuePolicy
+
+	// MaxKeySize and MaxValueSize limit the size in bytes of keys and values given to Set, SetE
+	// and Importer.Add. Oversized keys and values are rejected before the tree is modified. Zero
+	// means unlimited. Since Set cannot return an error, it panics on rejected keys and values.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// RejectEmptyKey makes SetE, RemoveE and Importer.Add return an error for empty keys, which
+	// are often a sign of a bug in the caller. By default, the empty key is a valid key which
+	// sorts before all other keys, and nil keys are treated as empty. Since Set and Remove cannot
+	// return an error, they panic on rejected keys. Empty keys already in the database can still
+	// be read and iterated over.
+	RejectEmptyKey bool
+
+	// MaxHeight limits the height of the tree, i.e. the length of its longest path from the root
+	// to a leaf. SetE returns an error and leaves the tree unmodified if setting a key would grow
+	// the tree taller. Balanced trees are logarithmic in height, so this is an invariant check
+	// for e.g. fuzzing and tests. Zero means unlimited. Since Set cannot return an error, it
+	// panics instead.
+	MaxHeight int8
+
+	// ExternalValueThreshold stores values larger than this many bytes outside of their leaf nodes,
+	// under a separate key for each leaf, so that loading and rewriting nodes doesn't involve
+	// large values. Values are loaded transparently along with their leaf nodes, and the leaf hash
+	// only depends on the value hash, so tree hashes and proofs are unaffected. Fast storage still
+	// holds the values. Zero stores all values in their leaf nodes. Once values have been stored
+	// externally, the option must remain enabled, or they are not deleted along with their nodes.
+	ExternalValueThreshold int
+
+	// Logger receives debug logs of e.g. saving and deleting versions and enabling fast storage,
+	// so that they can be told apart between trees. Nil logs to the package debug output, which
+	// is disabled by default.
+	Logger Logger
+
+	// NodeCodec encodes nodes stored in the database, e.g. in a more compact format. Nil uses
+	// DefaultNodeCodec. Tree hashes don't depend on the codec. The codec name is persisted in new
+	// databases, and opening a database with a differently named codec returns an error. It
+	// can't be combined with ExternalValueThreshold.
+	NodeCodec NodeCodec
+
+	// ValueCodec encodes the values of leaf nodes and fast nodes stored in the database, e.g. to
+	// compress them, and decodes them transparently when they are read. Tree hashes and proofs are
+	// computed from the decoded values, so they are unaffected. The codec name is persisted in
+	// new databases, and opening a database with a differently named codec, or with or without
+	// one when the values were stored otherwise, returns an error.
+	ValueCodec ValueCodec
+
+	// WAL journals every change to the working tree by Set, Remove and their variants before it is
+	// applied, so that the working tree can be recovered with MutableTree.ReplayWAL after a crash.
+	// The WAL is truncated when the working tree is saved or rolled back. Since Set, Remove and
+	// Rollback cannot return errors, they panic if the WAL can't be written or truncated, so
+	// callers handling WAL errors should use SetE, RemoveE and RollbackE instead. It can't be
+	// combined with DeferCommit.
+	WAL WAL
+
+	// CommitParallelism is the maximum number of goroutines used to hash independent unsaved
+	// subtrees of the working tree, e.g. by WorkingHash and SaveVersion. The resulting hashes are
+	// identical to serial hashing. Values of 1 or less hash serially.
+	CommitParallelism int
+
+	// OrphanGracePeriodVersions defers the deletion of versions by DeleteVersion and
+	// DeleteVersionsRange until this many newer versions have been saved, so that recently deleted
+	// versions remain readable, e.g. by GetVersioned. Deletion happens during SaveVersion, and is
+	// postponed further while the versions have active readers. 0 deletes versions immediately.
+	OrphanGracePeriodVersions int
+
+	// DeferCommit makes SaveVersion stage its writes in memory instead of committing them to the
+	// database, until MutableTree.FlushToDisk commits all staged versions in a single batch. Staged
+	// versions can be read through the tree, but are lost if the process exits or crashes before
+	// they are flushed. Versions can't be loaded or deleted while there are staged writes.
+	DeferCommit bool
+
+	// SkipUnchangedWrites makes Set and its variants look up the existing value of the key, and
+	// leave the tree unmodified if it is equal to the new value, returning updated as false. This
+	// avoids orphaning and rewriting nodes for idempotent writes, at the cost of a lookup for
+	// every write.
+	SkipUnchangedWrites bool
+
+	// DetectDuplicateWritesPerVersion tracks the keys set since the last save, so that keys set more
+	// than once, where the last write silently wins, can be listed by MutableTree.DuplicateWrites.
+	// It is a debugging aid, which costs memory for every key written.
+	DetectDuplicateWritesPerVersion bool
+
+	// LeafHashSalt is prepended to leaf values when hashing them, so that the tree hash commits to
+	// the keys and values without allowing others to compute it from them. Inner nodes are hashed
+	// as usual. The salt is persisted in new databases, and opening a database with a different
+	// salt returns an error. Proofs of salted trees can't be verified without the salt, e.g. by
+	// ICS23 verifiers or RangeProof.VerifyItem.
+	LeafHashSalt []byte
+
+	// MaxCommitBatchEntries splits the writes committed by SaveVersion and similar operations into
+	// database batches of at most this many sets and deletes, which are written sequentially, since
+	// some backends write several medium batches faster than a single huge one. Zero writes a
+	// single batch. Each batch is atomic, but the commit as a whole isn't. The root of a version
+	// is written after its nodes, and fast storage is rebuilt on load if its update was
+	// interrupted, but a crash during a commit can still leave orphan records of a version that
+	// wasn't saved, so the database should be restored from a backup after one. CommitRetry
+	// resumes with the batch that failed.
+	MaxCommitBatchEntries int
+
+	// OrphanFlushThreshold flushes the orphan records of a version to the database in chunks of
+	// this many entries while it is saved, when it has more orphans than that, to bound the memory
+	// used by the batch. Zero writes them with the rest of the commit in a single batch. Flushed
+	// orphans are deleted again if the save fails, but a crash before the version is committed
+	// leaves orphan records for nodes which are still part of the latest version, and deleting the
+	// previous version would then delete them, so the database should be restored from a backup
+	// after one. It has no effect with DeferCommit.
+	OrphanFlushThreshold int
+
+	// CommitRetry retries failed writes of batches to the database, e.g. on transient disk errors.
+	// If SaveVersion still fails, the working tree is restored to its state before the call, so
+	// that it can be retried.
+	CommitRetry CommitRetryOptions
+
+	// Comparator orders the keys of the tree instead of bytes.Compare, returning a negative number,
+	// 0 or a positive number if a is less than, equal to or greater than b. It must be a total
+	// order which only returns 0 for identical keys. ComparatorName must be set along with it, and
+	// is persisted in new databases. Opening a database with a differently named comparator, or
+	// with or without one when the tree was built otherwise, returns an error.
+	//
+	// Iteration follows the comparator, so iterators don't use fast storage, and
+	// VerifyFastStorage isn't supported. Range and ICS23 proofs assume byte order, and return
+	// an error.
+	Comparator func(a, b []byte) int
+
+	// ComparatorName identifies Comparator, see above.
+	ComparatorName string
+
+	// OnNodePersisted is called by SaveVersion with the hash and encoded bytes of each new node as
+	// it is written to the database batch, before the batch is committed, e.g. to mirror the
+	// nodes in another store. An error aborts the save like a failed write. The callback must
+	// not modify encoded or call into the tree. Nodes written by imports aren't reported.
+	OnNodePersisted func(hash []byte, encoded []byte) error
+}
+
+// CommitRetryOptions configures retries of failed batch writes, see Options.CommitRetry.
+type CommitRetryOptions struct {
+	// Attempts is the maximum number of times a batch write is attempted. 1 or less doesn't retry.
+	Attempts int
+
+	// Backoff is the delay before the first retry, which is doubled for each further retry.
+	Backoff time.Duration
 }
 
 // DefaultOptions returns the default options for IAVL.
 func DefaultOptions() Options {
 	return Options{}
 }
+
+// validateKeyValue checks the key and value sizes against MaxKeySize and MaxValueSize, and
+// rejects empty keys if RejectEmptyKey is set.
+func (opts Options) validateKeyValue(key, value []byte) error {
+	if opts.RejectEmptyKey && len(key) == 0 {
+		return errors.New("empty keys are not allowed")
+	}
+	if opts.MaxKeySize > 0 && len(key) > opts.MaxKeySize {
+		return errors.Errorf("key size %d exceeds maximum of %d bytes", len(key), opts.MaxKeySize)
+	}
+	if opts.MaxValueSize > 0 && len(value) > opts.MaxValueSize {
+		return errors.Errorf("value size %d for key '%X' exceeds maximum of %d bytes",
+			len(value), key, opts.MaxValueSize)
+	}
+	return nil
+}
@@ -1,12 +1,14 @@
 package iavl
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/crypto/merkle"
 	tmmerkle "github.com/tendermint/tendermint/proto/tendermint/crypto"
 	db "github.com/tendermint/tm-db"
 )
@@ -97,3 +99,47 @@ func TestProofOp(t *testing.T) {
 		})
 	}
 }
+
+func TestGetWithProofOps(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, nil)
+	require.NoError(t, err)
+	keys := []byte{0x0a, 0x11, 0x2e, 0x32, 0x50, 0x72, 0x99, 0xa1, 0xe4, 0xf7}
+	for _, ikey := range keys {
+		key := []byte{ikey}
+		tree.Set(key, key)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	prt := merkle.NewProofRuntime()
+	prt.RegisterOpDecoder(ProofOpIAVLValue, ValueOpDecoder)
+	prt.RegisterOpDecoder(ProofOpIAVLAbsence, AbsenceOpDecoder)
+
+	for _, ikey := range []byte{0x00, 0x0a, 0x0b, 0x72, 0xaa, 0xf7, 0xff} {
+		key := []byte{ikey}
+		keyPath := merkle.KeyPath{}.AppendKey(key, merkle.KeyEncodingHex).String()
+		value, proofOps, err := tree.GetWithProofOps(key)
+		require.NoError(t, err)
+		require.Len(t, proofOps.Ops, 1)
+
+		// Round-trip the proof through its Protobuf encoding.
+		bz, err := proofOps.Marshal()
+		require.NoError(t, err)
+		proofOps = &tmmerkle.ProofOps{}
+		require.NoError(t, proofOps.Unmarshal(bz))
+
+		if bytes.IndexByte(keys, ikey) >= 0 {
+			require.Equal(t, key, value)
+			require.Equal(t, ProofOpIAVLValue, proofOps.Ops[0].Type)
+			require.NoError(t, prt.VerifyValue(proofOps, root, keyPath, value))
+			require.Error(t, prt.VerifyValue(proofOps, root, keyPath, []byte{0x01}))
+			require.Error(t, prt.VerifyAbsence(proofOps, root, keyPath))
+		} else {
+			require.Nil(t, value)
+			require.Equal(t, ProofOpIAVLAbsence, proofOps.Ops[0].Type)
+			require.NoError(t, prt.VerifyAbsence(proofOps, root, keyPath))
+			require.Error(t, prt.VerifyValue(proofOps, root, keyPath, key))
+		}
+		require.Error(t, prt.VerifyValue(proofOps, []byte("invalid root hash"), keyPath, value))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	tmmerkle "github.com/tendermint/tendermint/proto/tendermint/crypto"
 
 	iavlproto "github.com/cosmos/iavl/proto"
 )
@@ -330,6 +331,29 @@ func (proof *RangeProof) ToProto() *iavlproto.RangeProof {
 	return pb
 }
 
+// ToProofOps converts the proof of a key to ProofOps, which can be verified by a Tendermint
+// merkle.ProofRuntime with ValueOpDecoder and AbsenceOpDecoder registered. The proof is encoded
+// as a ValueOp if it contains the key, otherwise as an AbsenceOp.
+func (proof *RangeProof) ToProofOps(key []byte) *tmmerkle.ProofOps {
+	var op tmmerkle.ProofOp
+	if proof.hasLeaf(key) {
+		op = NewValueOp(key, proof).ProofOp()
+	} else {
+		op = NewAbsenceOp(key, proof).ProofOp()
+	}
+	return &tmmerkle.ProofOps{Ops: []tmmerkle.ProofOp{op}}
+}
+
+// hasLeaf returns whether the proof contains a leaf with the given key.
+func (proof *RangeProof) hasLeaf(key []byte) bool {
+	for _, leaf := range proof.Leaves {
+		if bytes.Equal(leaf.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
 // rangeProofFromProto generates a RangeProof from a Protobuf RangeProof.
 func RangeProofFromProto(pbProof *iavlproto.RangeProof) (RangeProof, error) {
 	proof := RangeProof{}
@@ -373,6 +397,9 @@ func RangeProofFromProto(pbProof *iavlproto.RangeProof) (RangeProof, error) {
 // If keyStart >= keyEnd and both not nil, panics.
 // Limit is never exceeded.
 func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof *RangeProof, keys, values [][]byte, err error) {
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return nil, nil, nil, errors.New("range proofs are not supported for trees with a custom comparator")
+	}
 	if keyStart != nil && keyEnd != nil && bytes.Compare(keyStart, keyEnd) >= 0 {
 		panic("if keyStart and keyEnd are present, need keyStart < keyEnd.")
 	}
@@ -382,7 +409,7 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 	if t.root == nil {
 		return nil, nil, nil, nil
 	}
-	t.root.hashWithCount() // Ensure that all hashes are calculated.
+	t.root.hashWithCount(t.leafHashSalt()) // Ensure that all hashes are calculated.
 
 	// Get the first key/value pair proof, which provides us with the left key.
 	path, left, err := t.root.PathToLeaf(t, keyStart)
@@ -399,11 +426,10 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 		values = append(values, left.value)
 	}
 
-	h := sha256.Sum256(left.value)
 	var leaves = []ProofLeafNode{
 		{
 			Key:       left.key,
-			ValueHash: h[:],
+			ValueHash: leafValueHash(left.value, t.leafHashSalt()),
 			Version:   left.version,
 		},
 	}
@@ -462,10 +488,9 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 				// Start a new one to track as we traverse the tree.
 				currentPathToLeaf = PathToLeaf(nil)
 
-				h := sha256.Sum256(node.value)
 				leaves = append(leaves, ProofLeafNode{
 					Key:       node.key,
-					ValueHash: h[:],
+					ValueHash: leafValueHash(node.value, t.leafHashSalt()),
 					Version:   node.version,
 				})
 
@@ -532,7 +557,129 @@ func (t *ImmutableTree) GetWithProof(key []byte) (value []byte, proof *RangeProo
 	return nil, proof, nil
 }
 
+// ProofSize returns the size in bytes of the Protobuf-encoded existence proof of a key, as returned
+// by GetWithProof and encoded with ToProto, along with the number of inner nodes in its path, so
+// that clients can budget bandwidth before requesting the proof. The size is computed from the
+// path to the key without building the proof. It returns an error if the key doesn't exist.
+func (t *ImmutableTree) ProofSize(key []byte) (size int, pathLen int, err error) {
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return 0, 0, errors.New("range proofs are not supported for trees with a custom comparator")
+	}
+	if t.root == nil {
+		return 0, 0, errors.Errorf("key %X not found", key)
+	}
+
+	node := t.root
+	for !node.isLeaf() {
+		// Each inner node has the hash of the sibling subtree.
+		inner := protoVarintFieldSize(uint64(node.height)*2) + protoVarintFieldSize(uint64(node.size)) +
+			protoVarintFieldSize(uint64(node.version)) + protoBytesFieldSize(hashSize)
+		size += protoBytesFieldSize(inner)
+		pathLen++
+		if t.compareKeys(key, node.key) < 0 {
+			node = node.getLeftNode(t)
+		} else {
+			node = node.getRightNode(t)
+		}
+	}
+	if !bytes.Equal(node.key, key) {
+		return 0, 0, errors.Errorf("key %X not found", key)
+	}
+	leaf := protoBytesFieldSize(len(node.key)) + protoBytesFieldSize(hashSize) +
+		protoVarintFieldSize(uint64(node.version))
+	size += protoBytesFieldSize(leaf)
+	return size, pathLen, nil
+}
+
+// protoVarintFieldSize returns the encoded size of a Protobuf varint field with a one-byte tag,
+// which is omitted if zero.
+func protoVarintFieldSize(v uint64) int {
+	if v == 0 {
+		return 0
+	}
+	n := 2
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// protoBytesFieldSize returns the encoded size of a Protobuf length-delimited field of n bytes with
+// a one-byte tag, which is omitted if empty.
+func protoBytesFieldSize(n int) int {
+	if n == 0 {
+		return 0
+	}
+	return protoVarintFieldSize(uint64(n)) + n
+}
+
+// GetManyWithProof gets the values of the given keys, positionally aligned with keys, with nil
+// for keys that don't exist, along with proofs of their existence or absence, also aligned with
+// keys. A range proof covers all leaves between its first and last key, so keys are only proved
+// by a shared range proof when their leaves, or those bounding their absence, are adjacent in the
+// tree. Other keys get separate proofs, so the size of the proofs doesn't depend on the number of
+// leaves between far-apart keys.
+func (t *ImmutableTree) GetManyWithProof(keys [][]byte) (values [][]byte, proofs []*RangeProof, err error) {
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys given")
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	values = make([][]byte, len(keys))
+	proofs = make([]*RangeProof, len(keys))
+	for i := 0; i < len(order); {
+		// Extend the run while the next key is at or next to the last key's position.
+		lastIndex, _ := t.GetWithIndex(keys[order[i]])
+		j := i + 1
+		for ; j < len(order); j++ {
+			index, _ := t.GetWithIndex(keys[order[j]])
+			if index > lastIndex+1 {
+				break
+			}
+			lastIndex = index
+		}
+
+		first, last := keys[order[i]], keys[order[j-1]]
+		proof, rangeKeys, rangeValues, err := t.getRangeProof(first, cpIncr(last), 0)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "constructing range proof")
+		}
+		for _, k := range order[i:j] {
+			key := keys[k]
+			n := sort.Search(len(rangeKeys), func(n int) bool {
+				return bytes.Compare(rangeKeys[n], key) >= 0
+			})
+			if n < len(rangeKeys) && bytes.Equal(rangeKeys[n], key) {
+				values[k] = rangeValues[n]
+			}
+			proofs[k] = proof
+		}
+		i = j
+	}
+	return values, proofs, nil
+}
+
+// GetWithProofOps is like GetWithProof, but returns the proof as ProofOps. See
+// RangeProof.ToProofOps.
+func (t *ImmutableTree) GetWithProofOps(key []byte) (value []byte, proofOps *tmmerkle.ProofOps, err error) {
+	value, proof, err := t.GetWithProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, proof.ToProofOps(key), nil
+}
+
 // GetRangeWithProof gets key/value pairs within the specified range and limit.
+// The range is [startKey, endKey), and either side is open if nil. A limit of 0 means no limit.
+// The returned proof verifies the pairs against the root hash, along with the absence of any
+// other keys between them, and includes the neighboring leaves to prove the range boundaries.
+// Panics if startKey >= endKey, or if limit is negative.
 func (t *ImmutableTree) GetRangeWithProof(startKey []byte, endKey []byte, limit int) (keys, values [][]byte, proof *RangeProof, err error) {
 	proof, keys, values, err = t.getRangeProof(startKey, endKey, limit)
 	return
@@ -552,6 +699,21 @@ func (tree *MutableTree) GetVersionedWithProof(key []byte, version int64) ([]byt
 	return nil, nil, errors.Wrap(ErrVersionDoesNotExist, "")
 }
 
+// GetWorkingProof is like GetWithProof, but for the current working tree, before it is saved. It
+// hashes the working tree like WorkingHash, and returns the root hash which the proof verifies
+// against.
+func (tree *MutableTree) GetWorkingProof(key []byte) (value []byte, proof *RangeProof, rootHash []byte, err error) {
+	// Hashing modifies the unsaved nodes.
+	tree.workingMtx.Lock()
+	defer tree.workingMtx.Unlock()
+	rootHash = tree.ImmutableTree.Hash()
+	value, proof, err = tree.ImmutableTree.GetWithProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return value, proof, rootHash, nil
+}
+
 // GetVersionedRangeWithProof gets key/value pairs within the specified range
 // and limit.
 func (tree *MutableTree) GetVersionedRangeWithProof(startKey, endKey []byte, limit int, version int64) (
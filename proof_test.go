@@ -3,6 +3,7 @@ package iavl
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	proto "github.com/gogo/protobuf/proto"
@@ -48,6 +49,57 @@ func TestTreeGetWithProof(t *testing.T) {
 	require.NoError(err, "%+v", err)
 }
 
+func TestTreeGetWorkingProof(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for _, ikey := range []byte{0x11, 0x32, 0x50} {
+		tree.Set([]byte{ikey}, []byte{ikey})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	savedHash := tree.Hash()
+
+	// Uncommitted changes are proven against the working hash.
+	tree.Set([]byte{0x72}, []byte{0x72})
+	tree.Set([]byte{0x32}, []byte{0x33})
+	tree.Remove([]byte{0x50})
+
+	for _, tc := range []struct {
+		key   byte
+		value []byte
+	}{
+		{0x11, []byte{0x11}},
+		{0x32, []byte{0x33}},
+		{0x72, []byte{0x72}},
+		{0x50, nil},
+		{0x01, nil},
+		{0xff, nil},
+	} {
+		key := []byte{tc.key}
+		value, proof, root, err := tree.GetWorkingProof(key)
+		require.NoError(t, err)
+		require.Equal(t, tree.WorkingHash(), root)
+		require.NotEqual(t, savedHash, root)
+		require.Equal(t, tc.value, value)
+		require.NoError(t, proof.Verify(root))
+		if tc.value != nil {
+			require.NoError(t, proof.VerifyItem(key, value))
+		} else {
+			require.NoError(t, proof.VerifyAbsence(key))
+		}
+	}
+
+	// The proofs match those of the version once it is saved.
+	_, proof, root, err := tree.GetWorkingProof([]byte{0x72})
+	require.NoError(t, err)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, root, hash)
+	_, savedProof, err := tree.GetVersionedWithProof([]byte{0x72}, version)
+	require.NoError(t, err)
+	require.Equal(t, savedProof, proof)
+}
+
 func TestTreeKeyExistsProof(t *testing.T) {
 	tree, err := getTestTree(0)
 	require.NoError(t, err)
@@ -206,6 +258,170 @@ func TestTreeKeyInRangeProofs(t *testing.T) {
 	}
 }
 
+func TestTreeKeyInRangeProofs_Limit(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	keys := []byte{0x0a, 0x11, 0x2e, 0x32, 0x50, 0x72, 0x99, 0xa1, 0xe4, 0xf7}
+	for _, ikey := range keys {
+		key := []byte{ikey}
+		tree.Set(key, key)
+	}
+	root := tree.WorkingHash()
+
+	// Paginate over the range, verifying each page against the root.
+	var (
+		start = []byte{0x00}
+		end   = []byte{0xff}
+		all   []byte
+	)
+	for pages := 0; bytes.Compare(start, end) < 0; pages++ {
+		require.Less(t, pages, len(keys))
+		pageKeys, pageValues, proof, err := tree.GetRangeWithProof(start, end, 3)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(pageKeys), 3)
+		require.Equal(t, pageKeys, pageValues)
+		verifyProof(t, proof, root)
+		if len(pageKeys) == 0 {
+			break
+		}
+
+		for i, key := range pageKeys {
+			require.NoError(t, proof.VerifyItem(key, key))
+			// Keys between returned entries are proven absent.
+			if i > 0 {
+				for absent := int(pageKeys[i-1][0]) + 1; absent < int(key[0]); absent++ {
+					require.NoError(t, proof.VerifyAbsence([]byte{byte(absent)}))
+				}
+			}
+		}
+		all = append(all, flatten(pageKeys)...)
+		start = cpIncr(pageKeys[len(pageKeys)-1])
+	}
+	require.Equal(t, keys, all)
+}
+
+func TestTreeGetManyWithProof(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	keys := []byte{0x0a, 0x11, 0x2e, 0x32, 0x50, 0x72, 0x99, 0xa1, 0xe4, 0xf7}
+	for _, ikey := range keys {
+		key := []byte{ikey}
+		tree.Set(key, key)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	for _, query := range [][]byte{
+		{0x32},
+		{0x33},
+		{0x99, 0x11, 0x50},
+		{0x00, 0x72, 0x73, 0x11, 0x72},
+		{0xf7, 0xff, 0x0a, 0x05},
+		{0xff, 0xfe},
+	} {
+		queryKeys := make([][]byte, len(query))
+		for i, ikey := range query {
+			queryKeys[i] = []byte{ikey}
+		}
+		values, proofs, err := itree.GetManyWithProof(queryKeys)
+		require.NoError(t, err)
+		require.Len(t, values, len(query))
+		require.Len(t, proofs, len(query))
+
+		for i, key := range queryKeys {
+			// Verify the proof after encoding and decoding it.
+			bz, err := encodeProof(proofs[i])
+			require.NoError(t, err)
+			proof, err := decodeProof(bz)
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(root))
+			if bytes.IndexByte(keys, key[0]) >= 0 {
+				require.Equal(t, key, values[i])
+				require.NoError(t, proof.VerifyItem(key, values[i]))
+				require.Error(t, proof.VerifyAbsence(key))
+			} else {
+				require.Nil(t, values[i])
+				require.NoError(t, proof.VerifyAbsence(key))
+			}
+		}
+	}
+
+	// Adjacent keys share a proof, while far-apart keys don't, so the size of the proofs doesn't
+	// depend on the leaves between them.
+	_, proofs, err := itree.GetManyWithProof([][]byte{{0x2e}, {0x32}, {0x33}, {0xe4}})
+	require.NoError(t, err)
+	require.Same(t, proofs[0], proofs[1])
+	require.Same(t, proofs[0], proofs[2])
+	require.NotSame(t, proofs[0], proofs[3])
+
+	proofSize := func(itree *ImmutableTree, keys ...[]byte) int {
+		_, proofs, err := itree.GetManyWithProof(keys)
+		require.NoError(t, err)
+		size, seen := 0, map[*RangeProof]bool{}
+		for _, proof := range proofs {
+			if !seen[proof] {
+				seen[proof] = true
+				size += len(proof.Leaves)
+			}
+		}
+		return size
+	}
+	for _, between := range []int{10, 1000} {
+		tree, err := getTestTree(0)
+		require.NoError(t, err)
+		tree.Set([]byte("a"), []byte{1})
+		tree.Set([]byte("z"), []byte{1})
+		for i := 0; i < between; i++ {
+			tree.Set([]byte(fmt.Sprintf("m%04d", i)), []byte{1})
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, 2, proofSize(itree, []byte("a"), []byte("z")))
+		require.Equal(t, 3, proofSize(itree, []byte("a"), []byte("b"), []byte("z")))
+	}
+
+	_, _, err = itree.GetManyWithProof(nil)
+	require.Error(t, err)
+}
+
+func TestTreeProofSize(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	keys := make([][]byte, 0, 500)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i*37%1000))
+		keys = append(keys, key)
+		tree.Set(key, randBytes(i%50+1))
+	}
+	// Versions above 127 take two bytes to encode.
+	for v := 0; v < 130; v++ {
+		tree.Set(keys[v], []byte{byte(v)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	tree.Set([]byte("unsaved"), []byte("value"))
+
+	for _, key := range append(keys, []byte("unsaved")) {
+		size, pathLen, err := tree.ProofSize(key)
+		require.NoError(t, err)
+		_, proof, _, err := tree.GetWorkingProof(key)
+		require.NoError(t, err)
+		bz, err := encodeProof(proof)
+		require.NoError(t, err)
+		require.Equal(t, len(bz), size, "key %s", key)
+		require.Equal(t, len(proof.LeftPath), pathLen)
+	}
+
+	_, _, err = tree.ProofSize([]byte("missing"))
+	require.Error(t, err)
+	_, _, err = (&ImmutableTree{}).ProofSize([]byte("missing"))
+	require.Error(t, err)
+}
+
 func encodeProof(proof *RangeProof) ([]byte, error) {
 	return proto.Marshal(proof.ToProto())
 }
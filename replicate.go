@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// DiffNode is a node created by a version, as returned by MutableTree.NewNodesSince. Unlike
+// nodes exported by Exporter, which can rebuild a whole tree, it refers to the hashes of its
+// children, which may be nodes of earlier versions.
+type DiffNode struct {
+	ExportNode
+
+	// LeftHash and RightHash are the hashes of the children of inner nodes, and nil for leaves.
+	LeftHash  []byte
+	RightHash []byte
+}
+
+// NewNodesSince returns the nodes of the given version which were created since the previous
+// saved version, along with the root hash of the version, e.g. to replicate the version to a
+// follower which has the previous version with MutableTree.ApplyNewNodes. This is much smaller
+// than a snapshot of the version. The nodes are in post-order, so children precede their parents
+// and the root, if it is new, is last. Nodes are never older than their descendants, so only the
+// subtrees that changed are traversed.
+func (tree *MutableTree) NewNodesSince(version int64) (nodes []DiffNode, rootHash []byte, err error) {
+	tree.ndb.incrVersionReaders(version)
+	defer tree.ndb.decrVersionReaders(version)
+
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous := tree.ndb.getPreviousVersion(version)
+
+	nodes = []DiffNode{}
+	var walk func(node *Node) error
+	walk = func(node *Node) error {
+		if node.version <= previous {
+			return nil
+		}
+		diffNode := DiffNode{
+			ExportNode: ExportNode{
+				Key:     node.key,
+				Version: node.version,
+				Height:  node.height,
+			},
+		}
+		if node.isLeaf() {
+			diffNode.Value = node.value
+		} else {
+			for _, hash := range [][]byte{node.leftHash, node.rightHash} {
+				child, err := tree.ndb.getNode(hash)
+				if err != nil {
+					return err
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			diffNode.LeftHash = node.leftHash
+			diffNode.RightHash = node.rightHash
+		}
+		nodes = append(nodes, diffNode)
+		return nil
+	}
+	if itree.root != nil {
+		if err := walk(itree.root); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nodes, itree.Hash(), nil
+}
+
+// ApplyNewNodes saves the given version from the nodes returned by NewNodesSince for it on another
+// tree, which must have saved the version preceding it there, and have no unsaved changes. The
+// nodes orphaned by the version and fast storage are updated as if the version had been saved
+// with Set and Remove, and the tree is at the given version afterwards. An error is returned and
+// nothing is saved if the resulting root hash doesn't match rootHash.
+func (tree *MutableTree) ApplyNewNodes(version int64, nodes []DiffNode, rootHash []byte) error {
+	if err := tree.checkNewVersion(version); err != nil {
+		return err
+	}
+	if len(tree.orphans) > 0 || len(tree.unsavedFastNodeAdditions) > 0 || len(tree.unsavedFastNodeRemovals) > 0 ||
+		(tree.root != nil && !tree.root.persisted) {
+		return errors.New("tree has unsaved changes")
+	}
+
+	// Build the new nodes, which refer to either earlier new nodes or nodes of the current version.
+	created := make(map[string]*Node, len(nodes))
+	unreferenced := map[string]bool{} // new nodes which aren't the child of another yet
+	kept := map[string]bool{}
+	child := func(hash []byte) (*Node, error) {
+		if node, ok := created[string(hash)]; ok {
+			if !unreferenced[string(hash)] {
+				return nil, errors.Errorf("node %X is referenced more than once", hash)
+			}
+			delete(unreferenced, string(hash))
+			return node, nil
+		}
+		kept[string(hash)] = true
+		return tree.ndb.getNode(hash)
+	}
+	var root *Node
+	for i, diffNode := range nodes {
+		if diffNode.Version <= tree.version || diffNode.Version > version {
+			return errors.Errorf("node %d has version %d outside of (%d, %d]", i, diffNode.Version, tree.version, version)
+		}
+		node := &Node{
+			key:     diffNode.Key,
+			value:   diffNode.Value,
+			version: diffNode.Version,
+			height:  diffNode.Height,
+			size:    1,
+		}
+		if node.height > 0 {
+			left, err := child(diffNode.LeftHash)
+			if err != nil {
+				return errors.Wrapf(err, "node %d", i)
+			}
+			right, err := child(diffNode.RightHash)
+			if err != nil {
+				return errors.Wrapf(err, "node %d", i)
+			}
+			node.leftHash, node.rightHash = diffNode.LeftHash, diffNode.RightHash
+			if !left.persisted {
+				node.leftNode = left
+			}
+			if !right.persisted {
+				node.rightNode = right
+			}
+			node.size = left.size + right.size
+		}
+		if err := node.validate(); err != nil {
+			return errors.Wrapf(err, "node %d", i)
+		}
+		node._hash(tree.ndb.opts.LeafHashSalt)
+		created[string(node.hash)] = node
+		unreferenced[string(node.hash)] = true
+		root = node
+	}
+	if len(unreferenced) > 1 {
+		return errors.Errorf("%d nodes are not part of the tree", len(unreferenced)-1)
+	}
+
+	switch {
+	case root != nil:
+	case tree.root != nil && bytes.Equal(rootHash, tree.root.hash):
+		root = tree.root
+	case !bytes.Equal(rootHash, sha256.New().Sum(nil)):
+		return errors.Errorf("no new nodes given, but root hash %X differs from the current root", rootHash)
+	}
+	if root != nil && !bytes.Equal(root.hash, rootHash) {
+		return errors.Errorf("root hash %X does not match expected hash %X", root.hash, rootHash)
+	}
+
+	// The nodes of the current version which aren't referenced by the new nodes are orphaned.
+	orphans := map[string]int64{}
+	removedKeys := [][]byte{}
+	if tree.root != nil && root != tree.root {
+		stack := []*Node{tree.root}
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if kept[string(node.hash)] {
+				continue
+			}
+			orphans[string(node.hash)] = node.version
+			if node.isLeaf() {
+				removedKeys = append(removedKeys, node.key)
+				continue
+			}
+			for _, hash := range [][]byte{node.leftHash, node.rightHash} {
+				child, err := tree.ndb.getNode(hash)
+				if err != nil {
+					return err
+				}
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	tree.workingMtx.Lock()
+	for _, key := range removedKeys {
+		tree.addUnsavedRemoval(key)
+	}
+	for _, node := range created {
+		if node.isLeaf() {
+			tree.addUnsavedAddition(node.key, NewFastNode(node.key, node.value, node.version))
+		}
+	}
+	tree.root = root
+	tree.orphans = orphans
+	tree.workingMtx.Unlock()
+
+	// The nodes keep the versions they were created with, rather than being stamped with the
+	// version like SaveVersionTo does, since the root hash depends on them.
+	if _, _, _, err := tree.saveVersion(version, nil); err != nil {
+		tree.Rollback()
+		return err
+	}
+	return nil
+}
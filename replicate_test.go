@@ -0,0 +1,95 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMutableTree_ApplyNewNodes(t *testing.T) {
+	leader, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	follower, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	changes := []func(){
+		func() {
+			for i := 0; i < 20; i++ {
+				leader.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+			}
+		},
+		func() {
+			leader.Set([]byte("k03"), []byte("updated"))
+			leader.Remove([]byte("k07"))
+			leader.Set([]byte("k99"), []byte("new"))
+		},
+		func() {}, // a version without changes
+		func() {
+			for i := 0; i < 20; i += 2 {
+				leader.Remove([]byte(fmt.Sprintf("k%02d", i)))
+			}
+		},
+		func() {
+			_, err := leader.RemoveRange(nil, nil)
+			require.NoError(t, err)
+		},
+		func() {
+			leader.Set([]byte("a"), []byte("1"))
+		},
+	}
+	for i, change := range changes {
+		change()
+		hash, version, err := leader.SaveVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, i+1, version)
+
+		nodes, rootHash, err := leader.NewNodesSince(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, rootHash)
+		if i == 2 {
+			require.Empty(t, nodes)
+		}
+
+		// A tampered root hash is rejected without saving anything.
+		require.Error(t, follower.ApplyNewNodes(version, nodes, []byte("invalid")))
+		require.EqualValues(t, i, follower.Version())
+
+		require.NoError(t, follower.ApplyNewNodes(version, nodes, rootHash))
+		require.Equal(t, version, follower.Version())
+		require.Equal(t, hash, follower.Hash())
+
+		leaderKeys, followerKeys := [][]byte{}, [][]byte{}
+		leader.Iterate(func(key, value []byte) bool {
+			leaderKeys = append(leaderKeys, key)
+			require.Equal(t, value, follower.Get(key))
+			return false
+		})
+		follower.Iterate(func(key, value []byte) bool {
+			followerKeys = append(followerKeys, key)
+			return false
+		})
+		require.Equal(t, leaderKeys, followerKeys)
+		mismatches, err := follower.VerifyFastStorage()
+		require.NoError(t, err)
+		require.Empty(t, mismatches)
+	}
+
+	// Old versions can be deleted on the follower, as the orphans were recorded.
+	require.NoError(t, follower.DeleteVersionsRange(1, follower.Version()))
+	require.Equal(t, leader.Hash(), follower.Hash())
+	require.Equal(t, []byte("1"), follower.Get([]byte("a")))
+
+	// The follower must have the previous version.
+	leader.Set([]byte("b"), []byte("2"))
+	_, _, err = leader.SaveVersion()
+	require.NoError(t, err)
+	leader.Set([]byte("c"), []byte("3"))
+	hash, version, err := leader.SaveVersion()
+	require.NoError(t, err)
+	nodes, rootHash, err := leader.NewNodesSince(version)
+	require.NoError(t, err)
+	require.Equal(t, hash, rootHash)
+	require.Error(t, follower.ApplyNewNodes(version, nodes, rootHash))
+}
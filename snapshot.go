@@ -0,0 +1,274 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotFormat is the format version of snapshots written by SnapshotVersion.
+const snapshotFormat = 1
+
+// hashManifestFormat is the format version of manifests written by ExportHashManifest.
+const hashManifestFormat = 1
+
+// SnapshotVersion writes a snapshot of the given version to w, which can be restored into an
+// empty tree with RestoreSnapshot. The version is pinned while the snapshot is being written, so
+// it cannot be deleted in the meanwhile, but new versions can still be saved concurrently.
+//
+// The snapshot consists of the format version, the tree version and the node count, followed by
+// the tree nodes in the order returned by Exporter.
+func (tree *MutableTree) SnapshotVersion(version int64, w io.Writer) error {
+	tree.ndb.incrVersionReaders(version)
+	defer tree.ndb.decrVersionReaders(version)
+
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return err
+	}
+	leaves, inner := itree.NodeCount()
+
+	bw := bufio.NewWriter(w)
+	if err := encodeUvarint(bw, snapshotFormat); err != nil {
+		return err
+	}
+	if err := encodeVarint(bw, version); err != nil {
+		return err
+	}
+	if err := encodeVarint(bw, leaves+inner); err != nil {
+		return err
+	}
+
+	exporter := itree.Export()
+	defer exporter.Close()
+
+	count := int64(0)
+	for {
+		node, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeSnapshotNode(bw, node); err != nil {
+			return err
+		}
+		count++
+	}
+	if count != leaves+inner {
+		return errors.Errorf("exported %d nodes, expected %d", count, leaves+inner)
+	}
+
+	return bw.Flush()
+}
+
+// RestoreSnapshot restores a snapshot written by SnapshotVersion into the tree, which must be
+// empty, and returns the restored version. The tree is loaded at the restored version on success.
+func (tree *MutableTree) RestoreSnapshot(r io.Reader) (version int64, err error) {
+	br := bufio.NewReader(r)
+	format, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading snapshot format")
+	}
+	if format != snapshotFormat {
+		return 0, errors.Errorf("unsupported snapshot format %d", format)
+	}
+	version, err = binary.ReadVarint(br)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading snapshot version")
+	}
+	count, err := binary.ReadVarint(br)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading snapshot node count")
+	}
+
+	importer, err := tree.Import(version)
+	if err != nil {
+		return 0, err
+	}
+	defer importer.Close()
+
+	for i := int64(0); i < count; i++ {
+		node, err := readSnapshotNode(br)
+		if err != nil {
+			return 0, errors.Wrapf(err, "reading snapshot node %d", i)
+		}
+		if err := importer.Add(node); err != nil {
+			return 0, err
+		}
+	}
+	if err := importer.Commit(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// ExportHashManifest writes a manifest of the structure of the tree to w, consisting of the height
+// and hash of every node but no keys or values, so that a copy of the tree, e.g. a restored backup,
+// can be verified with VerifyHashManifest without exposing its data. The tree must be saved.
+//
+// The manifest consists of the format version and the node count, followed by the height and hash
+// of each node in the pre-order of WalkNodes, which determines the topology of the tree.
+func (t *ImmutableTree) ExportHashManifest(w io.Writer) error {
+	leaves, inner := t.NodeCount()
+	bw := bufio.NewWriter(w)
+	if err := encodeUvarint(bw, hashManifestFormat); err != nil {
+		return err
+	}
+	if err := encodeVarint(bw, leaves+inner); err != nil {
+		return err
+	}
+
+	var err error
+	walkErr := t.WalkNodes(func(node NodeInfo) bool {
+		if node.Hash == nil {
+			err = errors.New("can't export the hash manifest of unsaved nodes")
+			return true
+		}
+		if err = encodeVarint(bw, int64(node.Height)); err != nil {
+			return true
+		}
+		err = encodeBytes(bw, node.Hash)
+		return err != nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// VerifyHashManifest checks that the given version has exactly the structure and node hashes
+// recorded in a manifest written by ExportHashManifest, and returns an error describing the first
+// difference otherwise.
+func (tree *MutableTree) VerifyHashManifest(version int64, r io.Reader) error {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	format, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading manifest format")
+	}
+	if format != hashManifestFormat {
+		return errors.Errorf("unsupported manifest format %d", format)
+	}
+	count, err := binary.ReadVarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading manifest node count")
+	}
+
+	i := int64(0)
+	walkErr := itree.WalkNodes(func(node NodeInfo) bool {
+		if i >= count {
+			err = errors.Errorf("version %d has more than the %d nodes in the manifest", version, count)
+			return true
+		}
+		var height int64
+		var hash []byte
+		if height, err = binary.ReadVarint(br); err == nil {
+			hash, err = readSnapshotBytes(br)
+		}
+		switch {
+		case err != nil:
+			err = errors.Wrapf(err, "reading manifest node %d", i)
+		case height != int64(node.Height):
+			err = errors.Errorf("node %d has height %d, but the manifest has height %d", i, node.Height, height)
+		case !bytes.Equal(hash, node.Hash):
+			err = errors.Errorf("node %d has hash %X, but the manifest has hash %X", i, node.Hash, hash)
+		}
+		i++
+		return err != nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+	if i != count {
+		return errors.Errorf("version %d has %d nodes, but the manifest has %d", version, i, count)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return errors.New("unexpected data after the end of the manifest")
+	}
+	return nil
+}
+
+// writeSnapshotNode writes an exported node as its height, version, key and, for leaf nodes, value.
+func writeSnapshotNode(w io.Writer, node *ExportNode) error {
+	if err := encodeVarint(w, int64(node.Height)); err != nil {
+		return err
+	}
+	if err := encodeVarint(w, node.Version); err != nil {
+		return err
+	}
+	if err := encodeBytes(w, node.Key); err != nil {
+		return err
+	}
+	if node.Height == 0 {
+		return encodeBytes(w, node.Value)
+	}
+	return nil
+}
+
+// readSnapshotNode reads a node written by writeSnapshotNode.
+func readSnapshotNode(r *bufio.Reader) (*ExportNode, error) {
+	height, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding height")
+	}
+	if height < 0 || height > 127 {
+		return nil, errors.Errorf("invalid height %d", height)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding version")
+	}
+	node := &ExportNode{
+		Height:  int8(height),
+		Version: version,
+	}
+	if node.Key, err = readSnapshotBytes(r); err != nil {
+		return nil, errors.Wrap(err, "decoding key")
+	}
+	if node.Height == 0 {
+		if node.Value, err = readSnapshotBytes(r); err != nil {
+			return nil, errors.Wrap(err, "decoding value")
+		}
+	}
+	return node, nil
+}
+
+// readSnapshotBytes reads a varint length-prefixed byte slice written by encodeBytes. The length
+// comes from the stream, so the slice is grown as the data is read rather than allocated up front,
+// and a corrupt length fails with an unexpected EOF instead of exhausting memory.
+func readSnapshotBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > math.MaxInt64 {
+		return nil, errors.Errorf("invalid out of range length %v decoding []byte", size)
+	}
+	if size == 0 {
+		return []byte{}, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
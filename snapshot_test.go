@@ -0,0 +1,176 @@
+package iavl
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestSnapshotVersion_Restore(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		tree.Set(randBytes(8), randBytes(16))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	// Keep saving new versions in the background while taking the snapshot.
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(stopped)
+				return
+			default:
+			}
+			for i := 0; i < 10; i++ {
+				tree.Set(randBytes(8), randBytes(16))
+			}
+			if _, _, err := tree.SaveVersion(); err != nil {
+				stopped <- err
+				return
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	err = tree.SnapshotVersion(version, &buf)
+	close(done)
+	require.NoError(t, err)
+	require.NoError(t, <-stopped)
+	require.Empty(t, tree.PinnedVersions())
+
+	restored, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	restoredVersion, err := restored.RestoreSnapshot(&buf)
+	require.NoError(t, err)
+	require.Equal(t, version, restoredVersion)
+	require.Equal(t, itree.Hash(), restored.Hash())
+	require.Equal(t, itree.Size(), restored.Size())
+	itree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, value, restored.Get(key))
+		return false
+	})
+
+	// The restored tree can keep saving versions.
+	restored.Set([]byte("a"), []byte{1})
+	_, restoredVersion, err = restored.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, version+1, restoredVersion)
+}
+
+func TestSnapshotVersion_Empty(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.SnapshotVersion(version, &buf))
+
+	restored, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	restoredVersion, err := restored.RestoreSnapshot(&buf)
+	require.NoError(t, err)
+	require.Equal(t, version, restoredVersion)
+	require.True(t, restored.IsEmpty())
+}
+
+func TestSnapshotVersion_Errors(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.ErrorIs(t, tree.SnapshotVersion(version+1, &bytes.Buffer{}), ErrVersionDoesNotExist)
+	require.Empty(t, tree.PinnedVersions())
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.SnapshotVersion(version, &buf))
+
+	// The target tree must be empty.
+	_, err = tree.RestoreSnapshot(bytes.NewReader(buf.Bytes()))
+	require.Error(t, err)
+
+	// Truncated snapshots are rejected.
+	restored, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, err = restored.RestoreSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.Error(t, err)
+
+	// Huge length prefixes fail without allocating the length up front.
+	for _, size := range []uint64{1 << 40, math.MaxInt64, math.MaxUint64} {
+		var corrupt bytes.Buffer
+		require.NoError(t, encodeUvarint(&corrupt, snapshotFormat))
+		require.NoError(t, encodeVarint(&corrupt, 1))
+		require.NoError(t, encodeVarint(&corrupt, 1))
+		require.NoError(t, encodeVarint(&corrupt, 0))
+		require.NoError(t, encodeVarint(&corrupt, 1))
+		require.NoError(t, encodeUvarint(&corrupt, size))
+		corrupt.WriteString("key")
+		_, err = restored.RestoreSnapshot(&corrupt)
+		require.Error(t, err, "length %d", size)
+	}
+	require.True(t, restored.IsEmpty())
+}
+
+func TestHashManifest(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte{7}, []byte("changed"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	var manifest bytes.Buffer
+	require.NoError(t, itree.ExportHashManifest(&manifest))
+	require.NoError(t, tree.VerifyHashManifest(version, bytes.NewReader(manifest.Bytes())))
+	require.Error(t, tree.VerifyHashManifest(version+1, bytes.NewReader(manifest.Bytes())))
+	require.ErrorIs(t, tree.VerifyHashManifest(version+2, bytes.NewReader(manifest.Bytes())), ErrVersionDoesNotExist)
+
+	// The manifest doesn't contain the keys or values.
+	require.False(t, bytes.Contains(manifest.Bytes(), []byte("changed")))
+
+	// A restored copy of the version matches the manifest.
+	var snapshot bytes.Buffer
+	require.NoError(t, tree.SnapshotVersion(version, &snapshot))
+	restored, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, err = restored.RestoreSnapshot(&snapshot)
+	require.NoError(t, err)
+	require.NoError(t, restored.VerifyHashManifest(version, bytes.NewReader(manifest.Bytes())))
+
+	// Truncated, extended and corrupted manifests are rejected.
+	bz := manifest.Bytes()
+	require.Error(t, tree.VerifyHashManifest(version, bytes.NewReader(bz[:len(bz)-1])))
+	require.Error(t, tree.VerifyHashManifest(version, bytes.NewReader(append(bz[:len(bz):len(bz)], 0))))
+	corrupted := append([]byte{}, bz...)
+	corrupted[len(corrupted)-1] ^= 1
+	require.Error(t, tree.VerifyHashManifest(version, bytes.NewReader(corrupted)))
+
+	// Empty trees have empty manifests, and unsaved trees can't be exported.
+	empty, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, version, err = empty.SaveVersion()
+	require.NoError(t, err)
+	manifest.Reset()
+	require.NoError(t, empty.ImmutableTree.ExportHashManifest(&manifest))
+	require.NoError(t, empty.VerifyHashManifest(version, &manifest))
+	empty.Set([]byte("a"), []byte{1})
+	require.Error(t, empty.ImmutableTree.ExportHashManifest(&bytes.Buffer{}))
+}
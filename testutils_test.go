@@ -72,7 +72,7 @@ func N(l, r interface{}) *Node {
 func T(n *Node) *MutableTree {
 	t, _ := getTestTree(0)
 
-	n.hashWithCount()
+	n.hashWithCount(nil)
 	t.root = n
 	return t
 }
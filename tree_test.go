@@ -3,18 +3,24 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/cosmos/iavl/cache"
 	cmn "github.com/cosmos/iavl/common"
 	db "github.com/tendermint/tm-db"
 )
@@ -1282,6 +1288,250 @@ func TestNilValueSemantics(t *testing.T) {
 	require.Panics(func() {
 		tree.Set([]byte("k"), nil)
 	})
+	require.Panics(func() {
+		tree.SetE([]byte("k"), nil) // nolint:errcheck
+	})
+}
+
+func TestNilValuePolicy(t *testing.T) {
+	require := require.New(t)
+
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{NilValuePolicy: RejectNil})
+	require.NoError(err)
+	_, err = tree.SetE([]byte("k"), nil)
+	require.Error(err)
+	require.False(tree.Has([]byte("k")))
+	require.Panics(func() {
+		tree.Set([]byte("k"), nil)
+	})
+	updated, err := tree.SetE([]byte("k"), []byte("v"))
+	require.NoError(err)
+	require.False(updated)
+
+	tree, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{NilValuePolicy: TreatNilAsEmpty})
+	require.NoError(err)
+	updated, err = tree.SetE([]byte("k"), nil)
+	require.NoError(err)
+	require.False(updated)
+	require.False(tree.Set([]byte("l"), nil))
+	require.Equal([]byte{}, tree.Get([]byte("k")))
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	require.Equal([]byte{}, tree.Get([]byte("k")))
+	require.Equal([]byte{}, tree.Get([]byte("l")))
+}
+
+func TestEmptyKey(t *testing.T) {
+	require := require.New(t)
+
+	// requireKeys checks the keys of the working tree and the given saved version, with and
+	// without fast storage, in both directions.
+	requireKeys := func(tree *MutableTree, version int64, expect ...[]byte) {
+		t.Helper()
+		itree, err := tree.GetImmutable(version)
+		require.NoError(err)
+		for _, ascending := range []bool{true, false} {
+			expected := append([][]byte{}, expect...)
+			if !ascending {
+				for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+					expected[i], expected[j] = expected[j], expected[i]
+				}
+			}
+			for _, itr := range []db.Iterator{
+				tree.Iterator(nil, nil, ascending),
+				itree.Iterator(nil, nil, ascending),
+				NewIterator(nil, nil, ascending, itree),
+			} {
+				keys := [][]byte{}
+				for ; itr.Valid(); itr.Next() {
+					keys = append(keys, itr.Key())
+				}
+				require.NoError(itr.Close())
+				require.Equal(expected, keys)
+			}
+		}
+		keys := [][]byte{}
+		tree.Iterate(func(key, value []byte) bool {
+			keys = append(keys, key)
+			return false
+		})
+		require.Equal(expect, keys)
+	}
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(err)
+	tree.Set([]byte("a"), []byte("1"))
+	require.False(tree.Set(nil, []byte("empty")))
+	require.True(tree.Set([]byte{}, []byte("0")))
+	_, version, err := tree.SaveVersion()
+	require.NoError(err)
+
+	require.Equal([]byte("0"), tree.Get(nil))
+	require.Equal([]byte("0"), tree.Get([]byte{}))
+	itree, err := tree.GetImmutable(version)
+	require.NoError(err)
+	require.Equal([]byte("0"), itree.Get([]byte{}))
+	index, value := itree.GetWithIndex(nil)
+	require.Zero(index)
+	require.Equal([]byte("0"), value)
+
+	// The empty key sorts before all other keys.
+	requireKeys(tree, version, []byte{}, []byte("a"))
+
+	// With RejectEmptyKey, an empty key already in the database can still be read and iterated
+	// over, but not set or removed.
+	strict, err := NewMutableTreeWithOpts(memDB, 0, &Options{RejectEmptyKey: true})
+	require.NoError(err)
+	_, err = strict.Load()
+	require.NoError(err)
+	require.Equal([]byte("0"), strict.Get(nil))
+	require.True(strict.Has([]byte{}))
+	requireKeys(strict, version, []byte{}, []byte("a"))
+	_, err = strict.SetE(nil, []byte("1"))
+	require.Error(err)
+	_, _, err = strict.RemoveE([]byte{})
+	require.Error(err)
+	require.Panics(func() {
+		strict.Remove(nil)
+	})
+	require.Panics(func() {
+		strict.RemoveIfPresent([]byte{})
+	})
+	_, err = strict.RemoveRange([]byte{}, []byte("b"))
+	require.Error(err)
+	_, err = strict.RemoveRange(nil, []byte{})
+	require.Error(err)
+	require.Equal([]byte("0"), strict.Get(nil))
+	require.EqualValues(2, strict.Size())
+
+	value, removed, err := tree.RemoveE(nil)
+	require.NoError(err)
+	require.True(removed)
+	require.Equal([]byte("0"), value)
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	require.Nil(tree.Get([]byte{}))
+	require.EqualValues(1, tree.Size())
+	requireKeys(tree, version, []byte("a"))
+
+	tree, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RejectEmptyKey: true})
+	require.NoError(err)
+	_, err = tree.SetE([]byte{}, []byte("0"))
+	require.Error(err)
+	_, err = tree.SetE(nil, []byte("0"))
+	require.Error(err)
+	require.Panics(func() {
+		tree.Set(nil, []byte("0"))
+	})
+	_, _, err = tree.RemoveE(nil)
+	require.Error(err)
+	require.Panics(func() {
+		tree.Remove([]byte{})
+	})
+	require.Panics(func() {
+		tree.RemoveIfPresent(nil)
+	})
+	_, err = tree.RemoveRange([]byte{}, nil)
+	require.Error(err)
+	require.EqualValues(0, tree.Size())
+	_, err = tree.SetE([]byte("a"), []byte("1"))
+	require.NoError(err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	require.Nil(tree.Get(nil))
+	requireKeys(tree, version, []byte("a"))
+	_, removed, err = tree.RemoveE([]byte("a"))
+	require.NoError(err)
+	require.True(removed)
+}
+
+func TestKeyValueSizeLimits(t *testing.T) {
+	require := require.New(t)
+
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxKeySize: 4, MaxValueSize: 8})
+	require.NoError(err)
+
+	_, err = tree.SetE([]byte("abcd"), []byte("12345678"))
+	require.NoError(err)
+	require.False(tree.Set([]byte("efgh"), []byte("1234")))
+
+	_, err = tree.SetE([]byte("abcde"), []byte("1"))
+	require.Error(err)
+	_, err = tree.SetE([]byte("abcd"), []byte("123456789"))
+	require.Error(err)
+	require.Panics(func() {
+		tree.Set([]byte("ijkl"), []byte("123456789"))
+	})
+
+	// Rejected sets must not modify the tree.
+	require.EqualValues(2, tree.Size())
+	require.Equal([]byte("12345678"), tree.Get([]byte("abcd")))
+	require.False(tree.Has([]byte("ijkl")))
+
+	// Zero means unlimited.
+	tree, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(err)
+	_, err = tree.SetE(make([]byte, 1024), make([]byte, 1<<20))
+	require.NoError(err)
+}
+
+func TestMaxHeight(t *testing.T) {
+	require := require.New(t)
+
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxHeight: 3})
+	require.NoError(err)
+
+	// Ascending keys fill a tree of height 3 with 8 keys.
+	var i int
+	for i = 0; ; i++ {
+		if _, err = tree.SetE(i2b(i), []byte{}); err != nil {
+			break
+		}
+		require.LessOrEqual(tree.Height(), int8(3))
+	}
+	require.Equal(8, i)
+	require.EqualValues(3, tree.Height())
+	hash := tree.WorkingHash()
+	require.Panics(func() { tree.Set(i2b(i), []byte{}) })
+
+	// Rejected sets must not modify the tree, and updates are still allowed.
+	require.Equal(hash, tree.WorkingHash())
+	require.EqualValues(8, tree.Size())
+	require.False(tree.Has(i2b(i)))
+	require.True(tree.Set(i2b(0), []byte{1}))
+
+	// Zero means unlimited.
+	tree, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(err)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), []byte{})
+	}
+	require.Greater(tree.Height(), int8(3))
+}
+
+func TestMaxHeight_Random(t *testing.T) {
+	// The height predicted before each set must match the height after it.
+	r := rand.New(rand.NewSource(1568))
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		key := []byte{byte(r.Intn(256)), byte(r.Intn(256))}
+		if r.Intn(4) == 0 {
+			tree.Remove(key)
+			continue
+		}
+		var expect int8
+		if tree.root != nil {
+			expect = tree.root.heightAfterSet(tree.ImmutableTree, key)
+		}
+		tree.Set(key, []byte{})
+		require.Equal(t, expect, tree.Height(), "set %d", i)
+		if r.Intn(100) == 0 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
 }
 
 func TestCopyValueSemantics(t *testing.T) {
@@ -1332,6 +1582,31 @@ func TestRollback(t *testing.T) {
 	require.Equal([]byte("v"), val)
 }
 
+func TestRollback_RetainsOnlySavedRoot(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(fmt.Sprintf("%04d", i)), []byte{byte(i)})
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Rewriting every key replaces every node of the working tree, but the saved tree only
+	// retains its detached root in memory.
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(fmt.Sprintf("%04d", i)), []byte{byte(i + 1)})
+	}
+	require.NotSame(t, tree.lastSaved.root, tree.root)
+	require.True(t, tree.lastSaved.root.persisted)
+	require.Nil(t, tree.lastSaved.root.leftNode)
+	require.Nil(t, tree.lastSaved.root.rightNode)
+	require.Equal(t, hash, tree.Hash())
+
+	tree.Rollback()
+	require.Equal(t, hash, tree.WorkingHash())
+	require.Equal(t, []byte{7}, tree.Get([]byte("0007")))
+}
+
 func TestLazyLoadVersion(t *testing.T) {
 	tree, err := getTestTree(0)
 	require.NoError(t, err)
@@ -1923,3 +2198,890 @@ func Benchmark_GetByIndex(b *testing.B) {
 		}
 	})
 }
+
+func TestSplitPoints_ImmutableTree(t *testing.T) {
+	for _, size := range []int{0, 1, 5, 100} {
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		for i := 0; i < size; i++ {
+			tree.Set([]byte(fmt.Sprintf("%03d", i*7%size)), []byte{byte(i)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(1)
+		require.NoError(t, err)
+
+		var expected [][]byte
+		itree.Iterate(func(key, value []byte) bool {
+			expected = append(expected, key)
+			return false
+		})
+
+		for _, n := range []int{0, 1, 2, 3, 4, 7, 10, 200} {
+			splits := itree.SplitPoints(n)
+			expectSplits := n - 1
+			if n > size {
+				expectSplits = size - 1
+			}
+			if expectSplits < 0 {
+				expectSplits = 0
+			}
+			require.Len(t, splits, expectSplits, "size %d n %d", size, n)
+
+			var actual [][]byte
+			bounds := append(append([][]byte{nil}, splits...), nil)
+			for i := 0; i < len(bounds)-1; i++ {
+				count := 0
+				itree.IterateRange(bounds[i], bounds[i+1], true, func(key, value []byte) bool {
+					actual = append(actual, key)
+					count++
+					return false
+				})
+				if size > 0 {
+					require.Positive(t, count, "size %d n %d range %d", size, n, i)
+					require.LessOrEqual(t, count, size/(len(splits)+1)+1)
+				}
+			}
+			require.Equal(t, expected, actual, "size %d n %d", size, n)
+		}
+	}
+}
+
+func TestIterateReverseFrom(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("%02d", i*2)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	collect := func(start []byte) []string {
+		keys := []string{}
+		itree.IterateReverseFrom(start, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		return keys
+	}
+	require.Equal(t, []string{"18", "16", "14", "12", "10", "08", "06", "04", "02", "00"}, collect(nil))
+	require.Equal(t, []string{"08", "06", "04", "02", "00"}, collect([]byte("10")))
+	require.Equal(t, []string{"10", "08", "06", "04", "02", "00"}, collect([]byte("11")))
+	require.Equal(t, []string{"18", "16"}, collect([]byte("99"))[:2])
+	require.Empty(t, collect([]byte("00")))
+	require.Empty(t, collect([]byte{}))
+
+	// Paginating backwards visits every key once.
+	pages := []string{}
+	var start []byte
+	for {
+		page := []string{}
+		itree.IterateReverseFrom(start, func(key, value []byte) bool {
+			page = append(page, string(key))
+			return len(page) == 3
+		})
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page...)
+		start = []byte(page[len(page)-1])
+	}
+	require.Equal(t, collect(nil), pages)
+
+	stopped := itree.IterateReverseFrom(nil, func(key, value []byte) bool { return true })
+	require.True(t, stopped)
+}
+
+func TestIterateExpired(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	// Values start with their expiry time, or are empty if they never expire.
+	expiries := map[string]int64{"a": 100, "b": 200, "c": 150, "d": -1, "e": 50, "f": 201}
+	for key, expiry := range expiries {
+		value := []byte{}
+		if expiry >= 0 {
+			value = make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(expiry))
+			value = append(value, "payload"...)
+		}
+		tree.Set([]byte(key), value)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	expiryFn := func(value []byte) int64 {
+		if len(value) < 8 {
+			return math.MaxInt64
+		}
+		return int64(binary.BigEndian.Uint64(value))
+	}
+	collect := func(now int64) []string {
+		keys := []string{}
+		stopped := itree.IterateExpired(now, expiryFn, func(key []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		require.False(t, stopped)
+		return keys
+	}
+	require.Empty(t, collect(0))
+	require.Equal(t, []string{"e"}, collect(50))
+	require.Equal(t, []string{"a", "c", "e"}, collect(199))
+	require.Equal(t, []string{"a", "b", "c", "e"}, collect(200))
+	require.Equal(t, []string{"a", "b", "c", "e", "f"}, collect(math.MaxInt64-1))
+
+	keys := []string{}
+	stopped := itree.IterateExpired(200, expiryFn, func(key []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) == 2
+	})
+	require.True(t, stopped)
+	require.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestIteratePage_ImmutableTree(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("%02d", i*2)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	for _, bounds := range [][2][]byte{
+		{nil, nil},
+		{[]byte("10"), []byte("60")},
+		{[]byte("11"), []byte("61")},
+		{[]byte("20"), nil},
+		{nil, []byte("20")},
+		{[]byte("50"), []byte("51")},
+		{[]byte("51"), []byte("52")},
+	} {
+		start, end := bounds[0], bounds[1]
+		for _, ascending := range []bool{true, false} {
+			var all [][]byte
+			itree.IterateRange(start, end, ascending, func(key, value []byte) bool {
+				all = append(all, key)
+				return false
+			})
+
+			for _, offset := range []int{0, 1, 7, 24, 25, 49, 50, 60} {
+				for _, limit := range []int{0, 1, 3, 10, 100} {
+					expect := [][]byte{}
+					if offset < len(all) {
+						expect = all[offset:]
+					}
+					if limit > 0 && limit < len(expect) {
+						expect = expect[:limit]
+					}
+					page := [][]byte{}
+					stopped := itree.IteratePage(start, end, ascending, offset, limit, func(key, value []byte) bool {
+						page = append(page, key)
+						return false
+					})
+					require.False(t, stopped)
+					require.Equal(t, expect, page, "range %q-%q ascending %v offset %v limit %v",
+						start, end, ascending, offset, limit)
+				}
+			}
+		}
+	}
+
+	// Stopping the iteration early is reported.
+	count := 0
+	require.True(t, itree.IteratePage(nil, nil, true, 10, 5, func(key, value []byte) bool {
+		count++
+		return count == 2
+	}))
+	require.Equal(t, 2, count)
+	require.Panics(t, func() { itree.IteratePage(nil, nil, true, -1, 0, nil) })
+}
+
+func TestNodeCount(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	leaves, inner := tree.NodeCount()
+	require.EqualValues(t, 0, leaves)
+	require.EqualValues(t, 0, inner)
+
+	check := func() {
+		leaves, inner := tree.NodeCount()
+		require.Equal(t, tree.Size(), leaves)
+		require.EqualValues(t, tree.nodeSize(), leaves+inner)
+	}
+
+	// Sequential inserts produce heavily rebalanced shapes, random ones less so.
+	for i := 0; i < 50; i++ {
+		tree.Set(i2b(i), []byte{1})
+		check()
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	check()
+
+	for i := 0; i < 200; i++ {
+		tree.Set(randBytes(4), []byte{2})
+		check()
+	}
+	for i := 0; i < 50; i += 3 {
+		tree.Remove(i2b(i))
+		check()
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	check()
+}
+
+func TestCommitParallelism(t *testing.T) {
+	newTree := func(parallelism int) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{CommitParallelism: parallelism})
+		require.NoError(t, err)
+		return tree
+	}
+
+	parallelisms := []int{0, 1, 2, 3, 4, 8, 64}
+	trees := make([]*MutableTree, len(parallelisms))
+	for i, parallelism := range parallelisms {
+		trees[i] = newTree(parallelism)
+	}
+
+	r := rand.New(rand.NewSource(0))
+	for version := 0; version < 5; version++ {
+		ops := make([][]byte, 2000)
+		for i := range ops {
+			ops[i] = []byte(strconv.Itoa(r.Intn(5000)))
+		}
+
+		var expectedHash []byte
+		for i, tree := range trees {
+			for j, key := range ops {
+				if j%5 == 0 {
+					tree.Remove(key)
+				} else {
+					tree.Set(key, []byte(strconv.Itoa(version)))
+				}
+			}
+			workingHash := tree.WorkingHash()
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, workingHash, hash)
+			if i == 0 {
+				expectedHash = hash
+			}
+			require.Equal(t, expectedHash, hash, "parallelism %d", parallelisms[i])
+		}
+	}
+}
+
+func BenchmarkCommitParallelism(b *testing.B) {
+	// 25k keys yield a tree of roughly 50k dirty nodes.
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(b, err)
+	for i := 0; i < 25000; i++ {
+		tree.Set(randBytes(16), randBytes(16))
+	}
+
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		tree.ndb.opts.CommitParallelism = parallelism
+		b.Run(fmt.Sprintf("parallelism-%d", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+					node.hash = nil
+					if !node.isLeaf() {
+						node.leftHash, node.rightHash = nil, nil
+					}
+					return false
+				})
+				b.StartTimer()
+
+				tree.WorkingHash()
+			}
+		})
+	}
+}
+
+func TestStructuralEqual(t *testing.T) {
+	build := func(keys []int, values map[int]string) *MutableTree {
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		for _, k := range keys {
+			value := "value"
+			if v, ok := values[k]; ok {
+				value = v
+			}
+			tree.Set([]byte(fmt.Sprintf("k%03d", k)), []byte(value))
+		}
+		return tree
+	}
+	save := func(tree *MutableTree) *ImmutableTree {
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		return itree
+	}
+	ascending := make([]int, 100)
+	for i := range ascending {
+		ascending[i] = i
+	}
+	descending := make([]int, 100)
+	for i := range descending {
+		descending[i] = 99 - i
+	}
+
+	// Identical trees, including a saved tree and an unsaved working tree.
+	tree := save(build(ascending, nil))
+	equal, key := tree.StructuralEqual(save(build(ascending, nil)))
+	require.True(t, equal)
+	require.Nil(t, key)
+	equal, key = tree.StructuralEqual(build(ascending, nil).WorkingImmutable())
+	require.True(t, equal)
+	require.Nil(t, key)
+
+	// Trees differing by a single value.
+	equal, key = tree.StructuralEqual(save(build(ascending, map[int]string{57: "other"})))
+	require.False(t, equal)
+	require.Equal(t, []byte("k057"), key)
+
+	// Trees with the same contents but a different shape.
+	other := save(build(descending, nil))
+	require.Equal(t, tree.Size(), other.Size())
+	equal, key = tree.StructuralEqual(other)
+	require.False(t, equal)
+	require.Equal(t, []byte("k036"), key)
+
+	// Trees with the same shape but different versions.
+	mtree := build(nil, nil)
+	_, _, err := mtree.SaveVersion()
+	require.NoError(t, err)
+	for _, k := range ascending {
+		mtree.Set([]byte(fmt.Sprintf("k%03d", k)), []byte("value"))
+	}
+	equal, key = tree.StructuralEqual(save(mtree))
+	require.False(t, equal)
+	require.Equal(t, []byte("k000"), key)
+
+	// Empty trees.
+	empty := &ImmutableTree{}
+	equal, key = empty.StructuralEqual(&ImmutableTree{})
+	require.True(t, equal)
+	require.Nil(t, key)
+	equal, key = empty.StructuralEqual(tree)
+	require.False(t, equal)
+	require.Equal(t, tree.root.key, key)
+}
+
+func TestImmutableTree_GetInto(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("value"))
+	tree.Set([]byte("b"), []byte{})
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("unsaved"))
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	n, found := itree.GetInto([]byte("a"), buf)
+	require.True(t, found)
+	require.Equal(t, []byte("value"), buf[:n])
+
+	// Too small buffers are left unmodified, and the needed length is returned.
+	small := []byte("xxxx")
+	n, found = itree.GetInto([]byte("a"), small)
+	require.True(t, found)
+	require.Equal(t, 5, n)
+	require.Equal(t, []byte("xxxx"), small)
+
+	n, found = itree.GetInto([]byte("b"), nil)
+	require.True(t, found)
+	require.Zero(t, n)
+	n, found = itree.GetInto([]byte("c"), buf)
+	require.False(t, found)
+	require.Zero(t, n)
+
+	// The mutable tree reads the working tree.
+	buf = make([]byte, 16)
+	n, found = tree.GetInto([]byte("a"), buf)
+	require.True(t, found)
+	require.Equal(t, []byte("unsaved"), buf[:n])
+}
+
+func BenchmarkImmutableTree_GetInto(b *testing.B) {
+	tree, err := NewMutableTree(db.NewMemDB(), 10000)
+	require.NoError(b, err)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i))
+		tree.Set(keys[i], []byte(fmt.Sprintf("value%04d", i)))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(b, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(b, err)
+
+	buf := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found := itree.GetInto(keys[i%len(keys)], buf); !found {
+			b.Fatal("key not found")
+		}
+	}
+}
+
+func TestPrefixHash(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 4; i++ {
+			tree.Set([]byte(fmt.Sprintf("%s/%d", prefix, i)), []byte{byte(i)})
+		}
+	}
+	tree.Set([]byte("e"), []byte{1})
+	tree.Set([]byte{0xff, 0xff}, []byte{2})
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	// Find the expected subtree for each prefix by brute force, collecting the keys of each node.
+	var visit func(node *Node) [][]byte
+	subtrees := map[string][]byte{}
+	visit = func(node *Node) [][]byte {
+		keys := [][]byte{node.key}
+		if !node.isLeaf() {
+			keys = append(visit(node.getLeftNode(itree)), visit(node.getRightNode(itree))...)
+		}
+		subtrees[fmt.Sprintf("%q", keys)] = node.hash
+		return keys
+	}
+	visit(itree.root)
+
+	aligned, unaligned := 0, 0
+	for _, prefix := range []string{"", "a", "a/", "a/1", "b", "b/", "c", "d/", "d/3", "e", "\xff", "\xff\xff", "a/0", "x", "a/9"} {
+		var keys [][]byte
+		itree.Iterate(func(key, value []byte) bool {
+			if bytes.HasPrefix(key, []byte(prefix)) {
+				keys = append(keys, key)
+			}
+			return false
+		})
+
+		hash, err := itree.PrefixHash([]byte(prefix))
+		expected, ok := subtrees[fmt.Sprintf("%q", keys)]
+		if len(keys) > 0 && ok {
+			require.NoError(t, err, "prefix %q", prefix)
+			require.Equal(t, expected, hash, "prefix %q", prefix)
+			aligned++
+		} else {
+			require.Error(t, err, "prefix %q", prefix)
+			require.Nil(t, hash)
+			if len(keys) > 0 {
+				unaligned++
+			}
+		}
+	}
+	require.Positive(t, aligned)
+	require.Positive(t, unaligned)
+
+	hash, err := itree.PrefixHash(nil)
+	require.NoError(t, err)
+	require.Equal(t, itree.Hash(), hash)
+
+	// The working tree is hashed as needed.
+	tree.Set([]byte("a/4"), []byte{4})
+	hash, err = tree.PrefixHash([]byte("a/4"))
+	require.NoError(t, err)
+	require.NotNil(t, hash)
+
+	_, err = (&ImmutableTree{}).PrefixHash(nil)
+	require.Error(t, err)
+}
+
+func TestWalkNodes(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		tree.Set([]byte(fmt.Sprintf("%03d", i*7%200)), []byte{byte(i)})
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// Load the tree from the database, so that nodes are walked lazily.
+	tree, err = NewMutableTree(tree.ndb.db, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	var expected []NodeInfo
+	itree.root.traverse(itree, true, func(node *Node) bool {
+		info := NodeInfo{Hash: node.hash, Key: node.key, Height: node.height, Size: node.size, Version: node.version}
+		if node.isLeaf() {
+			info.Value = node.value
+		}
+		expected = append(expected, info)
+		return false
+	})
+
+	var walked []NodeInfo
+	leaves, inner := 0, 0
+	err = itree.WalkNodes(func(node NodeInfo) bool {
+		walked = append(walked, node)
+		if node.Height == 0 {
+			leaves++
+			require.NotNil(t, node.Value)
+		} else {
+			inner++
+			require.Nil(t, node.Value)
+		}
+		return false
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, itree.Size(), leaves)
+	require.EqualValues(t, itree.Size()-1, inner)
+	require.Equal(t, expected, walked)
+	require.Equal(t, itree.Hash(), walked[0].Hash)
+
+	// The walk stops when fn returns true.
+	count := 0
+	require.NoError(t, itree.WalkNodes(func(node NodeInfo) bool {
+		count++
+		return count == 10
+	}))
+	require.Equal(t, 10, count)
+
+	// Unsaved working trees are walked in memory.
+	tree.Set([]byte("new"), []byte{1})
+	leaves = 0
+	require.NoError(t, tree.WalkNodes(func(node NodeInfo) bool {
+		if node.Height == 0 {
+			leaves++
+		}
+		return false
+	}))
+	require.EqualValues(t, tree.Size(), leaves)
+
+	require.NoError(t, (&ImmutableTree{}).WalkNodes(func(node NodeInfo) bool {
+		t.Fatal("empty tree walked")
+		return false
+	}))
+
+	// Nodes missing from the database are reported as errors.
+	require.NoError(t, tree.ndb.db.Delete(tree.ndb.nodeKey(walked[len(walked)-1].Hash)))
+	err = itree.WalkNodes(func(node NodeInfo) bool { return false })
+	require.Error(t, err)
+}
+
+func TestBalanceFactors(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	maxBalance, unbalanced := tree.BalanceFactors()
+	require.Zero(t, maxBalance)
+	require.Zero(t, unbalanced)
+
+	// Sequential and random inserts and removals keep the tree balanced.
+	for i := 0; i < 500; i++ {
+		tree.Set(i2b(i), []byte{1})
+	}
+	for i := 0; i < 500; i++ {
+		tree.Set(randBytes(4), []byte{2})
+	}
+	for i := 0; i < 500; i += 3 {
+		tree.Remove(i2b(i))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	maxBalance, unbalanced = itree.BalanceFactors()
+	require.LessOrEqual(t, maxBalance, 1)
+	require.Positive(t, maxBalance)
+	require.Zero(t, unbalanced)
+
+	// A chain of nodes to the right is detected.
+	empty := &ImmutableTree{}
+	leaf := func(key string) *Node {
+		return NewNode([]byte(key), []byte{1}, 1)
+	}
+	inner := func(left, right *Node) *Node {
+		node := &Node{key: right.lmd(empty).key, version: 1, leftNode: left, rightNode: right}
+		node.calcHeightAndSize(empty)
+		return node
+	}
+	corrupted := &ImmutableTree{root: inner(leaf("a"), inner(leaf("b"), inner(leaf("c"), inner(leaf("d"), leaf("e")))))}
+	maxBalance, unbalanced = corrupted.BalanceFactors()
+	require.Equal(t, 3, maxBalance)
+	require.Equal(t, 2, unbalanced)
+}
+
+// newConcurrentReadTree returns a tree with two saved versions, where reads of the first version
+// traverse the nodes rather than fast storage, and its keys.
+func newConcurrentReadTree(t require.TestingT, cacheSize int) (*MutableTree, [][]byte) {
+	tree, err := NewMutableTree(db.NewMemDB(), cacheSize)
+	require.NoError(t, err)
+	keys := make([][]byte, 5000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%05d", i))
+		tree.Set(keys[i], keys[i])
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, key := range keys {
+		tree.Set(key, []byte("updated"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	return tree, keys
+}
+
+func TestConcurrentImmutableReaders(t *testing.T) {
+	tree, keys := newConcurrentReadTree(t, 20000)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			itree, err := tree.GetImmutable(1)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := range keys {
+				key := keys[(i*7+g)%len(keys)]
+				if _, value := itree.GetWithIndex(key); !bytes.Equal(key, value) {
+					errs <- fmt.Errorf("unexpected value %q for key %q", value, key)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func BenchmarkConcurrentImmutableReaders(b *testing.B) {
+	tree, keys := newConcurrentReadTree(b, 20000)
+	for _, shards := range []int{1, nodeCacheShards} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			tree.ndb.nodeCache = cache.NewSharded(20000, shards)
+			itree, err := tree.GetImmutable(1)
+			require.NoError(b, err)
+			itree.Iterate(func(key, value []byte) bool { return false }) // warm the cache
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			var next int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := atomic.AddInt64(&next, 1)
+				for pb.Next() {
+					itree.GetWithIndex(keys[i%int64(len(keys))])
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func TestIterateNewLeaves(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	expected := map[int64][]string{}
+	for v := int64(1); v <= 3; v++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("v%d-%02d", v, (i*7)%30)
+			tree.Set([]byte(key), []byte{byte(v)})
+		}
+		// Overwrite some keys of earlier versions, which makes them new at this version.
+		if v > 1 {
+			for i := 0; i < 30; i += 10 {
+				key := fmt.Sprintf("v%d-%02d", v-1, i)
+				tree.Set([]byte(key), []byte{byte(v)})
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// Removing a key doesn't make any leaves new.
+	tree.Remove([]byte("v1-05"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	itree, err := tree.GetImmutable(4)
+	require.NoError(t, err)
+	itree.Iterate(func(key, value []byte) bool {
+		version := int64(value[0])
+		expected[version] = append(expected[version], string(key))
+		return false
+	})
+	for v := int64(1); v <= 4; v++ {
+		var keys []string
+		stopped := itree.IterateNewLeaves(v, func(key, value []byte) bool {
+			require.EqualValues(t, v, value[0])
+			keys = append(keys, string(key))
+			return false
+		})
+		require.False(t, stopped)
+		require.Equal(t, expected[v], keys, "version %d", v)
+	}
+	require.Len(t, expected[1], 26)
+	require.Len(t, expected[2], 30)
+	require.Len(t, expected[3], 33)
+	require.Empty(t, expected[4])
+
+	// Earlier versions see the leaves as of that version.
+	itree, err = tree.GetImmutable(2)
+	require.NoError(t, err)
+	var keys []string
+	itree.IterateNewLeaves(2, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.Len(t, keys, 33)
+
+	count := 0
+	require.True(t, itree.IterateNewLeaves(1, func(key, value []byte) bool {
+		count++
+		return count == 5
+	}))
+	require.Equal(t, 5, count)
+}
+
+func TestNewReadSnapshotTree(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v1"))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	expected := tree.lastSaved.String()
+
+	_, err = NewReadSnapshotTree(memDB, version+1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	snapshot, err := NewReadSnapshotTree(memDB, version)
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), snapshot.Hash())
+
+	// The writer saves and prunes newer versions, while the snapshot reads the pinned version.
+	done := make(chan error, 1)
+	go func() {
+		for v := 2; v <= 30; v++ {
+			for i := 0; i < 100; i += v%7 + 1 {
+				tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v%d", v)))
+				if i == 0 {
+					tree.Remove([]byte("key050"))
+				}
+			}
+			if _, _, err := tree.SaveVersion(); err != nil {
+				done <- err
+				return
+			}
+			if v > 3 {
+				if err := tree.DeleteVersion(int64(v - 1)); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	for reads := 0; ; reads++ {
+		require.Equal(t, expected, snapshot.String())
+		require.Equal(t, []byte("v1"), snapshot.Get([]byte("key050")))
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			require.Positive(t, reads)
+			require.Equal(t, expected, snapshot.String())
+			require.EqualValues(t, 30, tree.Version())
+			return
+		default:
+		}
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, _, ok := tree.Floor([]byte("a"))
+	require.False(t, ok)
+	_, _, ok = tree.Ceiling([]byte("a"))
+	require.False(t, ok)
+
+	keys := []string{}
+	for i := 1; i <= 50; i++ {
+		key := fmt.Sprintf("%03d", i*2)
+		keys = append(keys, key)
+		tree.Set([]byte(key), []byte("v"+key))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		key     string
+		floor   string
+		ceiling string
+	}{
+		{"002", "002", "002"}, // exact matches
+		{"050", "050", "050"},
+		{"100", "100", "100"},
+		{"051", "050", "052"}, // between keys
+		{"0505", "050", "052"},
+		{"", "", "002"}, // out of range
+		{"001", "", "002"},
+		{"101", "100", ""},
+		{"999", "100", ""},
+	}
+	for _, tc := range testCases {
+		k, v, ok := itree.Floor([]byte(tc.key))
+		require.Equal(t, tc.floor != "", ok, "floor of %q", tc.key)
+		if ok {
+			require.Equal(t, tc.floor, string(k), "floor of %q", tc.key)
+			require.Equal(t, "v"+tc.floor, string(v), "floor of %q", tc.key)
+		}
+		k, v, ok = itree.Ceiling([]byte(tc.key))
+		require.Equal(t, tc.ceiling != "", ok, "ceiling of %q", tc.key)
+		if ok {
+			require.Equal(t, tc.ceiling, string(k), "ceiling of %q", tc.key)
+			require.Equal(t, "v"+tc.ceiling, string(v), "ceiling of %q", tc.key)
+		}
+	}
+
+	// Compare against a search of the sorted keys for every possible probe.
+	for i := 0; i <= 102; i++ {
+		probe := fmt.Sprintf("%03d", i)
+		j := sort.SearchStrings(keys, probe)
+		k, _, ok := itree.Ceiling([]byte(probe))
+		require.Equal(t, j < len(keys), ok)
+		if ok {
+			require.Equal(t, keys[j], string(k))
+		}
+		if j == len(keys) || keys[j] != probe {
+			j--
+		}
+		k, _, ok = itree.Floor([]byte(probe))
+		require.Equal(t, j >= 0, ok)
+		if ok {
+			require.Equal(t, keys[j], string(k))
+		}
+	}
+}
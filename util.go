@@ -31,7 +31,7 @@ func printNode(ndb *nodeDB, node *Node, indent int) {
 		printNode(ndb, rightNode, indent+1)
 	}
 
-	hash := node._hash()
+	hash := node._hash(ndb.opts.LeafHashSalt)
 	fmt.Printf("%sh:%X\n", indentPrefix, hash)
 	if node.isLeaf() {
 		fmt.Printf("%s%X:%X (%v)\n", indentPrefix, node.key, node.value, node.height)
@@ -59,6 +59,26 @@ func cp(bz []byte) (ret []byte) {
 	return ret
 }
 
+// copyValue returns a copy of a value, keeping nil values nil.
+func copyValue(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return cp(value)
+}
+
+// getInto copies a value into dst if it fits, for GetInto, returning the value length and whether
+// it exists.
+func getInto(value []byte, dst []byte) (n int, found bool) {
+	if value == nil {
+		return 0, false
+	}
+	if len(value) <= len(dst) {
+		copy(dst, value)
+	}
+	return len(value), true
+}
+
 // Returns a slice of the same length (big endian)
 // except incremented by one.
 // Appends 0x00 if bz is all 0xFF.
@@ -81,6 +101,19 @@ func cpIncr(bz []byte) (ret []byte) {
 	return []byte{0x00}
 }
 
+// prefixEnd returns the smallest key greater than all keys starting with prefix, or nil if there is
+// no such key, i.e. if the prefix is all 0xFF.
+func prefixEnd(prefix []byte) []byte {
+	end := cp(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 type byteslices [][]byte
 
 func (bz byteslices) Len() int {
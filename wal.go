@@ -0,0 +1,225 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// WAL is an append-only log of records, used by Options.WAL to journal changes to the working tree
+// so that they can be recovered with MutableTree.ReplayWAL after a crash.
+type WAL interface {
+	// Append durably appends a record to the log.
+	Append(record []byte) error
+
+	// Records returns all records appended since the log was last truncated, in order.
+	Records() ([][]byte, error)
+
+	// Truncate discards all records.
+	Truncate() error
+}
+
+// walOp identifies the operation of a WAL record.
+type walOp byte
+
+const (
+	walOpSet    walOp = 1
+	walOpRemove walOp = 2
+)
+
+// journal appends a record of a working tree operation to Options.WAL, if any. The value is only
+// recorded for walOpSet.
+func (tree *MutableTree) journal(op walOp, key, value []byte) error {
+	wal := tree.ndb.opts.WAL
+	if wal == nil || tree.replayingWAL {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(byte(op))
+	if err := encodeBytes(&buf, key); err != nil {
+		return err
+	}
+	if op == walOpSet {
+		if err := encodeBytes(&buf, value); err != nil {
+			return err
+		}
+	}
+	if err := wal.Append(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "failed to journal operation")
+	}
+	return nil
+}
+
+// truncateWAL discards the journaled operations once they are no longer needed for recovery, i.e.
+// when the working tree has been saved or rolled back.
+func (tree *MutableTree) truncateWAL() error {
+	if tree.ndb.opts.WAL == nil {
+		return nil
+	}
+	return errors.Wrap(tree.ndb.opts.WAL.Truncate(), "failed to truncate WAL")
+}
+
+// ReplayWAL reapplies the operations journaled to Options.WAL since the last save to the working
+// tree, and returns the number of operations replayed. It should be called after loading the
+// tree following a restart, before any other changes, to recover the working tree as it was
+// before a crash. Operations of a save which was committed before the WAL was truncated are
+// replayed onto the saved version again, which leaves the working tree unchanged.
+func (tree *MutableTree) ReplayWAL() (int, error) {
+	wal := tree.ndb.opts.WAL
+	if wal == nil {
+		return 0, errors.New("no WAL configured")
+	}
+	records, err := wal.Records()
+	if err != nil {
+		return 0, err
+	}
+
+	tree.replayingWAL = true
+	defer func() { tree.replayingWAL = false }()
+
+	for i, record := range records {
+		if len(record) == 0 {
+			return i, errors.Errorf("empty WAL record %d", i)
+		}
+		key, n, err := decodeBytes(record[1:])
+		if err != nil {
+			return i, errors.Wrapf(err, "invalid WAL record %d", i)
+		}
+		switch walOp(record[0]) {
+		case walOpSet:
+			value, _, err := decodeBytes(record[1+n:])
+			if err != nil {
+				return i, errors.Wrapf(err, "invalid WAL record %d", i)
+			}
+			if _, _, err := tree.setE(key, value); err != nil {
+				return i, errors.Wrapf(err, "failed to replay WAL record %d", i)
+			}
+		case walOpRemove:
+			if _, _, err := tree.RemoveE(key); err != nil {
+				return i, errors.Wrapf(err, "failed to replay WAL record %d", i)
+			}
+		default:
+			return i, errors.Errorf("unknown operation %d in WAL record %d", record[0], i)
+		}
+	}
+	return len(records), nil
+}
+
+// FileWAL is a WAL stored in a file, which is synced to disk on every append. Each record is
+// stored with its length and a checksum. A record which was only partially written at the end of
+// the file, e.g. due to a crash, is discarded, while other corrupt records are reported as errors.
+type FileWAL struct {
+	mtx  sync.Mutex
+	file *os.File
+}
+
+var _ WAL = (*FileWAL)(nil)
+
+// walChecksumTable is the CRC-32 table used for the checksums of FileWAL records.
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewFileWAL opens the WAL stored in the file at path, creating it if it doesn't exist. A partially
+// written record at the end of the file is discarded. It returns an error if any other record is
+// corrupt.
+func NewFileWAL(path string) (*FileWAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWAL{file: file}
+	_, size, err := w.readRecords()
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Append implements WAL.
+func (w *FileWAL) Append(record []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var buf bytes.Buffer
+	if err := encodeBytes(&buf, record); err != nil {
+		return err
+	}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(record, walChecksumTable))
+	buf.Write(checksum[:])
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Records implements WAL.
+func (w *FileWAL) Records() ([][]byte, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	records, _, err := w.readRecords()
+	return records, err
+}
+
+// readRecords reads the records in the file, and returns them along with the size of the file up
+// to the end of the last complete record. A record extending past the end of the file was only
+// partially written, and ends the log, while a complete record with an invalid length or checksum
+// is an error.
+func (w *FileWAL) readRecords() (records [][]byte, size int64, err error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	bz, err := ioutil.ReadAll(w.file)
+	if err != nil {
+		return nil, 0, err
+	}
+	records = [][]byte{}
+	for len(bz) > 0 {
+		length, n := binary.Uvarint(bz)
+		if n == 0 {
+			break // partially written length
+		}
+		if n < 0 {
+			return nil, 0, errors.Errorf("invalid WAL record length at offset %d", size)
+		}
+		if length > uint64(len(bz)-n) || uint64(len(bz)-n)-length < 4 {
+			break // partially written record
+		}
+		end := n + int(length)
+		record := bz[n:end]
+		if crc32.Checksum(record, walChecksumTable) != binary.BigEndian.Uint32(bz[end:end+4]) {
+			return nil, 0, errors.Errorf("invalid WAL record checksum at offset %d", size)
+		}
+		records = append(records, append([]byte{}, record...))
+		bz = bz[end+4:]
+		size += int64(end + 4)
+	}
+	return records, size, nil
+}
+
+// Truncate implements WAL.
+func (w *FileWAL) Truncate() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Close closes the WAL file.
+func (w *FileWAL) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.file.Close()
+}
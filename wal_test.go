@@ -0,0 +1,192 @@
+package iavl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestFileWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-iavl-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wal")
+	wal, err := NewFileWAL(path)
+	require.NoError(t, err)
+	require.NoError(t, wal.Append([]byte("a")))
+	require.NoError(t, wal.Append([]byte{}))
+	require.NoError(t, wal.Append([]byte("c")))
+	records, err := wal.Records()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), {}, []byte("c")}, records)
+	require.NoError(t, wal.Close())
+
+	// Simulate a crash while appending a record, which is discarded on reopening.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{5, 'd', 'e'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	wal, err = NewFileWAL(path)
+	require.NoError(t, err)
+	require.NoError(t, wal.Append([]byte("f")))
+	records, err = wal.Records()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), {}, []byte("c"), []byte("f")}, records)
+
+	require.NoError(t, wal.Truncate())
+	records, err = wal.Records()
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.NoError(t, wal.Append([]byte("g")))
+	records, err = wal.Records()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("g")}, records)
+	require.NoError(t, wal.Append([]byte("h")))
+	require.NoError(t, wal.Close())
+
+	// Corruption before the end of the file is an error, and the file is left intact.
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	corrupt := append([]byte{}, bz...)
+	corrupt[1] = 'x'
+	require.NoError(t, ioutil.WriteFile(path, corrupt, 0o644))
+	_, err = NewFileWAL(path)
+	require.Error(t, err)
+	stored, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, corrupt, stored)
+
+	// So is an invalid length, even in the last record.
+	corrupt = append(append([]byte{}, bz...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+	require.NoError(t, ioutil.WriteFile(path, corrupt, 0o644))
+	_, err = NewFileWAL(path)
+	require.Error(t, err)
+
+	// Records with errors aren't returned by an open WAL either.
+	require.NoError(t, ioutil.WriteFile(path, bz, 0o644))
+	wal, err = NewFileWAL(path)
+	require.NoError(t, err)
+	defer wal.Close()
+	corrupt = append([]byte{}, bz...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, corrupt, 0o644))
+	_, err = wal.Records()
+	require.Error(t, err)
+}
+
+// failingWAL is a WAL which fails all operations.
+type failingWAL struct{}
+
+func (failingWAL) Append(record []byte) error { return errors.New("append failed") }
+func (failingWAL) Records() ([][]byte, error) { return nil, errors.New("read failed") }
+func (failingWAL) Truncate() error            { return errors.New("truncate failed") }
+
+func TestMutableTree_WALErrors(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{WAL: failingWAL{}})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	// The variants returning errors leave the tree unchanged, while the others panic.
+	_, err = tree.SetE([]byte("b"), []byte("2"))
+	require.Error(t, err)
+	_, _, err = tree.RemoveE([]byte("a"))
+	require.Error(t, err)
+	require.Panics(t, func() { tree.Set([]byte("b"), []byte("2")) })
+	require.Panics(t, func() { tree.Remove([]byte("a")) })
+	require.Equal(t, []byte("1"), tree.Get([]byte("a")))
+	require.Nil(t, tree.Get([]byte("b")))
+
+	require.Error(t, tree.RollbackE())
+	require.Panics(t, tree.Rollback)
+	_, err = tree.ReplayWAL()
+	require.Error(t, err)
+}
+
+func TestMutableTree_ReplayWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-iavl-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wal")
+	memDB := db.NewMemDB()
+	wal, err := NewFileWAL(path)
+	require.NoError(t, err)
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{WAL: wal})
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	tree.Set([]byte("c"), []byte("3"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	records, err := wal.Records()
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// Changes rolled back are discarded from the WAL.
+	tree.Set([]byte("x"), []byte("0"))
+	tree.Rollback()
+	records, err = wal.Records()
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	tree.Set([]byte("a"), []byte("10"))
+	tree.Remove([]byte("b"))
+	tree.Set([]byte("d"), []byte("4"))
+	_, _, err = tree.RemoveE([]byte("d"))
+	require.NoError(t, err)
+	tree.Set([]byte("e"), []byte{})
+	_, err = tree.RemoveRange([]byte("c"), []byte("d"))
+	require.NoError(t, err)
+	workingHash := tree.WorkingHash()
+
+	// Simulate a crash, and recover the working tree in a new process.
+	require.NoError(t, wal.Close())
+	wal, err = NewFileWAL(path)
+	require.NoError(t, err)
+	defer wal.Close()
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{WAL: wal})
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+
+	count, err := tree.ReplayWAL()
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+	require.Equal(t, workingHash, tree.WorkingHash())
+	require.Equal(t, []byte("10"), tree.Get([]byte("a")))
+	require.Nil(t, tree.Get([]byte("b")))
+	require.Nil(t, tree.Get([]byte("c")))
+	require.Nil(t, tree.Get([]byte("d")))
+	require.Equal(t, []byte{}, tree.Get([]byte("e")))
+
+	// Replaying doesn't journal the operations again.
+	records, err = wal.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, workingHash, hash)
+	count, err = tree.ReplayWAL()
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	_, err = NewMutableTreeWithOpts(memDB, 0, &Options{WAL: wal, DeferCommit: true})
+	require.Error(t, err)
+}